@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/carprks/account/service"
+	"github.com/joho/godotenv"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// account-reconcile brings existing accounts in line with their role
+// templates, the accounts are read one per line as "identifier" or
+// "identifier role" and the summary is written to stdout as json
+func main() {
+	// .env is optional, the environment wins
+	_ = godotenv.Load()
+
+	in := flag.String("in", "-", "file of accounts, - for stdin")
+	dryRun := flag.Bool("dry-run", false, "report the differences without changing anything")
+	removeExtra := flag.Bool("remove-extra", false, "take away permissions that aren't in the template, by default they are left")
+	rate := flag.Float64("rate", 5, "most accounts a second, 0 for no limit")
+	checkpoint := flag.String("checkpoint", "", "file to resume from, kept until the list is finished")
+	flag.Parse()
+
+	_, err := service.NewRoleTemplates()
+	if err != nil {
+		fail(err)
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// stdout is for the summary
+	s := service.NewService()
+	s.Logger = service.NewLogger(os.Stderr, service.ParseLevel(os.Getenv("LOG_LEVEL")))
+
+	rec := service.Reconciler{
+		Service: s,
+		Options: service.ReconcileOptions{
+			DryRun:      *dryRun,
+			RemoveExtra: *removeExtra,
+		},
+		Checkpoint: *checkpoint,
+	}
+	if *rate > 0 {
+		rec.Interval = time.Duration(float64(time.Second) / *rate)
+	}
+
+	// stop between accounts so the checkpoint is where the run got to
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	sum, err := rec.Run(ctx, r)
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	if eerr := out.Encode(sum); eerr != nil {
+		fail(eerr)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if sum.Failed >= 1 || sum.Stopped != "" {
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/carprks/account/service"
+	"github.com/joho/godotenv"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	// .env is optional, the environment wins
+	_ = godotenv.Load()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "80"
+	}
+
+	err := service.CheckConfig()
+	if err != nil {
+		service.DefaultLogger.Error("config", service.Fields{"err": err})
+		os.Exit(1)
+	}
+
+	s := service.NewService()
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%s", port),
+		Handler:           s.Router(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		s.Logger.Info("listening", service.Fields{"port": port})
+		errs <- srv.ListenAndServe()
+	}()
+
+	// nothing schedules the server, so it runs the jobs itself
+	work, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+	go func() {
+		ticker := time.NewTicker(service.WorkerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = s.Work(work)
+			case <-work.Done():
+				return
+			}
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		s.Logger.Error("server err", service.Fields{"err": err})
+		os.Exit(1)
+	case sig := <-stop:
+		s.Logger.Info("shutting down", service.Fields{"signal": sig.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		s.Logger.Error("shutdown err", service.Fields{"err": err})
+		os.Exit(1)
+	}
+}
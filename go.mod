@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/aws/aws-lambda-go v1.13.0
+	github.com/aws/aws-sdk-go v1.23.9
 	github.com/badoux/checkmail v0.0.0-20181210160741-9661bd69e9ad
 	github.com/carprks/login v0.0.0-20190827174259-dc4267c355e9
 	github.com/carprks/permissions v0.0.0-20190827133130-c539e74aa410
@@ -12,4 +13,5 @@ require (
 	github.com/keloran/go-healthcheck v0.0.0-20190531235443-d828d6042163
 	github.com/keloran/go-probe v0.0.0-20190520144024-f910985758fc
 	github.com/stretchr/testify v1.4.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -3,8 +3,21 @@ package main
 import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/carprks/account/service"
+	"os"
 )
 
 func main() {
+	err := service.CheckConfig()
+	if err != nil {
+		service.DefaultLogger.Error("config", service.Fields{"err": err})
+		os.Exit(1)
+	}
+
+	// the same build runs the scheduled jobs
+	if os.Getenv("ACCOUNT_WORKER") != "" {
+		lambda.Start(service.WorkContext)
+		return
+	}
+
 	lambda.Start(service.Handler)
 }
@@ -1,34 +1,48 @@
 package service
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	permissions "github.com/carprks/permissions/service"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"time"
+	"sync"
+)
+
+const (
+	// AllowedBatchWorkers how many checks of a batch are sent to the permissions service at once
+	AllowedBatchWorkers = 8
+	// AllowedBatchMax the most checks in a batch
+	AllowedBatchMax = 100
 )
 
 // AllowedHandler ...
 func AllowedHandler(body string) (string, error) {
+	return AllowedHandlerContext(context.Background(), body)
+}
+
+// AllowedHandlerContext AllowedHandler bounded by ctx
+func AllowedHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().AllowedHandler(ctx, body)
+}
+
+// AllowedHandler ...
+func (s Service) AllowedHandler(ctx context.Context, body string) (string, error) {
 	r := permissions.Permissions{}
 	err := json.Unmarshal([]byte(body), &r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't unmarshall input: %v, %v", err, body))
-		return "", fmt.Errorf("can't unmarshall input: %w", err)
+		s.Logger.Error("can't unmarshall input", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall input: %w", WithKind(ErrValidation, err))
 	}
 
-	rf, err := Allowed(r)
+	rf, err := s.Allowed(ctx, r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't get allowed: %v, %v", err, r))
+		s.Logger.Error("can't get allowed", Fields{"err": err, "request": r})
 		return "", fmt.Errorf("can't get allowed: %w", err)
 	}
 
 	rfb, err := json.Marshal(rf)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't marshal allowed: %v, %v", err, rf))
+		s.Logger.Error("can't marshal allowed", Fields{"err": err, "response": rf})
 		return "", fmt.Errorf("can't unmarshal allowed: %w", err)
 	}
 
@@ -37,51 +51,230 @@ func AllowedHandler(body string) (string, error) {
 
 // Allowed ...
 func Allowed(p permissions.Permissions) (permissions.Permissions, error) {
-	pr := permissions.Permissions{}
+	return AllowedContext(context.Background(), p)
+}
 
-	j, err := json.Marshal(&p)
+// AllowedContext Allowed bounded by ctx
+func AllowedContext(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	return NewService().Allowed(ctx, p)
+}
+
+// Allowed ...
+func (s Service) Allowed(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	if s.Cache != nil {
+		pr, err := s.allowedCached(ctx, p)
+		if err != nil {
+			s.Logger.Error("allowed err", Fields{"err": err})
+		}
+		return pr, err
+	}
+
+	pr := permissions.Permissions{}
+	err := s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		var err error
+		pr, err = s.PermissionsClient.Allowed(ctx, p)
+		return err
+	})
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't unmarshal permissions: %v, %v", err, p))
-		return pr, fmt.Errorf("can't unmarshal permissions: %w", err)
+		s.Logger.Error("allowed err", Fields{"err": err})
+		return pr, err
+	}
+
+	return pr, nil
+}
+
+// AllowedBatchConfig how batches are checked, ALLOWED_BATCH_WORKERS and
+// ALLOWED_BATCH_MAX change the defaults, a zero value has no limits
+type AllowedBatchConfig struct {
+	Workers int
+	Max     int
+}
+
+// NewAllowedBatchConfig ...
+func NewAllowedBatchConfig() AllowedBatchConfig {
+	return AllowedBatchConfig{
+		Workers: envInt("ALLOWED_BATCH_WORKERS", AllowedBatchWorkers),
+		Max:     envInt("ALLOWED_BATCH_MAX", AllowedBatchMax),
 	}
+}
+
+// AllowedCheck can identifier do action to name, on the resource when it is given
+type AllowedCheck struct {
+	Identifier         string `json:"identifier"`
+	Name               string `json:"name"`
+	Action             string `json:"action"`
+	ResourceIdentifier string `json:"resource_identifier,omitempty"`
+}
+
+// AllowedBatchRequest ...
+type AllowedBatchRequest struct {
+	Checks []AllowedCheck `json:"checks"`
+}
+
+// AllowedResult the outcome of a check, Status is allowed or denied unless
+// the check couldn't be made, then Error says why
+type AllowedResult struct {
+	AllowedCheck
+	Status string        `json:"status,omitempty"`
+	Error  *AllowedError `json:"error,omitempty"`
+}
+
+// AllowedError why a single check failed, the codes are the same as ErrorDetail
+type AllowedError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AllowedBatchResponse the results in the same order as the checks
+type AllowedBatchResponse struct {
+	Results []AllowedResult `json:"results"`
+}
+
+// AllowedBatchHandler ...
+func AllowedBatchHandler(body string) (string, error) {
+	return AllowedBatchHandlerContext(context.Background(), body)
+}
+
+// AllowedBatchHandlerContext AllowedBatchHandler bounded by ctx
+func AllowedBatchHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().AllowedBatchHandler(ctx, body)
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/allowed", os.Getenv("SERVICE_PERMISSIONS")), bytes.NewBuffer(j))
+// AllowedBatchHandler ...
+func (s Service) AllowedBatchHandler(ctx context.Context, body string) (string, error) {
+	r := AllowedBatchRequest{}
+	err := json.Unmarshal([]byte(body), &r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("req err: %v", err))
-		return pr, fmt.Errorf("req allowed err: %w", err)
+		s.Logger.Error("can't unmarshall input", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall input: %w", WithKind(ErrValidation, err))
 	}
 
-	req.Header.Set("X-Authorization", os.Getenv("AUTH_PERMISSIONS"))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{
-		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     2 * time.Minute,
-		},
+	rf, err := s.AllowedBatch(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't get allowed batch", Fields{"err": err})
+		return "", fmt.Errorf("can't get allowed: %w", err)
 	}
-	resp, err := client.Do(req)
+
+	rfb, err := json.Marshal(rf)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("verify client err: %v", err))
-		return pr, fmt.Errorf("verify client err: %w", err)
+		s.Logger.Error("can't marshal allowed batch", Fields{"err": err})
+		return "", fmt.Errorf("can't marshal allowed: %w", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println(fmt.Sprintf("verify resp err: %v", err))
-			return pr, fmt.Errorf("verify resp err: %w", err)
+
+	return string(rfb), nil
+}
+
+// AllowedBatch ...
+func AllowedBatch(r AllowedBatchRequest) (AllowedBatchResponse, error) {
+	return AllowedBatchContext(context.Background(), r)
+}
+
+// AllowedBatchContext AllowedBatch bounded by ctx
+func AllowedBatchContext(ctx context.Context, r AllowedBatchRequest) (AllowedBatchResponse, error) {
+	return NewService().AllowedBatch(ctx, r)
+}
+
+// AllowedBatch check each of r.Checks, only a bad batch is an error, a check
+// that fails has its error in its result and the rest still get checked
+func (s Service) AllowedBatch(ctx context.Context, r AllowedBatchRequest) (AllowedBatchResponse, error) {
+	if len(r.Checks) == 0 {
+		return AllowedBatchResponse{}, WithKind(ErrValidation, fmt.Errorf("no checks"))
+	}
+	if s.Batch.Max > 0 && len(r.Checks) > s.Batch.Max {
+		return AllowedBatchResponse{}, WithKind(ErrValidation, fmt.Errorf("too many checks, the most is %d", s.Batch.Max))
+	}
+
+	workers := s.Batch.Workers
+	if workers <= 0 || workers > len(r.Checks) {
+		workers = len(r.Checks)
+	}
+
+	results := make([]AllowedResult, len(r.Checks))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = s.allowedCheck(ctx, r.Checks[i])
+			}
+		}()
+	}
+	for i := range r.Checks {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return AllowedBatchResponse{
+		Results: results,
+	}, nil
+}
+
+// allowedCheck a single check of a batch
+func (s Service) allowedCheck(ctx context.Context, c AllowedCheck) AllowedResult {
+	res := AllowedResult{
+		AllowedCheck: c,
+	}
+
+	if c.Identifier == "" || c.Name == "" || c.Action == "" {
+		res.Error = &AllowedError{
+			Code:    "validation",
+			Message: "a check needs an identifier, name and action",
 		}
+		return res
+	}
 
-		err = json.Unmarshal(body, &pr)
-		if err != nil {
-			fmt.Println(fmt.Sprintf("can't unmarshall permissions: %v, %v", err, string(body)))
-			return pr, fmt.Errorf("can't unmarshall permissions: %w", err)
+	var status string
+	var err error
+	if c.ResourceIdentifier != "" {
+		status, err = s.allowedResource(ctx, c)
+	} else {
+		var pr permissions.Permissions
+		pr, err = s.Allowed(ctx, permissions.Permissions{
+			Identifier: c.Identifier,
+			Permissions: []permissions.Permission{
+				{
+					Name:   c.Name,
+					Action: c.Action,
+				},
+			},
+		})
+		status = pr.Status
+	}
+	if err != nil {
+		_, code := errorStatus(err)
+		res.Error = &AllowedError{
+			Code:    code,
+			Message: err.Error(),
 		}
+		return res
+	}
 
-		return pr, nil
+	res.Status = status
+	return res
+}
+
+// allowedResource the permissions service only matches a permission against
+// the account, so a check on a resource is made here against the stored set,
+// the permission's identifier has to be the resource or "*"
+func (s Service) allowedResource(ctx context.Context, c AllowedCheck) (string, error) {
+	stored, err := s.storedPermissions(ctx, c.Identifier)
+	if err != nil {
+		s.Logger.Error("allowed resource err", Fields{"err": err})
+		return "", err
+	}
+
+	check := permissions.Permission{
+		Name:   c.Name,
+		Action: c.Action,
+	}
+	for _, perm := range stored {
+		if ok, _ := permissionMatches(perm, check, c.ResourceIdentifier); ok {
+			return "allowed", nil
+		}
 	}
 
-	return pr, fmt.Errorf("allowed came back with a different statuscode: %v", resp.StatusCode)
+	return "denied", nil
 }
@@ -1,13 +1,19 @@
 package service_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/carprks/account/service"
 	login "github.com/carprks/login/service"
 	permissions "github.com/carprks/permissions/service"
-	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
-	"os"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testsAllowed = []struct {
@@ -51,25 +57,14 @@ var testsAllowed = []struct {
 }
 
 func TestAllowed(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	r := login.RegisterRequest{
 		Email:    "tester@carpark.ninja",
-		Password: "tester",
-		Verify:   "tester",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
 	}
 	resp, err := service.Register(r)
 	if err != nil {
-		t.Errorf("login register failed: %w", err)
+		t.Errorf("login register failed: %v", err)
 	}
 
 	for _, test := range testsAllowed {
@@ -77,7 +72,7 @@ func TestAllowed(t *testing.T) {
 			response, err := service.Allowed(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("verify test type err: %w, request: %v", err, test.request)
+				t.Errorf("verify test type err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -92,25 +87,14 @@ func TestAllowed(t *testing.T) {
 func BenchmarkAllowed(b *testing.B) {
 	b.ReportAllocs()
 
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					b.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	r := login.RegisterRequest{
 		Email:    "tester@carpark.ninja",
-		Password: "tester",
-		Verify:   "tester",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
 	}
 	resp, err := service.Register(r)
 	if err != nil {
-		b.Errorf("login register failed: %w", err)
+		b.Errorf("login register failed: %v", err)
 	}
 
 	b.ResetTimer()
@@ -121,7 +105,7 @@ func BenchmarkAllowed(b *testing.B) {
 			response, err := service.Allowed(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("verify test type err: %w, request: %v", err, test.request)
+				t.Errorf("verify test type err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -134,3 +118,170 @@ func BenchmarkAllowed(b *testing.B) {
 
 	deleteAccount(resp.Identifier)
 }
+
+// busyPermissions counts how many allowed calls are in flight at once, and
+// fails any for the broken identifier
+type busyPermissions struct {
+	*memoryPermissions
+	mu       sync.Mutex
+	inFlight int
+	most     int
+}
+
+func (b *busyPermissions) Allowed(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	b.mu.Lock()
+	b.inFlight++
+	if b.inFlight > b.most {
+		b.most = b.inFlight
+	}
+	b.mu.Unlock()
+
+	time.Sleep(time.Millisecond * 5)
+
+	b.mu.Lock()
+	b.inFlight--
+	b.mu.Unlock()
+
+	if p.Identifier == "broken" {
+		return permissions.Permissions{}, service.WithKind(service.ErrUpstream, fmt.Errorf("allowed came back with a different statuscode: 500"))
+	}
+
+	return b.memoryPermissions.Allowed(ctx, p)
+}
+
+func batchService() (service.Service, *busyPermissions) {
+	perms := &busyPermissions{
+		memoryPermissions: newMemoryPermissions(),
+	}
+	perms.perms["ident"] = []permissions.Permission{
+		{Name: "account", Action: "login", Identifier: "ident"},
+		{Name: "carparks", Action: "book", Identifier: "*"},
+		{Name: "carparks", Action: "edit", Identifier: "carpark-2"},
+	}
+
+	s := service.NewService()
+	s.PermissionsClient = perms
+	s.PermissionsUpstream = service.Upstream{
+		Name: "permissions",
+	}
+	s.Batch = service.AllowedBatchConfig{
+		Workers: 3,
+		Max:     50,
+	}
+
+	return s, perms
+}
+
+func TestAllowedBatch(t *testing.T) {
+	s, perms := batchService()
+
+	checks := []service.AllowedCheck{
+		{Identifier: "ident", Name: "account", Action: "login"},
+		{Identifier: "ident", Name: "carparks", Action: "create"},
+		{Identifier: "ident", Name: "carparks", Action: "book", ResourceIdentifier: "carpark-1"},
+		{Identifier: "broken", Name: "account", Action: "login"},
+		{Identifier: "ident", Name: "account"},
+		{Identifier: "other", Name: "account", Action: "login"},
+		{Identifier: "ident", Name: "carparks", Action: "edit", ResourceIdentifier: "carpark-2"},
+		{Identifier: "ident", Name: "carparks", Action: "edit", ResourceIdentifier: "carpark-1"},
+		{Identifier: "ident", Name: "account", Action: "login", ResourceIdentifier: "carpark-1"},
+	}
+	for i := 0; i < 10; i++ {
+		checks = append(checks, service.AllowedCheck{Identifier: "ident", Name: "account", Action: "login"})
+	}
+
+	resp, err := s.AllowedBatch(context.Background(), service.AllowedBatchRequest{
+		Checks: checks,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Results, len(checks))
+
+	expect := []struct {
+		status string
+		code   string
+	}{
+		{status: "allowed"},
+		{status: "denied"},
+		{status: "allowed"},
+		{code: "upstream_unavailable"},
+		{code: "validation"},
+		{status: "denied"},
+		{status: "allowed"},
+		{status: "denied"},
+		{status: "denied"},
+	}
+	for i, e := range expect {
+		res := resp.Results[i]
+		assert.Equal(t, checks[i], res.AllowedCheck, i)
+		assert.Equal(t, e.status, res.Status, i)
+		if e.code == "" {
+			assert.Nil(t, res.Error, i)
+		} else if assert.NotNil(t, res.Error, i) {
+			assert.Equal(t, e.code, res.Error.Code, i)
+		}
+	}
+	for _, res := range resp.Results[len(expect):] {
+		assert.Equal(t, "allowed", res.Status)
+	}
+
+	assert.True(t, perms.most > 1, "checked one at a time")
+	assert.True(t, perms.most <= 3, fmt.Sprintf("%d in flight", perms.most))
+}
+
+func TestAllowedBatchInvalid(t *testing.T) {
+	s, _ := batchService()
+	s.Batch.Max = 2
+
+	tests := []struct {
+		name   string
+		checks []service.AllowedCheck
+		err    string
+	}{
+		{
+			name: "no checks",
+			err:  "no checks",
+		},
+		{
+			name: "too many",
+			checks: []service.AllowedCheck{
+				{Identifier: "ident", Name: "account", Action: "login"},
+				{Identifier: "ident", Name: "account", Action: "view"},
+				{Identifier: "ident", Name: "account", Action: "edit"},
+			},
+			err: "too many checks, the most is 2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.AllowedBatch(context.Background(), service.AllowedBatchRequest{
+				Checks: test.checks,
+			})
+			assert.EqualError(t, err, test.err)
+			assert.True(t, errors.Is(err, service.ErrValidation))
+		})
+	}
+}
+
+func TestAllowedBatchHandler(t *testing.T) {
+	s, _ := batchService()
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/allowed/batch",
+		Body:     `{"checks":[{"identifier":"ident","name":"account","action":"login"},{"identifier":"ident","name":"account","action":"edit"}]}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	resp := service.AllowedBatchResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(response.Body), &resp))
+	assert.Equal(t, "allowed", resp.Results[0].Status)
+	assert.Equal(t, "denied", resp.Results[1].Status)
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/allowed/batch",
+		Body:     `{"checks":[]}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// BudgetReserve kept back from the lambda deadline to respond and roll back
+	BudgetReserve = time.Millisecond * 1500
+	// BudgetCall the most a single upstream call can take
+	BudgetCall = time.Second * 4
+	// BudgetRequest how long a request can take when there is no deadline
+	BudgetRequest = time.Second * 9
+)
+
+// Budget how the time left for a request is shared out between upstream calls,
+// a zero value leaves it to the caller's context
+type Budget struct {
+	Reserve time.Duration
+	Call    time.Duration
+	Request time.Duration
+}
+
+// NewBudget the default budget, sized for the 10 second lambda timeout
+func NewBudget() Budget {
+	return Budget{
+		Reserve: BudgetReserve,
+		Call:    BudgetCall,
+		Request: BudgetRequest,
+	}
+}
+
+// request the context for the whole request, it ends Reserve before the
+// lambda deadline so there is time to undo anything and respond
+func (b Budget) request(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.Reserve == 0 && b.Request == 0 {
+		return context.WithCancel(ctx)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, deadline.Add(-b.Reserve))
+	}
+
+	return context.WithTimeout(ctx, b.Request)
+}
+
+// call the context for a single upstream call, never longer than the request has left
+func (b Budget) call(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.Call == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.Call)
+}
+
+// compensate a context for undoing work, it isn't tied to the request so it
+// still runs once the request budget has run out
+func (b Budget) compensate() (context.Context, context.CancelFunc) {
+	if b.Reserve == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), b.Reserve)
+}
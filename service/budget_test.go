@@ -0,0 +1,106 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		budget   service.Budget
+		deadline time.Duration
+	}{
+		{
+			name: "lambda deadline",
+			budget: service.Budget{
+				Reserve: time.Millisecond * 100,
+				Call:    time.Second * 5,
+				Request: time.Second * 5,
+			},
+			deadline: time.Millisecond * 200,
+		},
+		{
+			name: "call",
+			budget: service.Budget{
+				Reserve: time.Millisecond * 100,
+				Call:    time.Millisecond * 100,
+				Request: time.Second * 5,
+			},
+		},
+		{
+			name: "request",
+			budget: service.Budget{
+				Reserve: time.Millisecond * 100,
+				Call:    time.Second * 5,
+				Request: time.Millisecond * 100,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requireFakes(t)
+			for i := 0; i < service.RetryAttempts; i++ {
+				loginService.Stall("/login", time.Second*5)
+			}
+
+			s := service.NewService()
+			s.Budget = test.budget
+			s.LoginUpstream.Breaker = service.NewBreaker("login")
+
+			ctx := context.Background()
+			if test.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.deadline)
+				defer cancel()
+			}
+
+			start := time.Now()
+			response, err := s.Handler(ctx, events.APIGatewayProxyRequest{
+				Resource: "/login",
+				Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+			assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+		})
+	}
+}
+
+func TestBudgetRollback(t *testing.T) {
+	requireFakes(t)
+	permissionsService.Stall("/create", time.Second*5)
+
+	s := service.NewService()
+	s.PermissionsUpstream.Breaker = service.NewBreaker("permissions")
+	s.Budget = service.Budget{
+		Reserve: time.Second,
+		Call:    time.Second * 5,
+	}
+
+	// the request runs out while permissions are being created
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second+time.Millisecond*200)
+	defer cancel()
+
+	_, err := s.Register(ctx, login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+	assert.False(t, loginService.Exists("5f46cf19-5399-55e3-aa62-0e7c19382250"))
+
+	re := service.RegisterError{}
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, []string{"delete permissions", "delete login"}, re.Compensations)
+		assert.False(t, re.Partial())
+	}
+}
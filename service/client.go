@@ -0,0 +1,70 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// transport is shared by every upstream client so warm lambdas reuse connections
+var transport = &http.Transport{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 100,
+	IdleConnTimeout:     2 * time.Minute,
+}
+
+// NewHTTPClient http client using the shared pooled transport
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// doJSON send in as json to the upstream and decode the response into out,
+// the body is only decoded when the upstream responds with a 200, the call is
+// abandoned when ctx is done
+func doJSON(ctx context.Context, client *http.Client, method, url, auth string, in, out interface{}) (int, error) {
+	j, err := json.Marshal(in)
+	if err != nil {
+		return 0, fmt.Errorf("can't marshall request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(j))
+	if err != nil {
+		return 0, fmt.Errorf("req err: %w", err)
+	}
+
+	req.Header.Set("X-Authorization", auth)
+	req.Header.Set("Content-Type", "application/json")
+	if key := IdempotencyKey(ctx); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, WithKind(ErrUpstream, fmt.Errorf("client err: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, WithKind(ErrUpstream, fmt.Errorf("resp err: %w", err))
+	}
+	if out == nil || len(body) == 0 {
+		return resp.StatusCode, nil
+	}
+
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		return resp.StatusCode, WithKind(ErrUpstream, fmt.Errorf("can't unmarshal body: %w, %v", err, string(body)))
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,179 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+type memoryLogin struct {
+	sync.Mutex
+	logins map[string]login.RegisterRequest
+}
+
+func newMemoryLogin() *memoryLogin {
+	return &memoryLogin{
+		logins: map[string]login.RegisterRequest{},
+	}
+}
+
+func (m *memoryLogin) Register(ctx context.Context, r login.RegisterRequest) (login.Register, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if r.Password != r.Verify {
+		return login.Register{}, service.WithKind(service.ErrValidation, fmt.Errorf("unknown login error: passwords don't match"))
+	}
+
+	ident := login.GenerateIdent(r.Email)
+	if _, ok := m.logins[ident]; ok {
+		return login.Register{}, service.WithKind(service.ErrConflict, fmt.Errorf("login already exists"))
+	}
+	m.logins[ident] = r
+
+	return login.Register{
+		Identifier: ident,
+		Email:      r.Email,
+	}, nil
+}
+
+func (m *memoryLogin) Login(ctx context.Context, r login.LoginRequest) (login.Login, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	ident := login.GenerateIdent(r.Email)
+	l, ok := m.logins[ident]
+	if !ok {
+		return login.Login{}, service.WithKind(service.ErrUnauthorized, fmt.Errorf("login response err: no identity"))
+	}
+	if l.Password != r.Password {
+		return login.Login{}, service.WithKind(service.ErrUnauthorized, fmt.Errorf("login response err: invalid password"))
+	}
+
+	return login.Login{
+		Identifier: ident,
+	}, nil
+}
+
+func (m *memoryLogin) Delete(ctx context.Context, ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.logins, ident)
+	return nil
+}
+
+type memoryPermissions struct {
+	sync.Mutex
+	perms map[string][]permissions.Permission
+}
+
+func newMemoryPermissions() *memoryPermissions {
+	return &memoryPermissions{
+		perms: map[string][]permissions.Permission{},
+	}
+}
+
+func (m *memoryPermissions) Create(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.perms[p.Identifier]; ok {
+		return permissions.Permissions{}, service.WithKind(service.ErrUpstream, fmt.Errorf("can't create permissions"))
+	}
+	m.perms[p.Identifier] = p.Permissions
+
+	return p, nil
+}
+
+func (m *memoryPermissions) Retrieve(ctx context.Context, ident string) (permissions.Permissions, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	perms, ok := m.perms[ident]
+	if !ok {
+		return permissions.Permissions{
+			Identifier: ident,
+			Status:     "no permissions",
+		}, nil
+	}
+
+	return permissions.Permissions{
+		Identifier:  ident,
+		Permissions: perms,
+	}, nil
+}
+
+func (m *memoryPermissions) Delete(ctx context.Context, ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.perms, ident)
+	return nil
+}
+
+// Allowed same rules as the permissions service
+func (m *memoryPermissions) Allowed(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	stored, err := m.Retrieve(ctx, p.Identifier)
+	if err != nil {
+		return permissions.Permissions{}, err
+	}
+
+	allowed := false
+	for _, perm := range stored.Permissions {
+		for _, cperm := range p.Permissions {
+			if perm.Name == cperm.Name {
+				if perm.Action == cperm.Action {
+					if perm.Identifier == p.Identifier || perm.Identifier == "*" {
+						allowed = true
+					}
+				}
+
+				if perm.Action == "*" {
+					allowed = true
+				}
+			}
+
+			if perm.Name == "*" {
+				allowed = true
+			}
+		}
+	}
+
+	status := "denied"
+	if allowed {
+		status = "allowed"
+	}
+
+	return permissions.Permissions{
+		Identifier: p.Identifier,
+		Status:     status,
+	}, nil
+}
+
+func TestServiceMemory(t *testing.T) {
+	s := service.NewService()
+	s.LoginClient = newMemoryLogin()
+	s.PermissionsClient = newMemoryPermissions()
+	s.Verifications = service.NewMemoryVerificationStore()
+
+	for _, test := range testsService {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := s.Handler(context.Background(), test.request)
+			response.Body = withoutTokens(response.Body)
+			passed := assert.IsType(t, test.err, err)
+			if !passed {
+				t.Errorf("service memory test type err: %v, request: %v", err, test.request)
+			}
+			passed = assert.Equal(t, test.expect, response)
+			if !passed {
+				t.Errorf("service memory test value response: %v, request: %v", response, test.request)
+			}
+		})
+	}
+}
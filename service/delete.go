@@ -0,0 +1,407 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Deletion statuses
+const (
+	DeleteScheduled = "scheduled"
+	DeleteDeleted   = "deleted"
+	DeleteCancelled = "cancelled"
+)
+
+// DeleteRequest delete the caller's account, the password and, when mfa is on,
+// a code are needed again
+type DeleteRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// DeleteObject ...
+type DeleteObject struct {
+	Identifier string `json:"identifier"`
+	Status     string `json:"status"`
+	// Due when a scheduled deletion happens, it can be cancelled until then
+	Due *time.Time `json:"due,omitempty"`
+}
+
+// DeleteConfig DELETE_GRACE_HOURS sets how long a deletion waits so it can be
+// cancelled, a zero Grace deletes straight away
+type DeleteConfig struct {
+	Grace time.Duration
+}
+
+// NewDeleteConfig ...
+func NewDeleteConfig() DeleteConfig {
+	return DeleteConfig{
+		Grace: time.Duration(envInt("DELETE_GRACE_HOURS", 0)) * time.Hour,
+	}
+}
+
+// Deletion an account on its way out, the steps done so far are recorded so a
+// deletion that fails part way can be run again without redoing them
+type Deletion struct {
+	Identifier         string
+	Requested          time.Time
+	Due                time.Time
+	PermissionsDeleted bool
+	LoginDeleted       bool
+}
+
+// DeletionStore where deletions are kept until they are done
+type DeletionStore interface {
+	Get(ident string) (Deletion, bool, error)
+	Save(d Deletion) error
+	Delete(ident string) error
+	// Due the deletions due by now
+	Due(now time.Time) ([]Deletion, error)
+}
+
+// ErrDeletionPending the account is waiting to be deleted, it can't be logged
+// into until the deletion is cancelled
+var ErrDeletionPending = WithKind(ErrConflict, fmt.Errorf("account deletion pending, cancel it to log in"))
+
+// newDeletionStore in the account table when there is one, a grace period
+// outlives a warm lambda
+func newDeletionStore() DeletionStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryDeletionStore()
+	}
+
+	return DynamoDeletionStore{table}
+}
+
+// MemoryDeletionStore deletion store that lives as long as the lambda is warm,
+// a grace period longer than that needs a store that outlives it
+type MemoryDeletionStore struct {
+	sync.Mutex
+	deletions map[string]Deletion
+}
+
+// NewMemoryDeletionStore ...
+func NewMemoryDeletionStore() *MemoryDeletionStore {
+	return &MemoryDeletionStore{
+		deletions: map[string]Deletion{},
+	}
+}
+
+// Get ...
+func (m *MemoryDeletionStore) Get(ident string) (Deletion, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	d, ok := m.deletions[ident]
+	return d, ok, nil
+}
+
+// Save ...
+func (m *MemoryDeletionStore) Save(d Deletion) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deletions[d.Identifier] = d
+	return nil
+}
+
+// Delete ...
+func (m *MemoryDeletionStore) Delete(ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.deletions, ident)
+	return nil
+}
+
+// Due ...
+func (m *MemoryDeletionStore) Due(now time.Time) ([]Deletion, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	due := []Deletion{}
+	for _, d := range m.deletions {
+		if !now.Before(d.Due) {
+			due = append(due, d)
+		}
+	}
+
+	return due, nil
+}
+
+// DeleteHandler ...
+func DeleteHandler(body string) (string, error) {
+	return DeleteHandlerContext(context.Background(), body)
+}
+
+// DeleteHandlerContext DeleteHandler bounded by ctx
+func DeleteHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().DeleteHandler(ctx, body)
+}
+
+// DeleteHandler ...
+func (s Service) DeleteHandler(ctx context.Context, body string) (string, error) {
+	r := DeleteRequest{}
+	return s.mfaHandler("delete account", body, &r, func() (interface{}, error) {
+		return s.Delete(ctx, r)
+	})
+}
+
+// DeleteCancelHandler ...
+func DeleteCancelHandler(body string) (string, error) {
+	return DeleteCancelHandlerContext(context.Background(), body)
+}
+
+// DeleteCancelHandlerContext DeleteCancelHandler bounded by ctx
+func DeleteCancelHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().DeleteCancelHandler(ctx, body)
+}
+
+// DeleteCancelHandler ...
+func (s Service) DeleteCancelHandler(ctx context.Context, body string) (string, error) {
+	r := DeleteRequest{}
+	return s.mfaHandler("cancel delete", body, &r, func() (interface{}, error) {
+		return s.DeleteCancel(ctx, r)
+	})
+}
+
+// Delete ...
+func Delete(r DeleteRequest) (DeleteObject, error) {
+	return DeleteContext(context.Background(), r)
+}
+
+// DeleteContext Delete bounded by ctx
+func DeleteContext(ctx context.Context, r DeleteRequest) (DeleteObject, error) {
+	return NewService().Delete(ctx, r)
+}
+
+// Delete the caller's account, after the grace period when there is one,
+// asking again for a scheduled deletion just says when it is due
+func (s Service) Delete(ctx context.Context, r DeleteRequest) (DeleteObject, error) {
+	ident, _, err := s.reauthenticate(ctx, r.Email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return DeleteObject{}, err
+	}
+
+	d, ok, err := s.Deletions.Get(ident)
+	if err != nil {
+		return DeleteObject{}, fmt.Errorf("deletion get: %w", err)
+	}
+	if !ok {
+		now := s.now()
+		d = Deletion{
+			Identifier: ident,
+			Requested:  now,
+			Due:        now.Add(s.Deletion.Grace),
+		}
+		err = s.Deletions.Save(d)
+		if err != nil {
+			return DeleteObject{}, fmt.Errorf("deletion save: %w", err)
+		}
+		s.Logger.Info("account deletion requested", Fields{"identifier": ident, "due": d.Due})
+
+		// logins are refused until it is cancelled, so sessions go now
+		err = s.Sessions.RevokeAll(ctx, ident)
+		if err != nil {
+			s.Logger.Error("delete sessions", Fields{"err": err, "identifier": ident})
+		}
+	}
+
+	if s.now().Before(d.Due) {
+		return DeleteObject{
+			Identifier: ident,
+			Status:     DeleteScheduled,
+			Due:        &d.Due,
+		}, nil
+	}
+
+	err = s.purge(ctx, d)
+	if err != nil {
+		return DeleteObject{}, err
+	}
+
+	return DeleteObject{
+		Identifier: ident,
+		Status:     DeleteDeleted,
+	}, nil
+}
+
+// DeleteCancel ...
+func DeleteCancel(r DeleteRequest) (DeleteObject, error) {
+	return DeleteCancelContext(context.Background(), r)
+}
+
+// DeleteCancelContext DeleteCancel bounded by ctx
+func DeleteCancelContext(ctx context.Context, r DeleteRequest) (DeleteObject, error) {
+	return NewService().DeleteCancel(ctx, r)
+}
+
+// DeleteCancel stop a scheduled deletion, once it has started it can't be
+func (s Service) DeleteCancel(ctx context.Context, r DeleteRequest) (DeleteObject, error) {
+	ident, _, err := s.reauthenticate(ctx, r.Email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return DeleteObject{}, err
+	}
+
+	d, ok, err := s.Deletions.Get(ident)
+	if err != nil {
+		return DeleteObject{}, fmt.Errorf("deletion get: %w", err)
+	}
+	if !ok {
+		return DeleteObject{}, WithKind(ErrNotFound, fmt.Errorf("no deletion scheduled"))
+	}
+	if d.PermissionsDeleted || d.LoginDeleted {
+		return DeleteObject{}, WithKind(ErrConflict, fmt.Errorf("deletion already started"))
+	}
+
+	err = s.Deletions.Delete(ident)
+	if err != nil {
+		return DeleteObject{}, fmt.Errorf("deletion delete: %w", err)
+	}
+	s.Logger.Info("account deletion cancelled", Fields{"identifier": ident})
+
+	return DeleteObject{
+		Identifier: ident,
+		Status:     DeleteCancelled,
+	}, nil
+}
+
+// PurgeDeletions ...
+func PurgeDeletions() (int, error) {
+	return PurgeDeletionsContext(context.Background())
+}
+
+// PurgeDeletionsContext PurgeDeletions bounded by ctx
+func PurgeDeletionsContext(ctx context.Context) (int, error) {
+	return NewService().PurgeDeletions(ctx)
+}
+
+// PurgeDeletions carry out every deletion that is due, for running on a
+// schedule, one that fails is left to be tried again next time
+func (s Service) PurgeDeletions(ctx context.Context) (int, error) {
+	due, err := s.Deletions.Due(s.now())
+	if err != nil {
+		return 0, fmt.Errorf("deletions due: %w", err)
+	}
+
+	purged := 0
+	var last error
+	for _, d := range due {
+		err = s.purge(ctx, d)
+		if err != nil {
+			last = err
+			continue
+		}
+		purged++
+	}
+
+	return purged, last
+}
+
+// reauthenticate the identifier of the login and the form of the email it is
+// under, checking mfa when it is on, wrong passwords and codes count towards
+// the same lockout as logins
+func (s Service) reauthenticate(ctx context.Context, email, password, otp, recovery string) (string, string, error) {
+	key := s.Emails.Normalise(email)
+	err := s.throttled(ctx, key)
+	if err != nil {
+		s.Logger.Info("reauthenticate throttled", Fields{"err": err})
+		return "", "", err
+	}
+
+	lo, under, err := s.loginAs(ctx, email, password)
+	if errors.Is(err, ErrUnauthorized) {
+		s.Logger.Info("reauthenticate failed", Fields{"err": err})
+		s.failed(ctx, key)
+		return "", "", fmt.Errorf("can't reauthenticate: %w", ErrLoginFailed)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("can't reauthenticate: %w", err)
+	}
+
+	enabled, err := s.mfaEnabled(lo.Identifier)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled {
+		err = s.checkMFA(lo.Identifier, otp, recovery)
+		if errors.Is(err, ErrMFACode) {
+			s.failed(ctx, key)
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	s.unlock(key)
+
+	return lo.Identifier, under, nil
+}
+
+// purge remove the account everywhere, permissions go before the login so a
+// failure leaves a login that can ask again
+func (s Service) purge(ctx context.Context, d Deletion) error {
+	if !d.PermissionsDeleted {
+		err := s.DeletePermissions(ctx, d.Identifier)
+		if err != nil {
+			return fmt.Errorf("can't delete permissions: %w", err)
+		}
+		d.PermissionsDeleted = true
+		err = s.Deletions.Save(d)
+		if err != nil {
+			return fmt.Errorf("deletion save: %w", err)
+		}
+	}
+
+	if !d.LoginDeleted {
+		ident, err := s.loginKey(d.Identifier)
+		if err != nil {
+			return fmt.Errorf("can't delete login: %w", err)
+		}
+		err = s.DeleteLogin(ctx, ident)
+		if err != nil {
+			return fmt.Errorf("can't delete login: %w", err)
+		}
+		d.LoginDeleted = true
+		err = s.Deletions.Save(d)
+		if err != nil {
+			return fmt.Errorf("deletion save: %w", err)
+		}
+	}
+
+	// the account is gone, anything left here only lingers until it expires
+	err := s.Sessions.RevokeAll(ctx, d.Identifier)
+	if err != nil {
+		s.Logger.Error("delete sessions", Fields{"err": err, "identifier": d.Identifier})
+	}
+	err = s.MFAs.Delete(d.Identifier)
+	if err != nil {
+		s.Logger.Error("delete mfa", Fields{"err": err, "identifier": d.Identifier})
+	}
+	err = s.Exports.DeleteIdentifier(d.Identifier)
+	if err != nil {
+		s.Logger.Error("delete exports", Fields{"err": err, "identifier": d.Identifier})
+	}
+	if s.Identities != nil {
+		err = s.Identities.Forget(d.Identifier)
+		if err != nil {
+			s.Logger.Error("delete identity", Fields{"err": err, "identifier": d.Identifier})
+		}
+	}
+	err = s.EmailChanges.Delete(d.Identifier)
+	if err != nil {
+		s.Logger.Error("delete email change", Fields{"err": err, "identifier": d.Identifier})
+	}
+	err = s.Deletions.Delete(d.Identifier)
+	if err != nil {
+		s.Logger.Error("delete deletion", Fields{"err": err, "identifier": d.Identifier})
+	}
+
+	s.Logger.Info("account deleted", Fields{"identifier": d.Identifier})
+	return nil
+}
@@ -0,0 +1,253 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// failingLogin a login client whose deletes fail until fail is cleared, and
+// whose registers fail until failCreate is
+type failingLogin struct {
+	*memoryLogin
+	fail       bool
+	failCreate bool
+}
+
+func (f *failingLogin) Register(ctx context.Context, r login.RegisterRequest) (login.Register, error) {
+	if f.failCreate {
+		return login.Register{}, service.WithKind(service.ErrUpstream, fmt.Errorf("create login came back with a different statuscode: 500"))
+	}
+
+	return f.memoryLogin.Register(ctx, r)
+}
+
+func (f *failingLogin) Delete(ctx context.Context, ident string) error {
+	if f.fail {
+		return service.WithKind(service.ErrUpstream, fmt.Errorf("delete login came back with a different statuscode: 500"))
+	}
+
+	return f.memoryLogin.Delete(ctx, ident)
+}
+
+// deleteService an account held in memory with nothing shared between tests
+func deleteService(t *testing.T, grace time.Duration) (service.Service, *time.Time, *failingLogin, *countingPermissions, string) {
+	now := time.Now()
+	logins := &failingLogin{
+		memoryLogin: newMemoryLogin(),
+	}
+	perms := &countingPermissions{
+		memoryPermissions: newMemoryPermissions(),
+	}
+
+	s := service.NewService()
+	s.LoginClient = logins
+	s.PermissionsClient = perms
+	s.LoginUpstream = service.Upstream{Name: "login"}
+	s.PermissionsUpstream = service.Upstream{Name: "permissions"}
+	s.Verifications = service.NewMemoryVerificationStore()
+	s.Sessions = service.NewMemorySessionStore()
+	s.MFAs = service.NewMemoryMFAStore()
+	s.Deletions = service.NewMemoryDeletionStore()
+	s.Deletion = service.DeleteConfig{
+		Grace: grace,
+	}
+	s.Attempts = service.NewMemoryAttemptStore()
+	s.Identities = service.NewMemoryIdentityStore()
+	s.EmailChanges = service.NewMemoryEmailChangeStore()
+	s.Clock = func() time.Time {
+		return now
+	}
+
+	resp, err := s.Register(context.Background(), testsRegister[0].request)
+	assert.Nil(t, err)
+
+	return s, &now, logins, perms, resp.Identifier
+}
+
+var deleteRequest = service.DeleteRequest{
+	Email:    "tester@carpark.ninja",
+	Password: "Carpark-Ninja-2019",
+}
+
+func TestDelete(t *testing.T) {
+	s, _, logins, perms, ident := deleteService(t, 0)
+
+	_, err := s.Delete(context.Background(), service.DeleteRequest{
+		Email:    deleteRequest.Email,
+		Password: "wrong",
+	})
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+
+	lo := sessionLogin(t, s)
+
+	resp, err := s.Delete(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.DeleteObject{
+		Identifier: ident,
+		Status:     service.DeleteDeleted,
+	}, resp)
+
+	assert.Len(t, logins.logins, 0)
+	assert.Len(t, perms.perms, 0)
+	_, err = s.Refresh(context.Background(), lo.RefreshToken)
+	assert.NotNil(t, err)
+	_, ok, err := s.Deletions.Get(ident)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = s.Delete(context.Background(), deleteRequest)
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+}
+
+func TestDeletePartialFailure(t *testing.T) {
+	s, _, logins, perms, ident := deleteService(t, 0)
+
+	logins.fail = true
+	_, err := s.Delete(context.Background(), deleteRequest)
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+
+	// the login is still there to ask again, the permissions aren't deleted twice
+	d, ok, err := s.Deletions.Get(ident)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, d.PermissionsDeleted)
+	assert.False(t, d.LoginDeleted)
+	assert.Len(t, perms.perms, 0)
+
+	_, err = s.DeleteCancel(context.Background(), deleteRequest)
+	assert.True(t, errors.Is(err, service.ErrConflict))
+
+	logins.fail = false
+	resp, err := s.Delete(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.DeleteDeleted, resp.Status)
+	assert.Len(t, logins.logins, 0)
+}
+
+func TestDeleteGrace(t *testing.T) {
+	s, now, logins, perms, ident := deleteService(t, time.Hour*24)
+
+	resp, err := s.Delete(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.DeleteScheduled, resp.Status)
+	assert.Equal(t, now.Add(time.Hour*24), *resp.Due)
+	assert.Len(t, logins.logins, 1)
+	assert.Len(t, perms.perms, 1)
+
+	// no logging in while it is pending
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    deleteRequest.Email,
+		Password: deleteRequest.Password,
+	})
+	assert.Equal(t, service.ErrDeletionPending, err)
+
+	// asking again doesn't move it
+	*now = now.Add(time.Hour)
+	again, err := s.Delete(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Due, again.Due)
+
+	cancelled, err := s.DeleteCancel(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.DeleteCancelled, cancelled.Status)
+	_, err = s.DeleteCancel(context.Background(), deleteRequest)
+	assert.True(t, errors.Is(err, service.ErrNotFound))
+	sessionLogin(t, s)
+
+	// nothing is due until the grace period is up
+	_, err = s.Delete(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	purged, err := s.PurgeDeletions(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged)
+
+	// the schedule runs it
+	*now = now.Add(time.Hour * 24)
+	sum, err := s.Work(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, service.WorkSummary{Purged: 1}, sum)
+	assert.Len(t, logins.logins, 0)
+	assert.Len(t, perms.perms, 0)
+	_, ok, _ := s.Deletions.Get(ident)
+	assert.False(t, ok)
+}
+
+func TestDeleteLockout(t *testing.T) {
+	s, now, _, _, _ := deleteService(t, time.Hour)
+
+	wrong := service.DeleteRequest{
+		Email:    deleteRequest.Email,
+		Password: "wrong",
+	}
+	for i := 0; i < service.LockoutDelayAfter; i++ {
+		_, err := s.Delete(context.Background(), wrong)
+		assert.Equal(t, "can't reauthenticate: invalid email or password", err.Error())
+	}
+
+	// counted with logins, the right password has to wait too
+	_, err := s.Delete(context.Background(), deleteRequest)
+	assert.True(t, errors.Is(err, service.ErrTooManyAttempts))
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    deleteRequest.Email,
+		Password: deleteRequest.Password,
+	})
+	assert.True(t, errors.Is(err, service.ErrTooManyAttempts))
+
+	*now = now.Add(service.LockoutDelay)
+	resp, err := s.Delete(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.DeleteScheduled, resp.Status)
+
+	// a success clears the failures
+	_, err = s.Delete(context.Background(), wrong)
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+	_, err = s.DeleteCancel(context.Background(), deleteRequest)
+	assert.Nil(t, err)
+}
+
+func TestDeleteMFA(t *testing.T) {
+	s, now, secret, _ := mfaService(t)
+	s.Deletions = service.NewMemoryDeletionStore()
+	s.Deletion = service.DeleteConfig{}
+
+	_, err := s.Delete(context.Background(), deleteRequest)
+	assert.Equal(t, service.ErrMFACode, err)
+
+	r := deleteRequest
+	r.OTP = totpCode(secret, *now)
+	resp, err := s.Delete(context.Background(), r)
+	assert.Nil(t, err)
+	assert.Equal(t, service.DeleteDeleted, resp.Status)
+
+	_, ok, err := s.MFAs.Get(resp.Identifier)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestDeleteHandler(t *testing.T) {
+	s, _, _, _, _ := deleteService(t, time.Hour)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/delete",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Body, `"status":"scheduled"`)
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/delete/cancel",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Body, `"status":"cancelled"`)
+}
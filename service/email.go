@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/badoux/checkmail"
+	"net"
+	"os"
+	"strings"
+)
+
+// disposableDomains throwaway mail services refused by default
+var disposableDomains = []string{
+	"10minutemail.com",
+	"discard.email",
+	"dispostable.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"maildrop.cc",
+	"mailinator.com",
+	"mailnesia.com",
+	"mintemail.com",
+	"mohmal.com",
+	"sharklasers.com",
+	"spamgourmet.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// MXResolver looks up mail servers, net.DefaultResolver is one
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// EmailPolicy how emails are normalised and what is accepted when registering,
+// identifiers come from the email so everything that makes two emails the
+// same inbox has to happen before the login is created
+type EmailPolicy struct {
+	// FoldCase lower case the local part too, most mail servers ignore its
+	// case but they don't have to
+	FoldCase bool
+	// StripPlus drop the +tag from the local part
+	StripPlus bool
+	// FoldGmailDots drop the dots from gmail local parts, gmail ignores them
+	FoldGmailDots bool
+	// Resolver checks the domain can receive mail, nil skips the check
+	Resolver MXResolver
+	// Disposable domains that are refused
+	Disposable map[string]bool
+}
+
+// NewEmailPolicy the default policy, EMAIL_FOLD_CASE, EMAIL_STRIP_PLUS and
+// EMAIL_FOLD_DOTS turn on the extra folding, EMAIL_CHECK_MX the mx check and EMAIL_DISPOSABLE_DOMAINS
+// adds to the disposable domains
+func NewEmailPolicy() EmailPolicy {
+	p := EmailPolicy{
+		FoldCase:      os.Getenv("EMAIL_FOLD_CASE") == "true",
+		StripPlus:     os.Getenv("EMAIL_STRIP_PLUS") == "true",
+		FoldGmailDots: os.Getenv("EMAIL_FOLD_DOTS") == "true",
+		Disposable:    map[string]bool{},
+	}
+	if os.Getenv("EMAIL_CHECK_MX") == "true" {
+		p.Resolver = net.DefaultResolver
+	}
+
+	domains := append([]string{}, disposableDomains...)
+	domains = append(domains, strings.Split(os.Getenv("EMAIL_DISPOSABLE_DOMAINS"), ",")...)
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" {
+			p.Disposable[d] = true
+		}
+	}
+
+	return p
+}
+
+// Normalise the form of email a new account is kept under, trimmed with a
+// lower case domain and any folding the policy asks for
+func (p EmailPolicy) Normalise(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+
+	if p.FoldCase {
+		local = strings.ToLower(local)
+	}
+	if p.StripPlus {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	if p.FoldGmailDots && (domain == "gmail.com" || domain == "googlemail.com") {
+		local = strings.Replace(local, ".", "", -1)
+		domain = "gmail.com"
+	}
+
+	return local + "@" + domain
+}
+
+// Candidates the forms an existing account for email can be under, the
+// normalised one first, accounts made before emails were normalised are under
+// the email as it was typed, or all lower case
+func (p EmailPolicy) Candidates(email string) []string {
+	email = strings.TrimSpace(email)
+	candidates := []string{}
+	seen := map[string]bool{}
+	for _, c := range []string{p.Normalise(email), email, strings.ToLower(email)} {
+		if c != "" && !seen[c] {
+			seen[c] = true
+			candidates = append(candidates, c)
+		}
+	}
+
+	return candidates
+}
+
+// Check whether a normalised email can be registered
+func (p EmailPolicy) Check(ctx context.Context, email string) error {
+	invalid := func(code, msg string) error {
+		return ValidationError{
+			Fields: []FieldError{
+				{
+					Field:   "email",
+					Code:    code,
+					Message: msg,
+				},
+			},
+		}
+	}
+
+	if email == "" {
+		return invalid("missing", "missing email address")
+	}
+	if err := checkmail.ValidateFormat(email); err != nil {
+		return invalid("invalid", "invalid email address")
+	}
+
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if p.Disposable[domain] {
+		return invalid("disposable", "disposable email addresses can't be used")
+	}
+
+	if p.Resolver != nil {
+		mx, err := p.Resolver.LookupMX(ctx, domain)
+		if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.IsTemporary || dnsErr.IsTimeout) {
+			// the lookup failed rather than the domain having no mail servers
+			return WithKind(ErrUpstream, fmt.Errorf("mx lookup: %w", err))
+		}
+		if err != nil || len(mx) == 0 {
+			return invalid("no_mx", "email domain can't receive mail")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	login "github.com/carprks/login/service"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmailChangeTTL how long both addresses have to confirm a change
+const EmailChangeTTL = time.Hour * 24
+
+// Email change statuses
+const (
+	EmailChangeRequested = "requested"
+	EmailChangeConfirmed = "confirmed"
+	EmailChangeChanged   = "changed"
+)
+
+// EmailChangeRequest move the caller's account to a new email, the password
+// and, when mfa is on, a code are needed again
+type EmailChangeRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+	NewEmail     string `json:"new_email"`
+}
+
+// EmailChangeConfirm a token sent to either address, with the password and,
+// when mfa is on, a code, the login service can't move a login so the new one
+// is made with the password
+type EmailChangeConfirm struct {
+	Token        string `json:"token"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// EmailChangeObject ...
+type EmailChangeObject struct {
+	Identifier string `json:"identifier"`
+	Status     string `json:"status"`
+	Email      string `json:"email,omitempty"`
+}
+
+// EmailChange a change waiting on both addresses, only the hashes of the tokens
+// are kept, each step of the move is recorded so a confirm that fails part way
+// picks up where it stopped
+type EmailChange struct {
+	Identifier string
+	OldEmail   string
+	NewEmail   string
+	// OldKey the login key the account was under when the change was asked for
+	OldKey       string
+	OldHash      string
+	NewHash      string
+	OldConfirmed bool
+	NewConfirmed bool
+	LoginCreated bool
+	Moved        bool
+	Expires      time.Time
+}
+
+// ErrEmailChangeToken the token doesn't exist or has expired
+var ErrEmailChangeToken = WithKind(ErrValidation, fmt.Errorf("invalid or expired token"))
+
+// EmailChangeStore where changes are kept until both addresses confirm, an
+// account has one change at a time
+type EmailChangeStore interface {
+	Save(c EmailChange) error
+	// Token the change either token hash belongs to
+	Token(hash string) (EmailChange, bool, error)
+	Delete(ident string) error
+}
+
+// newEmailChangeStore in the account table when there is one, the two tokens
+// can be confirmed on different instances
+func newEmailChangeStore() EmailChangeStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryEmailChangeStore()
+	}
+
+	return DynamoEmailChangeStore{table}
+}
+
+// MemoryEmailChangeStore email change store that lives as long as the lambda is warm
+type MemoryEmailChangeStore struct {
+	sync.Mutex
+	changes map[string]EmailChange
+}
+
+// NewMemoryEmailChangeStore ...
+func NewMemoryEmailChangeStore() *MemoryEmailChangeStore {
+	return &MemoryEmailChangeStore{
+		changes: map[string]EmailChange{},
+	}
+}
+
+// Save a new change replaces the one before
+func (m *MemoryEmailChangeStore) Save(c EmailChange) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.changes[c.Identifier] = c
+	return nil
+}
+
+// Token ...
+func (m *MemoryEmailChangeStore) Token(hash string) (EmailChange, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, c := range m.changes {
+		if c.OldHash == hash || c.NewHash == hash {
+			return c, true, nil
+		}
+	}
+
+	return EmailChange{}, false, nil
+}
+
+// Delete ...
+func (m *MemoryEmailChangeStore) Delete(ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.changes, ident)
+	return nil
+}
+
+// EmailChangeHandler ...
+func EmailChangeHandler(body string) (string, error) {
+	return EmailChangeHandlerContext(context.Background(), body)
+}
+
+// EmailChangeHandlerContext EmailChangeHandler bounded by ctx
+func EmailChangeHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().EmailChangeHandler(ctx, body)
+}
+
+// EmailChangeHandler ...
+func (s Service) EmailChangeHandler(ctx context.Context, body string) (string, error) {
+	r := EmailChangeRequest{}
+	return s.mfaHandler("change email", body, &r, func() (interface{}, error) {
+		return s.ChangeEmail(ctx, r)
+	})
+}
+
+// EmailConfirmHandler ...
+func EmailConfirmHandler(body string) (string, error) {
+	return EmailConfirmHandlerContext(context.Background(), body)
+}
+
+// EmailConfirmHandlerContext EmailConfirmHandler bounded by ctx
+func EmailConfirmHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().EmailConfirmHandler(ctx, body)
+}
+
+// EmailConfirmHandler ...
+func (s Service) EmailConfirmHandler(ctx context.Context, body string) (string, error) {
+	r := EmailChangeConfirm{}
+	return s.mfaHandler("confirm email", body, &r, func() (interface{}, error) {
+		return s.ConfirmEmail(ctx, r)
+	})
+}
+
+// ChangeEmail ...
+func ChangeEmail(r EmailChangeRequest) (EmailChangeObject, error) {
+	return ChangeEmailContext(context.Background(), r)
+}
+
+// ChangeEmailContext ChangeEmail bounded by ctx
+func ChangeEmailContext(ctx context.Context, r EmailChangeRequest) (EmailChangeObject, error) {
+	return NewService().ChangeEmail(ctx, r)
+}
+
+// ChangeEmail start moving the caller's account to a new email, a token goes
+// to each address and nothing changes until both have been confirmed
+func (s Service) ChangeEmail(ctx context.Context, r EmailChangeRequest) (EmailChangeObject, error) {
+	// a moved account that is forgotten can't log in
+	if s.Identities == nil {
+		s.Logger.Error("email change without an identity store", nil)
+		return EmailChangeObject{}, fmt.Errorf("email changes need ACCOUNT_TABLE")
+	}
+
+	ident, _, err := s.reauthenticate(ctx, r.Email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return EmailChangeObject{}, err
+	}
+
+	old := s.Emails.Normalise(r.Email)
+	email := s.Emails.Normalise(r.NewEmail)
+	// only the case differing is still the same inbox
+	if strings.EqualFold(email, old) {
+		return EmailChangeObject{}, WithKind(ErrValidation, fmt.Errorf("new email is the same as the old one"))
+	}
+	err = s.Emails.Check(ctx, email)
+	if err != nil {
+		return EmailChangeObject{}, err
+	}
+	// the account changing back to the email it was made with is the one that
+	// owns that identifier
+	taken := login.GenerateIdent(email)
+	if taken != ident {
+		err = s.identifierTaken(taken)
+		if err != nil {
+			return EmailChangeObject{}, err
+		}
+		_, _, err = s.accountFor(ctx, email)
+		if err == nil {
+			return EmailChangeObject{}, WithKind(ErrConflict, fmt.Errorf("login already exists"))
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return EmailChangeObject{}, err
+		}
+	}
+	oldKey, err := s.loginKey(ident)
+	if err != nil {
+		return EmailChangeObject{}, err
+	}
+
+	oldToken, err := generateToken()
+	if err != nil {
+		return EmailChangeObject{}, fmt.Errorf("email change token: %w", err)
+	}
+	newToken, err := generateToken()
+	if err != nil {
+		return EmailChangeObject{}, fmt.Errorf("email change token: %w", err)
+	}
+
+	err = s.EmailChanges.Save(EmailChange{
+		Identifier: ident,
+		OldEmail:   old,
+		NewEmail:   email,
+		OldKey:     oldKey,
+		OldHash:    hashToken(oldToken),
+		NewHash:    hashToken(newToken),
+		Expires:    s.now().Add(EmailChangeTTL),
+	})
+	if err != nil {
+		return EmailChangeObject{}, fmt.Errorf("email change save: %w", err)
+	}
+
+	for _, n := range []Notification{
+		{Type: NotificationEmailChangeOld, Email: old, Token: oldToken},
+		{Type: NotificationEmailChangeNew, Email: email, Token: newToken},
+	} {
+		err = s.Notifier.Notify(n)
+		if err != nil {
+			s.Logger.Error("email change notify err", Fields{"err": err, "type": n.Type})
+		}
+	}
+	s.Logger.Info("email change requested", Fields{"identifier": ident})
+
+	return EmailChangeObject{
+		Identifier: ident,
+		Status:     EmailChangeRequested,
+	}, nil
+}
+
+// ConfirmEmail ...
+func ConfirmEmail(r EmailChangeConfirm) (EmailChangeObject, error) {
+	return ConfirmEmailContext(context.Background(), r)
+}
+
+// ConfirmEmailContext ConfirmEmail bounded by ctx
+func ConfirmEmailContext(ctx context.Context, r EmailChangeConfirm) (EmailChangeObject, error) {
+	return NewService().ConfirmEmail(ctx, r)
+}
+
+// ConfirmEmail confirm one of the addresses, once both have the login moves to
+// the new email, the identifier and the permissions under it stay as they are
+func (s Service) ConfirmEmail(ctx context.Context, r EmailChangeConfirm) (EmailChangeObject, error) {
+	if s.Identities == nil {
+		s.Logger.Error("email change without an identity store", nil)
+		return EmailChangeObject{}, fmt.Errorf("email changes need ACCOUNT_TABLE")
+	}
+
+	hash := hashToken(r.Token)
+	c, ok, err := s.EmailChanges.Token(hash)
+	if err != nil {
+		return EmailChangeObject{}, fmt.Errorf("email change token: %w", err)
+	}
+	if !ok || !s.now().Before(c.Expires) {
+		return EmailChangeObject{}, ErrEmailChangeToken
+	}
+
+	// the account logs in with the new email once it has moved
+	email := c.OldEmail
+	if c.Moved {
+		email = c.NewEmail
+	}
+	ident, _, err := s.reauthenticate(ctx, email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return EmailChangeObject{}, err
+	}
+	if ident != c.Identifier {
+		return EmailChangeObject{}, ErrEmailChangeToken
+	}
+
+	if hash == c.OldHash {
+		c.OldConfirmed = true
+	} else {
+		c.NewConfirmed = true
+	}
+	err = s.EmailChanges.Save(c)
+	if err != nil {
+		return EmailChangeObject{}, fmt.Errorf("email change save: %w", err)
+	}
+
+	if !c.OldConfirmed || !c.NewConfirmed {
+		return EmailChangeObject{
+			Identifier: c.Identifier,
+			Status:     EmailChangeConfirmed,
+		}, nil
+	}
+
+	err = s.changeEmail(ctx, c, r.Password)
+	if err != nil {
+		return EmailChangeObject{}, err
+	}
+
+	return EmailChangeObject{
+		Identifier: c.Identifier,
+		Status:     EmailChangeChanged,
+		Email:      c.NewEmail,
+	}, nil
+}
+
+// changeEmail make the login under the new email, point the account at it and
+// then delete the old one, so until the end the old email still logs in
+func (s Service) changeEmail(ctx context.Context, c EmailChange, password string) error {
+	to := login.GenerateIdent(c.NewEmail)
+
+	if !c.LoginCreated {
+		_, err := s.CreateLogin(ctx, login.RegisterRequest{
+			Email:    c.NewEmail,
+			Password: password,
+			Verify:   password,
+		})
+		// a create whose answer was lost has landed, the password says it is this one
+		if errors.Is(err, ErrConflict) {
+			lerr := s.call(ctx, s.LoginUpstream, true, func(ctx context.Context) error {
+				_, err := s.LoginClient.Login(ctx, login.LoginRequest{
+					Email:    c.NewEmail,
+					Password: password,
+				})
+				return err
+			})
+			if lerr == nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			s.Logger.Error("email change login err", Fields{"err": err})
+			return fmt.Errorf("can't create login: %w", err)
+		}
+		c.LoginCreated = true
+		err = s.EmailChanges.Save(c)
+		if err != nil {
+			return fmt.Errorf("email change save: %w", err)
+		}
+	}
+
+	if !c.Moved {
+		err := s.Identities.Move(c.Identifier, c.OldKey, to)
+		if err != nil {
+			return fmt.Errorf("identity move: %w", err)
+		}
+		c.Moved = true
+		err = s.EmailChanges.Save(c)
+		if err != nil {
+			return fmt.Errorf("email change save: %w", err)
+		}
+	}
+
+	err := s.DeleteLogin(ctx, c.OldKey)
+	if err != nil {
+		return fmt.Errorf("can't delete old login: %w", err)
+	}
+
+	// the new address proved itself by confirming
+	err = s.Verifications.Save(Verification{
+		Identifier: c.Identifier,
+		Email:      c.NewEmail,
+		Verified:   true,
+		Sent:       s.now(),
+	})
+	if err != nil {
+		s.Logger.Error("email change verification err", Fields{"err": err})
+	}
+	err = s.EmailChanges.Delete(c.Identifier)
+	if err != nil {
+		s.Logger.Error("email change delete err", Fields{"err": err})
+	}
+	s.unlock(c.OldEmail)
+
+	s.Logger.Info("email changed", Fields{"identifier": c.Identifier})
+	return nil
+}
@@ -0,0 +1,229 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var emailChangeRequest = service.EmailChangeRequest{
+	Email:    "tester@carpark.ninja",
+	Password: "Carpark-Ninja-2019",
+	NewEmail: "moved@carpark.ninja",
+}
+
+// emailConfirm the token with the account's password
+func emailConfirm(token string) service.EmailChangeConfirm {
+	return service.EmailChangeConfirm{
+		Token:    token,
+		Password: "Carpark-Ninja-2019",
+	}
+}
+
+// confirmEmailChange confirm both tokens the last change sent
+func confirmEmailChange(t *testing.T, s service.Service, notifier *captureNotifier) service.EmailChangeObject {
+	sent := notifier.sent[len(notifier.sent)-2:]
+	assert.Equal(t, service.NotificationEmailChangeOld, sent[0].Type)
+	assert.Equal(t, service.NotificationEmailChangeNew, sent[1].Type)
+
+	resp, err := s.ConfirmEmail(context.Background(), emailConfirm(sent[1].Token))
+	assert.Nil(t, err)
+	assert.Equal(t, service.EmailChangeConfirmed, resp.Status)
+
+	resp, err = s.ConfirmEmail(context.Background(), emailConfirm(sent[0].Token))
+	assert.Nil(t, err)
+	return resp
+}
+
+func TestChangeEmail(t *testing.T) {
+	s, _, logins, perms, ident := deleteService(t, 0)
+	notifier := &captureNotifier{}
+	s.Notifier = notifier
+
+	tests := []struct {
+		name    string
+		request service.EmailChangeRequest
+		expect  error
+	}{
+		{
+			name: "wrong password",
+			request: service.EmailChangeRequest{
+				Email:    emailChangeRequest.Email,
+				Password: "wrong",
+				NewEmail: emailChangeRequest.NewEmail,
+			},
+			expect: service.ErrUnauthorized,
+		},
+		{
+			name: "same email",
+			request: service.EmailChangeRequest{
+				Email:    emailChangeRequest.Email,
+				Password: emailChangeRequest.Password,
+				NewEmail: "Tester@carpark.ninja",
+			},
+			expect: service.ErrValidation,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.ChangeEmail(context.Background(), test.request)
+			assert.True(t, errors.Is(err, test.expect), err)
+		})
+	}
+	assert.Len(t, notifier.sent, 0)
+
+	resp, err := s.ChangeEmail(context.Background(), emailChangeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.EmailChangeObject{
+		Identifier: ident,
+		Status:     service.EmailChangeRequested,
+	}, resp)
+	assert.Equal(t, "tester@carpark.ninja", notifier.sent[0].Email)
+	assert.Equal(t, "moved@carpark.ninja", notifier.sent[1].Email)
+
+	// a token alone isn't enough
+	_, err = s.ConfirmEmail(context.Background(), service.EmailChangeConfirm{Token: notifier.sent[0].Token})
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+
+	// nothing moves until both have confirmed
+	resp, err = s.ConfirmEmail(context.Background(), emailConfirm(notifier.sent[0].Token))
+	assert.Nil(t, err)
+	assert.Equal(t, service.EmailChangeConfirmed, resp.Status)
+	_, err = s.LoginUser(context.Background(), login.LoginRequest{Email: "moved@carpark.ninja", Password: "Carpark-Ninja-2019"})
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+
+	resp, err = s.ConfirmEmail(context.Background(), emailConfirm(notifier.sent[1].Token))
+	assert.Nil(t, err)
+	assert.Equal(t, service.EmailChangeObject{
+		Identifier: ident,
+		Status:     service.EmailChangeChanged,
+		Email:      "moved@carpark.ninja",
+	}, resp)
+	_, err = s.ConfirmEmail(context.Background(), emailConfirm(notifier.last().Token))
+	assert.True(t, errors.Is(err, service.ErrValidation))
+
+	// the login has been made again under the new email, the identifier and
+	// its permissions haven't moved
+	assert.Len(t, logins.logins, 1)
+	_, ok := logins.logins[login.GenerateIdent("moved@carpark.ninja")]
+	assert.True(t, ok)
+	assert.Len(t, perms.perms[ident], len(testsRegister[0].expect.Permissions))
+	lo, err := s.Login(context.Background(), login.LoginRequest{Email: "moved@carpark.ninja", Password: "Carpark-Ninja-2019"})
+	assert.Nil(t, err)
+	assert.Equal(t, ident, lo.Identifier)
+	assert.Equal(t, perms.perms[ident], lo.Permissions)
+	_, err = s.Login(context.Background(), login.LoginRequest{Email: "tester@carpark.ninja", Password: "Carpark-Ninja-2019"})
+	assert.Equal(t, service.ErrLoginFailed, err)
+
+	// the old email's identifier still belongs to the account
+	_, err = s.Register(context.Background(), testsRegister[0].request)
+	assert.True(t, errors.Is(err, service.ErrConflict))
+
+	// and it can change back to it
+	_, err = s.ChangeEmail(context.Background(), service.EmailChangeRequest{
+		Email:    "moved@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		NewEmail: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+	resp = confirmEmailChange(t, s, notifier)
+	assert.Equal(t, service.EmailChangeChanged, resp.Status)
+	lo, err = s.Login(context.Background(), login.LoginRequest{Email: "tester@carpark.ninja", Password: "Carpark-Ninja-2019"})
+	assert.Nil(t, err)
+	assert.Equal(t, ident, lo.Identifier)
+	_, ok, err = s.Identities.Login(ident)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestChangeEmailFailures(t *testing.T) {
+	s, now, logins, _, ident := deleteService(t, 0)
+	notifier := &captureNotifier{}
+	s.Notifier = notifier
+
+	_, err := s.ChangeEmail(context.Background(), emailChangeRequest)
+	assert.Nil(t, err)
+	oldToken, newToken := notifier.sent[0].Token, notifier.sent[1].Token
+	_, err = s.ConfirmEmail(context.Background(), emailConfirm(oldToken))
+	assert.Nil(t, err)
+	logins.fail = true
+	_, err = s.ConfirmEmail(context.Background(), emailConfirm(newToken))
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+
+	// the account is already under the new email, only the old login is left
+	lo, err := s.LoginUser(context.Background(), login.LoginRequest{Email: "moved@carpark.ninja", Password: "Carpark-Ninja-2019"})
+	assert.Nil(t, err)
+	assert.Equal(t, ident, lo.Identifier)
+	assert.Len(t, logins.logins, 2)
+
+	// confirming again tries again
+	logins.fail = false
+	resp, err := s.ConfirmEmail(context.Background(), emailConfirm(newToken))
+	assert.Nil(t, err)
+	assert.Equal(t, service.EmailChangeChanged, resp.Status)
+	assert.Len(t, logins.logins, 1)
+
+	// deleting the account deletes the login it has moved to
+	_, err = s.Delete(context.Background(), service.DeleteRequest{
+		Email:    "moved@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, logins.logins, 0)
+	_, ok, err := s.Identities.Login(ident)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// tokens run out
+	_, err = s.Register(context.Background(), testsRegister[0].request)
+	assert.Nil(t, err)
+	_, err = s.ChangeEmail(context.Background(), emailChangeRequest)
+	assert.Nil(t, err)
+	*now = now.Add(service.EmailChangeTTL + time.Second)
+	_, err = s.ConfirmEmail(context.Background(), emailConfirm(notifier.last().Token))
+	assert.Equal(t, service.ErrEmailChangeToken, err)
+
+	// a moved account has to be kept somewhere that lasts
+	s.Identities = nil
+	_, err = s.ChangeEmail(context.Background(), emailChangeRequest)
+	assert.EqualError(t, err, "email changes need ACCOUNT_TABLE")
+}
+
+func TestChangeEmailHandler(t *testing.T) {
+	s, _, _, _, ident := deleteService(t, 0)
+	notifier := &captureNotifier{}
+	s.Notifier = notifier
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/email/change",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","new_email":"moved@carpark.ninja"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Body, `"status":"requested"`)
+
+	for i, status := range []string{"confirmed", "changed"} {
+		response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+			Resource: "/email/confirm",
+			Body:     fmt.Sprintf(`{"token":%q,"password":"Carpark-Ninja-2019"}`, notifier.sent[i].Token),
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Contains(t, response.Body, fmt.Sprintf(`"status":%q`, status))
+		assert.Contains(t, response.Body, ident)
+	}
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/email/confirm",
+		Body:     `{"token":"guessed"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
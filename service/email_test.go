@@ -0,0 +1,203 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestEmailNormalise(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy service.EmailPolicy
+		email  string
+		expect string
+	}{
+		{
+			name:   "trimmed with a lower case domain",
+			email:  " Tester@Carpark.Ninja ",
+			expect: "Tester@carpark.ninja",
+		},
+		{
+			name: "case folded",
+			policy: service.EmailPolicy{
+				FoldCase: true,
+			},
+			email:  " Tester@Carpark.Ninja ",
+			expect: "tester@carpark.ninja",
+		},
+		{
+			name:   "plus kept by default",
+			email:  "tester+parking@carpark.ninja",
+			expect: "tester+parking@carpark.ninja",
+		},
+		{
+			name: "plus stripped",
+			policy: service.EmailPolicy{
+				StripPlus: true,
+			},
+			email:  "tester+parking@carpark.ninja",
+			expect: "tester@carpark.ninja",
+		},
+		{
+			name: "gmail dots folded",
+			policy: service.EmailPolicy{
+				FoldGmailDots: true,
+			},
+			email:  "Car.Park.Ninja@googlemail.com",
+			expect: "CarParkNinja@gmail.com",
+		},
+		{
+			name: "other dots kept",
+			policy: service.EmailPolicy{
+				FoldGmailDots: true,
+			},
+			email:  "car.park@carpark.ninja",
+			expect: "car.park@carpark.ninja",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, test.policy.Normalise(test.email))
+		})
+	}
+}
+
+type fakeResolver map[string]error
+
+func (f fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	err, ok := f[name]
+	if !ok {
+		return []*net.MX{{Host: "mx." + name, Pref: 10}}, nil
+	}
+
+	return nil, err
+}
+
+func TestEmailCheck(t *testing.T) {
+	policy := service.NewEmailPolicy()
+	policy.Resolver = fakeResolver{
+		"nomail.ninja": &net.DNSError{Err: "no such host", IsNotFound: true},
+		"flaky.ninja":  &net.DNSError{Err: "server misbehaving", IsTemporary: true},
+	}
+
+	tests := []struct {
+		email string
+		code  string
+		kind  error
+	}{
+		{email: "tester@carpark.ninja"},
+		{email: "", code: "missing", kind: service.ErrValidation},
+		{email: "tester", code: "invalid", kind: service.ErrValidation},
+		{email: "tester@carpark..ninja", code: "invalid", kind: service.ErrValidation},
+		{email: "tester@mailinator.com", code: "disposable", kind: service.ErrValidation},
+		{email: "tester@nomail.ninja", code: "no_mx", kind: service.ErrValidation},
+		{email: "tester@flaky.ninja", kind: service.ErrUpstream},
+	}
+
+	for _, test := range tests {
+		t.Run(test.email, func(t *testing.T) {
+			err := policy.Check(context.Background(), test.email)
+			if test.kind == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, test.kind), fmt.Sprintf("%v", err))
+
+			var ve service.ValidationError
+			if test.code != "" && assert.True(t, errors.As(err, &ve)) {
+				assert.Equal(t, "email", ve.Fields[0].Field)
+				assert.Equal(t, test.code, ve.Fields[0].Code)
+			}
+		})
+	}
+}
+
+func TestEmailCandidates(t *testing.T) {
+	policy := service.EmailPolicy{}
+	assert.Equal(t, []string{"Tester@carpark.ninja", "Tester@Carpark.Ninja", "tester@carpark.ninja"}, policy.Candidates(" Tester@Carpark.Ninja "))
+	assert.Equal(t, []string{"tester@carpark.ninja"}, policy.Candidates("tester@carpark.ninja"))
+	assert.Empty(t, policy.Candidates(" "))
+}
+
+func TestRegisterEmailNormalised(t *testing.T) {
+	s := service.NewService()
+
+	resp, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    " tester@Carpark.Ninja ",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, testsRegister[0].expect.Identifier, resp.Identifier)
+	assert.Equal(t, "tester@carpark.ninja", resp.Email)
+
+	// the same inbox can't be registered twice
+	_, err = s.Register(context.Background(), testsRegister[0].request)
+	assert.True(t, errors.Is(err, service.ErrConflict))
+
+	lo, err := s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@CARPARK.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Identifier, lo.Identifier)
+
+	deleteAccount(resp.Identifier)
+}
+
+func TestLegacyEmail(t *testing.T) {
+	s, _, logins, perms, _ := deleteService(t, 0)
+	delete(logins.logins, login.GenerateIdent("tester@carpark.ninja"))
+	notifier := &captureNotifier{}
+	s.Notifier = notifier
+
+	// an account made before emails were normalised, under the email as typed
+	legacy := "Tester+Parking@Carpark.Ninja"
+	ident := login.GenerateIdent(legacy)
+	_, err := s.CreateLogin(context.Background(), login.RegisterRequest{
+		Email:    legacy,
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	perms.perms[ident] = perms.perms[login.GenerateIdent("tester@carpark.ninja")]
+
+	lo, err := s.Login(context.Background(), login.LoginRequest{Email: legacy, Password: "Carpark-Ninja-2019"})
+	assert.Nil(t, err)
+	assert.Equal(t, ident, lo.Identifier)
+
+	// nobody else gets the same inbox
+	_, err = s.Register(context.Background(), login.RegisterRequest{
+		Email:    legacy,
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.True(t, errors.Is(err, service.ErrConflict))
+
+	// and the password can still be reset and changed
+	_, err = s.Reset(context.Background(), service.ResetRequest{Email: legacy})
+	assert.Nil(t, err)
+	reset, err := s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Spaced-0ut-Parking",
+		Verify:   "Spaced-0ut-Parking",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ident, reset.Identifier)
+	_, err = s.ChangePassword(context.Background(), service.PasswordRequest{
+		Email:       legacy,
+		Password:    "Spaced-0ut-Parking",
+		NewPassword: "Carpark-Ninja-2020",
+		Verify:      "Carpark-Ninja-2020",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Carpark-Ninja-2020", logins.logins[ident].Password)
+	assert.Len(t, logins.logins, 1)
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Kinds of error, use errors.Is to check which kind an error is
+var (
+	ErrValidation   = errors.New("validation")
+	ErrConflict     = errors.New("conflict")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrUpstream     = errors.New("upstream unavailable")
+	ErrNotFound     = errors.New("not found")
+	// ErrTooManyAttempts refused until later
+	ErrTooManyAttempts = errors.New("too many attempts")
+	// ErrLoginLost a login was deleted and couldn't be registered again, the
+	// account has no login until it is
+	ErrLoginLost = errors.New("login lost")
+)
+
+// kindError keeps the message of err but is also its kind
+type kindError struct {
+	kind error
+	err  error
+}
+
+// WithKind err with the same message, that errors.Is reports as kind
+func WithKind(kind, err error) error {
+	return kindError{
+		kind: kind,
+		err:  err,
+	}
+}
+
+// Error ...
+func (e kindError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap ...
+func (e kindError) Unwrap() error {
+	return e.err
+}
+
+// Is ...
+func (e kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// ErrorObject the body sent back when something went wrong
+type ErrorObject struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail ...
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// errorStatus the status and code for the kind of error
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest, "validation"
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, ErrUpstream):
+		return http.StatusBadGateway, "upstream_unavailable"
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, ErrTooManyAttempts):
+		return http.StatusTooManyRequests, "too_many_attempts"
+	}
+
+	return http.StatusInternalServerError, "internal"
+}
+
+func jsonHeaders() map[string]string {
+	return map[string]string{
+		"Content-Type": "application/json",
+	}
+}
+
+func (s Service) errorResponse(request events.APIGatewayProxyRequest, err error) events.APIGatewayProxyResponse {
+	status, code := errorStatus(err)
+
+	detail := ErrorDetail{
+		Code:      code,
+		Message:   err.Error(),
+		RequestID: request.RequestContext.RequestID,
+	}
+	var ve ValidationError
+	if errors.As(err, &ve) {
+		detail.Fields = ve.Fields
+	}
+
+	j, merr := json.Marshal(ErrorObject{
+		Error: detail,
+	})
+	if merr != nil {
+		s.Logger.Error("can't marshall error", Fields{"err": merr})
+		status = http.StatusInternalServerError
+		j = []byte(`{"error":{"code":"internal","message":"internal error"}}`)
+	}
+
+	headers := jsonHeaders()
+	var te throttledError
+	if errors.As(err, &te) {
+		headers["Retry-After"] = strconv.Itoa(int(math.Ceil(te.RetryAfter().Seconds())))
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    headers,
+		Body:       string(j),
+	}
+}
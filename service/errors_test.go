@@ -0,0 +1,105 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestHandlerErrors(t *testing.T) {
+	requireFakes(t)
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		fail    func()
+		expect  events.APIGatewayProxyResponse
+	}{
+		{
+			name: "unknown resource",
+			request: events.APIGatewayProxyRequest{
+				Resource: "/unknown",
+				RequestContext: events.APIGatewayProxyRequestContext{
+					RequestID: "request-1",
+				},
+			},
+			expect: events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error":{"code":"not_found","message":"unknown resource: /unknown","request_id":"request-1"}}`,
+			},
+		},
+		{
+			name: "invalid body",
+			request: events.APIGatewayProxyRequest{
+				Resource: "/login",
+				Body:     `{"email":`,
+				RequestContext: events.APIGatewayProxyRequestContext{
+					RequestID: "request-2",
+				},
+			},
+			expect: events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error":{"code":"validation","message":"can't unmarshall login: unexpected end of JSON input","request_id":"request-2"}}`,
+			},
+		},
+		{
+			name: "login upstream down",
+			request: events.APIGatewayProxyRequest{
+				Resource: "/login",
+				Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
+				RequestContext: events.APIGatewayProxyRequestContext{
+					RequestID: "request-3",
+				},
+			},
+			fail: func() {
+				loginService.Down("/login", http.StatusBadGateway)
+			},
+			expect: events.APIGatewayProxyResponse{
+				StatusCode: 502,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error":{"code":"upstream_unavailable","message":"can't get login: can't get login for user: login came back with a different statuscode: 502","request_id":"request-3"}}`,
+			},
+		},
+		{
+			name: "allowed upstream down",
+			request: events.APIGatewayProxyRequest{
+				Resource: "/allowed",
+				Body:     `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","permissions":[{"action":"login","name":"account"}]}`,
+			},
+			fail: func() {
+				permissionsService.Down("/allowed", http.StatusServiceUnavailable)
+			},
+			expect: events.APIGatewayProxyResponse{
+				StatusCode: 502,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error":{"code":"upstream_unavailable","message":"can't get allowed: allowed came back with a different statuscode: 503","request_id":""}}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.fail != nil {
+				test.fail()
+			}
+			response, err := service.Handler(context.Background(), test.request)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, response)
+		})
+	}
+}
+
+func TestWithKind(t *testing.T) {
+	err := fmt.Errorf("can't register: %w", service.WithKind(service.ErrConflict, fmt.Errorf("login already exists")))
+
+	assert.Equal(t, "can't register: login already exists", err.Error())
+	assert.True(t, errors.Is(err, service.ErrConflict))
+	assert.False(t, errors.Is(err, service.ErrValidation))
+}
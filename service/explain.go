@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	permissions "github.com/carprks/permissions/service"
+	"sort"
+)
+
+// ExplainCandidates how many of the closest stored permissions are given for a denied check
+const ExplainCandidates = 3
+
+// AllowedExplanation why Allowed gave the status it did, Status is worked out
+// the same way as the permissions service so it is the answer Allowed gives
+type AllowedExplanation struct {
+	Identifier string             `json:"identifier"`
+	Status     string             `json:"status"`
+	Checks     []CheckExplanation `json:"checks"`
+}
+
+// CheckExplanation one of the permissions asked about
+type CheckExplanation struct {
+	Check   permissions.Permission `json:"check"`
+	Allowed bool                   `json:"allowed"`
+	// Matched the stored permission that allowed it
+	Matched *permissions.Permission `json:"matched,omitempty"`
+	// Wildcards the fields of Matched that were a "*"
+	Wildcards []string `json:"wildcards,omitempty"`
+	// Roles the role templates that grant Matched to the identifier
+	Roles []string `json:"roles,omitempty"`
+	// Candidates when denied, the stored permissions that came closest
+	Candidates []ExplainCandidate `json:"candidates,omitempty"`
+}
+
+// ExplainCandidate a stored permission that didn't match, and why
+type ExplainCandidate struct {
+	Permission permissions.Permission `json:"permission"`
+	Reasons    []string               `json:"reasons"`
+}
+
+// AllowedExplainHandler ...
+func AllowedExplainHandler(body string) (string, error) {
+	return AllowedExplainHandlerContext(context.Background(), body)
+}
+
+// AllowedExplainHandlerContext AllowedExplainHandler bounded by ctx
+func AllowedExplainHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().AllowedExplainHandler(ctx, body)
+}
+
+// AllowedExplainHandler ...
+func (s Service) AllowedExplainHandler(ctx context.Context, body string) (string, error) {
+	r := permissions.Permissions{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall input", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall input: %w", WithKind(ErrValidation, err))
+	}
+
+	// the explanation shows every stored permission, so it is for admins only
+	err = s.requireAdmin(ctx, r.Identifier)
+	if err != nil {
+		s.Logger.Error("can't explain allowed", Fields{"err": err, "identifier": r.Identifier})
+		return "", fmt.Errorf("can't explain allowed: %w", err)
+	}
+
+	rf, err := s.AllowedExplain(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't explain allowed", Fields{"err": err, "request": r})
+		return "", fmt.Errorf("can't explain allowed: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshal explanation", Fields{"err": err})
+		return "", fmt.Errorf("can't marshal explanation: %w", err)
+	}
+
+	return string(rfb), nil
+}
+
+// AllowedExplain ...
+func AllowedExplain(p permissions.Permissions) (AllowedExplanation, error) {
+	return AllowedExplainContext(context.Background(), p)
+}
+
+// AllowedExplainContext AllowedExplain bounded by ctx
+func AllowedExplainContext(ctx context.Context, p permissions.Permissions) (AllowedExplanation, error) {
+	return NewService().AllowedExplain(ctx, p)
+}
+
+// AllowedExplain Allowed with the reasons, it always reads the stored
+// permissions rather than the cache so it shows what is there now
+func (s Service) AllowedExplain(ctx context.Context, p permissions.Permissions) (AllowedExplanation, error) {
+	if p.Identifier == "" || len(p.Permissions) == 0 {
+		return AllowedExplanation{}, WithKind(ErrValidation, fmt.Errorf("needs an identifier and permissions to check"))
+	}
+
+	current := permissions.Permissions{}
+	err := s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		var err error
+		current, err = s.PermissionsClient.Retrieve(ctx, p.Identifier)
+		return err
+	})
+	if err != nil {
+		s.Logger.Error("explain retrieve err", Fields{"err": err})
+		return AllowedExplanation{}, err
+	}
+	stored := current.Permissions
+	if current.Status != "" {
+		stored = nil
+	}
+
+	ex := AllowedExplanation{
+		Identifier: p.Identifier,
+		Status:     "denied",
+		Checks:     []CheckExplanation{},
+	}
+	for _, cperm := range p.Permissions {
+		ce := s.explainCheck(stored, cperm, p.Identifier)
+		if ce.Allowed {
+			ex.Status = "allowed"
+		}
+		ex.Checks = append(ex.Checks, ce)
+	}
+
+	return ex, nil
+}
+
+func (s Service) explainCheck(stored []permissions.Permission, cperm permissions.Permission, ident string) CheckExplanation {
+	ce := CheckExplanation{
+		Check: cperm,
+	}
+
+	for _, perm := range stored {
+		if ok, wildcards := permissionMatches(perm, cperm, ident); ok {
+			matched := perm
+			ce.Allowed = true
+			ce.Matched = &matched
+			ce.Wildcards = wildcards
+			ce.Roles = s.grantedBy(matched, ident)
+			return ce
+		}
+	}
+
+	type scored struct {
+		candidate ExplainCandidate
+		score     int
+	}
+	closest := []scored{}
+	for _, perm := range stored {
+		c := scored{
+			candidate: ExplainCandidate{
+				Permission: perm,
+			},
+		}
+		if perm.Name == cperm.Name {
+			c.score += 2
+		} else {
+			c.candidate.Reasons = append(c.candidate.Reasons, fmt.Sprintf("name is %s not %s", perm.Name, cperm.Name))
+		}
+		if perm.Action == cperm.Action {
+			c.score++
+		} else {
+			c.candidate.Reasons = append(c.candidate.Reasons, fmt.Sprintf("action is %s not %s", perm.Action, cperm.Action))
+		}
+		if perm.Identifier == ident || perm.Identifier == "*" {
+			c.score++
+		} else {
+			c.candidate.Reasons = append(c.candidate.Reasons, fmt.Sprintf("identifier is %s not %s or *", perm.Identifier, ident))
+		}
+		if c.score >= 2 {
+			closest = append(closest, c)
+		}
+	}
+	sort.SliceStable(closest, func(i, j int) bool {
+		return closest[i].score > closest[j].score
+	})
+	for i := 0; i < len(closest) && i < ExplainCandidates; i++ {
+		ce.Candidates = append(ce.Candidates, closest[i].candidate)
+	}
+
+	return ce
+}
+
+// grantedBy the role templates that give ident perm, none means it was
+// granted by hand or by a template that has since changed
+func (s Service) grantedBy(perm permissions.Permission, ident string) []string {
+	names := []string{}
+	for name := range s.Roles.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	roles := []string{}
+	for _, name := range names {
+		perms, err := s.Roles.Render(name, ident)
+		if err != nil {
+			continue
+		}
+		for _, p := range perms {
+			if p == perm {
+				roles = append(roles, name)
+				break
+			}
+		}
+	}
+
+	return roles
+}
@@ -0,0 +1,192 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAllowedExplain(t *testing.T) {
+	login := permissions.Permission{Name: "account", Action: "login", Identifier: "ident"}
+	view := permissions.Permission{Name: "account", Action: "view", Identifier: "ident"}
+	viewAny := permissions.Permission{Name: "account", Action: "view", Identifier: "*"}
+
+	tests := []struct {
+		name   string
+		stored []permissions.Permission
+		check  permissions.Permission
+		expect service.CheckExplanation
+	}{
+		{
+			name:   "own",
+			stored: []permissions.Permission{login, view},
+			check:  permissions.Permission{Name: "account", Action: "login"},
+			expect: service.CheckExplanation{
+				Allowed: true,
+				Matched: &login,
+				Roles:   []string{"driver"},
+			},
+		},
+		{
+			name:   "wildcard identifier",
+			stored: []permissions.Permission{login, viewAny},
+			check:  permissions.Permission{Name: "account", Action: "view", Identifier: "other"},
+			expect: service.CheckExplanation{
+				Allowed:   true,
+				Matched:   &viewAny,
+				Wildcards: []string{"identifier"},
+				Roles:     []string{"support"},
+			},
+		},
+		{
+			name:   "granted by hand",
+			stored: []permissions.Permission{{Name: "carparks", Action: "*", Identifier: "ident"}},
+			check:  permissions.Permission{Name: "carparks", Action: "book"},
+			expect: service.CheckExplanation{
+				Allowed:   true,
+				Matched:   &permissions.Permission{Name: "carparks", Action: "*", Identifier: "ident"},
+				Wildcards: []string{"action"},
+				Roles:     []string{},
+			},
+		},
+		{
+			name: "denied",
+			stored: []permissions.Permission{
+				{Name: "carparks", Action: "report", Identifier: "*"},
+				login,
+				{Name: "account", Action: "edit", Identifier: "other"},
+			},
+			check: permissions.Permission{Name: "account", Action: "edit"},
+			expect: service.CheckExplanation{
+				Candidates: []service.ExplainCandidate{
+					{
+						Permission: login,
+						Reasons:    []string{"action is login not edit"},
+					},
+					{
+						Permission: permissions.Permission{Name: "account", Action: "edit", Identifier: "other"},
+						Reasons:    []string{"identifier is other not ident or *"},
+					},
+				},
+			},
+		},
+		{
+			name:  "no permissions",
+			check: permissions.Permission{Name: "account", Action: "login"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, perms := reconcileService(t)
+			if len(test.stored) >= 1 {
+				perms.perms["ident"] = test.stored
+			}
+			p := permissions.Permissions{
+				Identifier:  "ident",
+				Permissions: []permissions.Permission{test.check},
+			}
+
+			ex, err := s.AllowedExplain(context.Background(), p)
+			assert.Nil(t, err)
+			test.expect.Check = test.check
+			assert.Equal(t, []service.CheckExplanation{test.expect}, ex.Checks)
+
+			// the same answer Allowed gives
+			pr, err := s.Allowed(context.Background(), p)
+			assert.Nil(t, err)
+			assert.Equal(t, pr.Status, ex.Status)
+		})
+	}
+
+	s, _ := reconcileService(t)
+	_, err := s.AllowedExplain(context.Background(), permissions.Permissions{
+		Identifier: "ident",
+	})
+	assert.True(t, errors.Is(err, service.ErrValidation))
+}
+
+// adminToken an access token for ident, who can administer every account
+func adminToken(t *testing.T, s service.Service, perms *memoryPermissions, ident string) string {
+	perms.perms[ident] = []permissions.Permission{
+		{Name: "account", Action: "admin", Identifier: "*"},
+	}
+	token, err := s.Tokens.Sign(service.Claims{
+		Subject: ident,
+		Expires: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.Nil(t, err)
+
+	return token
+}
+
+func TestAllowedExplainHandler(t *testing.T) {
+	s, perms := reconcileService(t)
+	perms.perms["ident"] = []permissions.Permission{
+		{Name: "account", Action: "login", Identifier: "ident"},
+	}
+	admin := adminToken(t, s, perms, "admin")
+	driver, err := s.Tokens.Sign(service.Claims{
+		Subject: "ident",
+		Expires: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.Nil(t, err)
+
+	body := `{"identifier":"ident","permissions":[{"name":"carparks","action":"book"},{"name":"account","action":"login"}]}`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{
+			name:   "no token",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "bad token",
+			headers: map[string]string{"Authorization": "Bearer nope"},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "not an admin",
+			headers: map[string]string{"Authorization": "Bearer " + driver},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "admin",
+			headers: map[string]string{"authorization": "bearer " + admin},
+			status:  http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+				Resource: "/allowed/explain",
+				Headers:  test.headers,
+				Body:     body,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, test.status, response.StatusCode)
+		})
+	}
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/allowed/explain",
+		Headers:  map[string]string{"Authorization": "Bearer " + admin},
+		Body:     body,
+	})
+	assert.Nil(t, err)
+	ex := service.AllowedExplanation{}
+	assert.Nil(t, json.Unmarshal([]byte(response.Body), &ex))
+	assert.Equal(t, "allowed", ex.Status)
+	assert.False(t, ex.Checks[0].Allowed)
+	assert.True(t, ex.Checks[1].Allowed)
+}
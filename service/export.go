@@ -0,0 +1,533 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	permissions "github.com/carprks/permissions/service"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ExportTTL how long an export can be downloaded for once it is ready
+	ExportTTL = time.Hour * 24
+	// ExportAttempts how many times an export is tried before it fails
+	ExportAttempts = 3
+)
+
+// Export statuses
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export formats
+const (
+	ExportZip  = "zip"
+	ExportJSON = "json"
+)
+
+// ExportRequest export the caller's data, the password and, when mfa is on, a
+// code are needed again
+type ExportRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// ExportObject ...
+type ExportObject struct {
+	ID         string `json:"id"`
+	Identifier string `json:"identifier"`
+	Status     string `json:"status"`
+}
+
+// ExportDownload fetch a ready export with the token that was sent
+type ExportDownload struct {
+	Token string `json:"token"`
+	// Format zip, the default, or json
+	Format string `json:"format"`
+}
+
+// ExportJob a requested export, the archive is kept until the token expires and
+// only the hash of the token is kept
+type ExportJob struct {
+	ID         string
+	Identifier string
+	Email      string
+	Status     string
+	Requested  time.Time
+	Attempts   int
+
+	TokenHash string
+	Expires   time.Time
+	Document  []byte
+	Archive   []byte
+}
+
+// ExportStore where exports are kept between requests
+type ExportStore interface {
+	Save(e ExportJob) error
+	// Token the export the token hash belongs to
+	Token(hash string) (ExportJob, bool, error)
+	// Pending the exports waiting to be made
+	Pending() ([]ExportJob, error)
+	// Expire forget the exports that expired before now
+	Expire(now time.Time) error
+	// DeleteIdentifier forget every export of ident
+	DeleteIdentifier(ident string) error
+}
+
+// newExportStore in the account table when there is one, exports are made by
+// the worker and downloaded from whichever instance gets the request
+func newExportStore() ExportStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryExportStore()
+	}
+
+	return DynamoExportStore{table}
+}
+
+// MemoryExportStore export store that lives as long as the lambda is warm
+type MemoryExportStore struct {
+	sync.Mutex
+	exports map[string]ExportJob
+}
+
+// NewMemoryExportStore ...
+func NewMemoryExportStore() *MemoryExportStore {
+	return &MemoryExportStore{
+		exports: map[string]ExportJob{},
+	}
+}
+
+// Save ...
+func (m *MemoryExportStore) Save(e ExportJob) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.exports[e.ID] = e
+	return nil
+}
+
+// Token ...
+func (m *MemoryExportStore) Token(hash string) (ExportJob, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, e := range m.exports {
+		if e.TokenHash != "" && e.TokenHash == hash {
+			return e, true, nil
+		}
+	}
+
+	return ExportJob{}, false, nil
+}
+
+// Pending ...
+func (m *MemoryExportStore) Pending() ([]ExportJob, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	pending := []ExportJob{}
+	for _, e := range m.exports {
+		if e.Status == ExportPending {
+			pending = append(pending, e)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Requested.Before(pending[j].Requested)
+	})
+
+	return pending, nil
+}
+
+// Expire ...
+func (m *MemoryExportStore) Expire(now time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, e := range m.exports {
+		if e.Status != ExportPending && !now.Before(e.Expires) {
+			delete(m.exports, id)
+		}
+	}
+
+	return nil
+}
+
+// DeleteIdentifier ...
+func (m *MemoryExportStore) DeleteIdentifier(ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, e := range m.exports {
+		if e.Identifier == ident {
+			delete(m.exports, id)
+		}
+	}
+
+	return nil
+}
+
+// ExportSource data held about an account somewhere else, such as profiles,
+// vehicles or audit history, each source is a section of the export
+type ExportSource interface {
+	Name() string
+	Export(ctx context.Context, ident string) (interface{}, error)
+}
+
+// ExportManifest what is in the archive, with a checksum of each file
+type ExportManifest struct {
+	Identifier string               `json:"identifier"`
+	Created    time.Time            `json:"created"`
+	Files      []ExportManifestFile `json:"files"`
+}
+
+// ExportManifestFile ...
+type ExportManifestFile struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ExportHandler ...
+func ExportHandler(body string) (string, error) {
+	return ExportHandlerContext(context.Background(), body)
+}
+
+// ExportHandlerContext ExportHandler bounded by ctx
+func ExportHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().ExportHandler(ctx, body)
+}
+
+// ExportHandler ...
+func (s Service) ExportHandler(ctx context.Context, body string) (string, error) {
+	r := ExportRequest{}
+	return s.mfaHandler("export", body, &r, func() (interface{}, error) {
+		return s.Export(ctx, r)
+	})
+}
+
+// Export ...
+func Export(r ExportRequest) (ExportObject, error) {
+	return ExportContext(context.Background(), r)
+}
+
+// ExportContext Export bounded by ctx
+func ExportContext(ctx context.Context, r ExportRequest) (ExportObject, error) {
+	return NewService().Export(ctx, r)
+}
+
+// Export queue an export of the caller's data, ProcessExports makes it and the
+// download token is sent to the account's email
+func (s Service) Export(ctx context.Context, r ExportRequest) (ExportObject, error) {
+	ident, _, err := s.reauthenticate(ctx, r.Email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return ExportObject{}, err
+	}
+
+	id, err := generateToken()
+	if err != nil {
+		return ExportObject{}, fmt.Errorf("export id: %w", err)
+	}
+
+	e := ExportJob{
+		ID:         id,
+		Identifier: ident,
+		Email:      s.Emails.Normalise(r.Email),
+		Status:     ExportPending,
+		Requested:  s.now(),
+	}
+	err = s.Exports.Save(e)
+	if err != nil {
+		return ExportObject{}, fmt.Errorf("export save: %w", err)
+	}
+	s.Logger.Info("export requested", Fields{"identifier": ident, "id": id})
+
+	return ExportObject{
+		ID:         id,
+		Identifier: ident,
+		Status:     ExportPending,
+	}, nil
+}
+
+// ProcessExports ...
+func ProcessExports() (int, error) {
+	return ProcessExportsContext(context.Background())
+}
+
+// ProcessExportsContext ProcessExports bounded by ctx
+func ProcessExportsContext(ctx context.Context) (int, error) {
+	return NewService().ProcessExports(ctx)
+}
+
+// ProcessExports make every pending export and forget the expired ones, for
+// running on a schedule, one that fails is tried again next time until it has
+// had ExportAttempts
+func (s Service) ProcessExports(ctx context.Context) (int, error) {
+	err := s.Exports.Expire(s.now())
+	if err != nil {
+		return 0, fmt.Errorf("exports expire: %w", err)
+	}
+
+	pending, err := s.Exports.Pending()
+	if err != nil {
+		return 0, fmt.Errorf("exports pending: %w", err)
+	}
+
+	made := 0
+	var last error
+	for _, e := range pending {
+		err = s.makeExport(ctx, e)
+		if err != nil {
+			s.Logger.Error("export failed", Fields{"err": err, "identifier": e.Identifier, "id": e.ID})
+			last = err
+			continue
+		}
+		made++
+	}
+
+	return made, last
+}
+
+func (s Service) makeExport(ctx context.Context, e ExportJob) error {
+	now := s.now()
+	doc, archive, err := s.exportArchive(ctx, e.Identifier, e.Email, now)
+	if err != nil {
+		e.Attempts++
+		if e.Attempts >= ExportAttempts {
+			e.Status = ExportFailed
+			e.Expires = now
+		}
+		if serr := s.Exports.Save(e); serr != nil {
+			s.Logger.Error("export save", Fields{"err": serr})
+		}
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("export token: %w", err)
+	}
+	e.Status = ExportReady
+	e.TokenHash = hashToken(token)
+	e.Expires = now.Add(ExportTTL)
+	e.Document = doc
+	e.Archive = archive
+	err = s.Exports.Save(e)
+	if err != nil {
+		return fmt.Errorf("export save: %w", err)
+	}
+
+	err = s.Notifier.Notify(Notification{
+		Type:  NotificationExport,
+		Email: e.Email,
+		Token: token,
+	})
+	if err != nil {
+		return fmt.Errorf("export notify: %w", err)
+	}
+
+	return nil
+}
+
+// exportSections everything held about ident, by section name
+func (s Service) exportSections(ctx context.Context, ident, email string) (map[string]interface{}, error) {
+	current := permissions.Permissions{}
+	err := s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		var err error
+		current, err = s.PermissionsClient.Retrieve(ctx, ident)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve permissions: %w", err)
+	}
+	perms := current.Permissions
+	if perms == nil || current.Status != "" {
+		perms = []permissions.Permission{}
+	}
+
+	mfa, enabled, err := s.MFAs.Get(ident)
+	if err != nil {
+		return nil, fmt.Errorf("mfa get: %w", err)
+	}
+	deletion, deleting, err := s.Deletions.Get(ident)
+	if err != nil {
+		return nil, fmt.Errorf("deletion get: %w", err)
+	}
+
+	// secrets and hashes aren't the account holder's data, only what they mean
+	account := map[string]interface{}{
+		"identifier": ident,
+		"email":      email,
+		"mfa": map[string]interface{}{
+			"enabled":        enabled && mfa.Enabled,
+			"recovery_codes": len(mfa.Recovery),
+		},
+	}
+	if deleting {
+		account["deletion_due"] = deletion.Due
+	}
+
+	sections := map[string]interface{}{
+		"account":     account,
+		"permissions": perms,
+	}
+	for _, src := range s.ExportSources {
+		data, err := src.Export(ctx, ident)
+		if err != nil {
+			return nil, fmt.Errorf("can't export %s: %w", src.Name(), err)
+		}
+		sections[src.Name()] = data
+	}
+
+	return sections, nil
+}
+
+// exportArchive the export as one json document, and as a zip of a file per
+// section and a manifest of them
+func (s Service) exportArchive(ctx context.Context, ident, email string, now time.Time) ([]byte, []byte, error) {
+	sections, err := s.exportSections(ctx, ident, email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doc, err := json.MarshalIndent(map[string]interface{}{
+		"identifier": ident,
+		"created":    now,
+		"sections":   sections,
+	}, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("export marshal: %w", err)
+	}
+
+	names := []string{}
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+	manifest := ExportManifest{
+		Identifier: ident,
+		Created:    now,
+		Files:      []ExportManifestFile{},
+	}
+	add := func(name string, b []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	for _, name := range names {
+		b, err := json.MarshalIndent(sections[name], "", "  ")
+		if err != nil {
+			return nil, nil, fmt.Errorf("export marshal %s: %w", name, err)
+		}
+		file := name + ".json"
+		sum := sha256.Sum256(b)
+		manifest.Files = append(manifest.Files, ExportManifestFile{
+			Name:   file,
+			Size:   len(b),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+		err = add(file, b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("export zip: %w", err)
+		}
+	}
+
+	mb, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("export marshal manifest: %w", err)
+	}
+	err = add("manifest.json", mb)
+	if err != nil {
+		return nil, nil, fmt.Errorf("export zip: %w", err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("export zip: %w", err)
+	}
+
+	return doc, buf.Bytes(), nil
+}
+
+// ExportDownloadResponse the archive as a binary response, or the error
+func (s Service) ExportDownloadResponse(ctx context.Context, request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	r := ExportDownload{}
+	err := json.Unmarshal([]byte(request.Body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall export download", Fields{"err": err})
+		return s.errorResponse(request, fmt.Errorf("can't unmarshall export download: %w", WithKind(ErrValidation, err)))
+	}
+
+	body, contentType, err := s.ExportDownload(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't download export", Fields{"err": err})
+		return s.errorResponse(request, fmt.Errorf("can't download export: %w", err))
+	}
+
+	if contentType == "application/json" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Headers:    jsonHeaders(),
+			Body:       string(body),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":        contentType,
+			"Content-Disposition": `attachment; filename="export.zip"`,
+		},
+		Body:            base64.StdEncoding.EncodeToString(body),
+		IsBase64Encoded: true,
+	}
+}
+
+// ExportDownload the export the token was sent for and its content type, the
+// token can be used as often as needed until it expires
+func (s Service) ExportDownload(ctx context.Context, r ExportDownload) ([]byte, string, error) {
+	if r.Token == "" {
+		return nil, "", WithKind(ErrValidation, fmt.Errorf("missing token"))
+	}
+
+	e, ok, err := s.Exports.Token(hashToken(r.Token))
+	if err != nil {
+		return nil, "", fmt.Errorf("export token: %w", err)
+	}
+	if !ok || e.Status != ExportReady || !s.now().Before(e.Expires) {
+		return nil, "", WithKind(ErrUnauthorized, fmt.Errorf("invalid or expired token"))
+	}
+
+	switch r.Format {
+	case "", ExportZip:
+		return e.Archive, "application/zip", nil
+	case ExportJSON:
+		return e.Document, "application/json", nil
+	}
+
+	return nil, "", WithKind(ErrValidation, fmt.Errorf("unknown format: %s", r.Format))
+}
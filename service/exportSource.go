@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// HTTPExportSource a service that holds data about accounts, it is sent the
+// identifier and responds with its section of the export, a 404 means it
+// holds nothing
+type HTTPExportSource struct {
+	SourceName string
+	Address    string
+	Auth       string
+	Client     *http.Client
+}
+
+// Name ...
+func (h HTTPExportSource) Name() string {
+	return h.SourceName
+}
+
+// Export ...
+func (h HTTPExportSource) Export(ctx context.Context, ident string) (interface{}, error) {
+	data := json.RawMessage{}
+	status, err := doJSON(ctx, h.Client, "POST", h.Address, h.Auth, map[string]string{
+		"identifier": ident,
+	}, &data)
+	if err != nil {
+		return nil, fmt.Errorf("export %s %w", h.SourceName, err)
+	}
+	if status == http.StatusNotFound {
+		return map[string]interface{}{}, nil
+	}
+	if status != http.StatusOK {
+		return nil, WithKind(ErrUpstream, fmt.Errorf("export %s came back with different statuscode: %v", h.SourceName, status))
+	}
+	if len(data) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	return data, nil
+}
+
+type exportSourceConfig struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Auth    string `json:"auth"`
+}
+
+// NewExportSources the sources in EXPORT_SOURCES, a json list of
+// {"name", "address", "auth"}, the name is the section of the export
+func NewExportSources() ([]ExportSource, error) {
+	sources := []ExportSource{}
+	env := os.Getenv("EXPORT_SOURCES")
+	if env == "" {
+		return sources, nil
+	}
+
+	cfgs := []exportSourceConfig{}
+	err := json.Unmarshal([]byte(env), &cfgs)
+	if err != nil {
+		return nil, fmt.Errorf("EXPORT_SOURCES: %w", err)
+	}
+
+	// account and permissions are the account's own sections
+	seen := map[string]bool{
+		"account":     true,
+		"permissions": true,
+	}
+	for _, c := range cfgs {
+		if c.Name == "" || c.Address == "" {
+			return nil, fmt.Errorf("EXPORT_SOURCES: a source needs a name and address")
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("EXPORT_SOURCES: %s is used twice", c.Name)
+		}
+		seen[c.Name] = true
+
+		sources = append(sources, HTTPExportSource{
+			SourceName: c.Name,
+			Address:    c.Address,
+			Auth:       c.Auth,
+			Client:     NewHTTPClient(time.Second * 30),
+		})
+	}
+
+	return sources, nil
+}
+
+func exportSources() []ExportSource {
+	sources, err := NewExportSources()
+	if err != nil {
+		DefaultLogger.Error("can't load export sources", Fields{"err": err})
+	}
+
+	return sources
+}
@@ -0,0 +1,250 @@
+package service_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// vehicleSource stands in for data another service holds
+type vehicleSource struct {
+	err error
+}
+
+func (v *vehicleSource) Name() string {
+	return "vehicles"
+}
+
+func (v *vehicleSource) Export(ctx context.Context, ident string) (interface{}, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+
+	return []map[string]string{{"registration": "CA19 RKS"}}, nil
+}
+
+func exportService(t *testing.T) (service.Service, *time.Time, *captureNotifier, *vehicleSource, string) {
+	s, now, _, _, ident := deleteService(t, 0)
+	notifier := &captureNotifier{}
+	vehicles := &vehicleSource{}
+	s.Notifier = notifier
+	s.Exports = service.NewMemoryExportStore()
+	s.ExportSources = []service.ExportSource{vehicles}
+
+	return s, now, notifier, vehicles, ident
+}
+
+func TestExport(t *testing.T) {
+	s, now, notifier, _, ident := exportService(t)
+
+	_, err := s.Export(context.Background(), service.ExportRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "wrong",
+	})
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+
+	resp, err := s.Export(context.Background(), service.ExportRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, service.ExportPending, resp.Status)
+	assert.Equal(t, ident, resp.Identifier)
+	assert.Len(t, notifier.sent, 0)
+
+	// the schedule makes it
+	sum, err := s.Work(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, service.WorkSummary{Exported: 1}, sum)
+	sent := notifier.last()
+	assert.Equal(t, service.NotificationExport, sent.Type)
+	assert.Equal(t, "tester@carpark.ninja", sent.Email)
+
+	// already made
+	made, err := s.ProcessExports(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, made)
+
+	doc, contentType, err := s.ExportDownload(context.Background(), service.ExportDownload{
+		Token:  sent.Token,
+		Format: service.ExportJSON,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", contentType)
+	exported := struct {
+		Identifier string `json:"identifier"`
+		Sections   struct {
+			Account struct {
+				Email string `json:"email"`
+			} `json:"account"`
+			Permissions []map[string]string `json:"permissions"`
+			Vehicles    []map[string]string `json:"vehicles"`
+		} `json:"sections"`
+	}{}
+	assert.Nil(t, json.Unmarshal(doc, &exported))
+	assert.Equal(t, ident, exported.Identifier)
+	assert.Equal(t, "tester@carpark.ninja", exported.Sections.Account.Email)
+	assert.Len(t, exported.Sections.Permissions, len(testsRegister[0].expect.Permissions))
+	assert.Equal(t, "CA19 RKS", exported.Sections.Vehicles[0]["registration"])
+
+	archive, contentType, err := s.ExportDownload(context.Background(), service.ExportDownload{
+		Token: sent.Token,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "application/zip", contentType)
+	checkExportArchive(t, archive, []string{"account.json", "permissions.json", "vehicles.json"})
+
+	*now = now.Add(service.ExportTTL)
+	_, _, err = s.ExportDownload(context.Background(), service.ExportDownload{
+		Token: sent.Token,
+	})
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+}
+
+// checkExportArchive the manifest lists the files with the right checksums
+func checkExportArchive(t *testing.T, archive []byte, files []string) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	contents := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.Nil(t, err)
+		b, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		_ = rc.Close()
+		contents[f.Name] = b
+	}
+
+	manifest := service.ExportManifest{}
+	assert.Nil(t, json.Unmarshal(contents["manifest.json"], &manifest))
+	names := []string{}
+	for _, f := range manifest.Files {
+		names = append(names, f.Name)
+		sum := sha256.Sum256(contents[f.Name])
+		assert.Equal(t, hex.EncodeToString(sum[:]), f.SHA256, f.Name)
+		assert.Equal(t, len(contents[f.Name]), f.Size, f.Name)
+	}
+	assert.Equal(t, files, names)
+}
+
+func TestExportRetries(t *testing.T) {
+	s, _, notifier, vehicles, _ := exportService(t)
+	vehicles.err = fmt.Errorf("vehicles unavailable")
+
+	_, err := s.Export(context.Background(), service.ExportRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	for i := 0; i < service.ExportAttempts; i++ {
+		made, err := s.ProcessExports(context.Background())
+		assert.EqualError(t, err, "can't export vehicles: vehicles unavailable")
+		assert.Equal(t, 0, made)
+	}
+
+	// given up on, so nothing is left to try
+	vehicles.err = nil
+	made, err := s.ProcessExports(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, made)
+	assert.Len(t, notifier.sent, 0)
+}
+
+func TestExportSources(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "vehicles-auth", r.Header.Get("X-Authorization"))
+		body := map[string]string{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		switch body["identifier"] {
+		case "ident":
+			_, _ = w.Write([]byte(`[{"registration":"CA19 RKS"}]`))
+		case "unknown":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	_ = os.Setenv("EXPORT_SOURCES", `[{"name":"vehicles","address":"`+upstream.URL+`","auth":"vehicles-auth"}]`)
+	defer os.Unsetenv("EXPORT_SOURCES")
+	sources, err := service.NewExportSources()
+	assert.Nil(t, err)
+	assert.Len(t, sources, 1)
+	assert.Equal(t, "vehicles", sources[0].Name())
+
+	data, err := sources[0].Export(context.Background(), "ident")
+	assert.Nil(t, err)
+	b, err := json.Marshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"registration":"CA19 RKS"}]`, string(b))
+	data, err = sources[0].Export(context.Background(), "unknown")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{}, data)
+	_, err = sources[0].Export(context.Background(), "broken")
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+
+	for _, env := range []string{
+		`{"name":"vehicles"}`,
+		`[{"name":"vehicles"}]`,
+		`[{"name":"permissions","address":"http://permissions"}]`,
+		`[{"name":"vehicles","address":"http://a"},{"name":"vehicles","address":"http://b"}]`,
+	} {
+		_ = os.Setenv("EXPORT_SOURCES", env)
+		_, err = service.NewExportSources()
+		assert.NotNil(t, err, env)
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	s, _, notifier, _, _ := exportService(t)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/export",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Body, `"status":"pending"`)
+
+	_, err = s.ProcessExports(context.Background())
+	assert.Nil(t, err)
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/export/download",
+		Body:     fmt.Sprintf(`{"token":%q}`, notifier.last().Token),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/zip", response.Headers["Content-Type"])
+	assert.True(t, response.IsBase64Encoded)
+	archive, err := base64.StdEncoding.DecodeString(response.Body)
+	assert.Nil(t, err)
+	checkExportArchive(t, archive, []string{"account.json", "permissions.json", "vehicles.json"})
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/export/download",
+		Body:     `{"token":"guessed"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
@@ -0,0 +1,339 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	permissions "github.com/carprks/permissions/service"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// scriptedFailure what the fake responds with instead of the real behaviour
+type scriptedFailure struct {
+	status int
+	body   string
+	delay  time.Duration
+}
+
+// fakeUpstream an httptest server that can be scripted to fail
+type fakeUpstream struct {
+	*httptest.Server
+	sync.Mutex
+
+	auth     string
+	failures map[string][]scriptedFailure
+	calls    map[string]int
+	routes   map[string]func(body []byte) (interface{}, error)
+}
+
+func newFakeUpstream(auth string) *fakeUpstream {
+	f := &fakeUpstream{
+		auth:     auth,
+		failures: map[string][]scriptedFailure{},
+		calls:    map[string]int{},
+		routes:   map[string]func(body []byte) (interface{}, error){},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+
+	return f
+}
+
+// Fail the next request to path responds with status
+func (f *fakeUpstream) Fail(path string, status int) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.failures[path] = append(f.failures[path], scriptedFailure{
+		status: status,
+	})
+}
+
+// Down every attempt of the next call to path responds with status
+func (f *fakeUpstream) Down(path string, status int) {
+	for i := 0; i < service.RetryAttempts; i++ {
+		f.Fail(path, status)
+	}
+}
+
+// FailWith the next request to path responds with a 200 and body
+func (f *fakeUpstream) FailWith(path, body string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.failures[path] = append(f.failures[path], scriptedFailure{
+		status: http.StatusOK,
+		body:   body,
+	})
+}
+
+// Stall the next request to path waits for delay, or until the caller gives
+// up, before carrying on as normal
+func (f *fakeUpstream) Stall(path string, delay time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.failures[path] = append(f.failures[path], scriptedFailure{
+		delay: delay,
+	})
+}
+
+// Calls how many requests path has had
+func (f *fakeUpstream) Calls(path string) int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.calls[path]
+}
+
+// Reset forget scripted failures and call counts
+func (f *fakeUpstream) Reset() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.failures = map[string][]scriptedFailure{}
+	f.calls = map[string]int{}
+}
+
+func (f *fakeUpstream) nextFailure(path string) (scriptedFailure, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls[path]++
+	if len(f.failures[path]) == 0 {
+		return scriptedFailure{}, false
+	}
+
+	sf := f.failures[path][0]
+	f.failures[path] = f.failures[path][1:]
+	return sf, true
+}
+
+func (f *fakeUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Authorization") != f.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if sf, ok := f.nextFailure(r.URL.Path); ok && sf.delay != 0 {
+		// the server only notices the caller going away once the body is read
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		select {
+		case <-time.After(sf.delay):
+		case <-r.Context().Done():
+			return
+		}
+	} else if ok {
+		w.WriteHeader(sf.status)
+		_, _ = w.Write([]byte(sf.body))
+		return
+	}
+
+	route, ok := f.routes[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the lambdas return an error to api gateway which becomes a 502
+	resp, err := route(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(`{"message": "Internal server error"}`))
+		return
+	}
+
+	j, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(j)
+}
+
+// fakeLogin the login service
+type fakeLogin struct {
+	*fakeUpstream
+
+	store sync.Map
+}
+
+func newFakeLogin(auth string) *fakeLogin {
+	f := &fakeLogin{
+		fakeUpstream: newFakeUpstream(auth),
+	}
+	f.routes["/register"] = f.register
+	f.routes["/login"] = f.login
+	f.routes["/delete"] = f.delete
+
+	return f
+}
+
+// Exists whether there is a login for the identifier
+func (f *fakeLogin) Exists(ident string) bool {
+	_, ok := f.store.Load(ident)
+	return ok
+}
+
+func (f *fakeLogin) register(body []byte) (interface{}, error) {
+	r := login.RegisterRequest{}
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		return login.Register{
+			Error: err.Error(),
+		}, nil
+	}
+
+	if r.Password != r.Verify {
+		return login.Register{
+			Error: "passwords don't match",
+		}, nil
+	}
+	if r.Email == "" {
+		return login.Register{
+			Error: "missing email address",
+		}, nil
+	}
+
+	ident := login.GenerateIdent(r.Email)
+	if _, loaded := f.store.LoadOrStore(ident, r.Password); loaded {
+		return login.Register{
+			Error: "ErrCodeConditionalCheckFailedException: ConditionalCheckFailedException: The conditional request failed",
+		}, nil
+	}
+
+	return login.Register{
+		Identifier: ident,
+		Email:      r.Email,
+	}, nil
+}
+
+func (f *fakeLogin) login(body []byte) (interface{}, error) {
+	r := login.LoginRequest{}
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		return login.Login{
+			Error: err.Error(),
+		}, nil
+	}
+
+	ident := login.GenerateIdent(r.Email)
+	password, ok := f.store.Load(ident)
+	if !ok {
+		return login.Login{
+			Error: "no identity",
+		}, nil
+	}
+	if password.(string) != r.Password {
+		return login.Login{
+			Error: "invalid password",
+		}, nil
+	}
+
+	return login.Login{
+		Identifier: ident,
+	}, nil
+}
+
+func (f *fakeLogin) delete(body []byte) (interface{}, error) {
+	d := login.Delete{}
+	err := json.Unmarshal(body, &d)
+	if err != nil {
+		return login.Delete{
+			Error: err.Error(),
+		}, nil
+	}
+
+	f.store.Delete(d.Identifier)
+	d.Status = "Deleted"
+
+	return d, nil
+}
+
+// fakePermissions the permissions service
+type fakePermissions struct {
+	*fakeUpstream
+
+	memory *memoryPermissions
+}
+
+func newFakePermissions(auth string) *fakePermissions {
+	f := &fakePermissions{
+		fakeUpstream: newFakeUpstream(auth),
+		memory:       newMemoryPermissions(),
+	}
+	f.routes["/create"] = f.create
+	f.routes["/retrieve"] = f.retrieve
+	f.routes["/allowed"] = f.allowed
+	f.routes["/delete"] = f.delete
+
+	return f
+}
+
+// Exists whether there are permissions for the identifier
+func (f *fakePermissions) Exists(ident string) bool {
+	p, _ := f.memory.Retrieve(context.Background(), ident)
+	return p.Status == ""
+}
+
+func (f *fakePermissions) create(body []byte) (interface{}, error) {
+	p := permissions.Permissions{}
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Permissions) == 0 {
+		return nil, fmt.Errorf("need at least 1 permission")
+	}
+
+	return f.memory.Create(context.Background(), p)
+}
+
+func (f *fakePermissions) retrieve(body []byte) (interface{}, error) {
+	p := permissions.Permissions{}
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.memory.Retrieve(context.Background(), p.Identifier)
+}
+
+func (f *fakePermissions) allowed(body []byte) (interface{}, error) {
+	p := permissions.Permissions{}
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.memory.Allowed(context.Background(), p)
+}
+
+func (f *fakePermissions) delete(body []byte) (interface{}, error) {
+	p := permissions.Permissions{}
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	f.memory.Lock()
+	delete(f.memory.perms, p.Identifier)
+	f.memory.Unlock()
+
+	return permissions.Permissions{}, nil
+}
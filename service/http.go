@@ -0,0 +1,81 @@
+package service
+
+import (
+	"expvar"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/keloran/go-healthcheck"
+	"github.com/keloran/go-probe"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// Router the same resources as Handler served over plain http, with probe
+// and healthcheck for running outside of api gateway
+func (s Service) Router() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(middleware.Recoverer)
+
+	r.Get("/probe", probe.HTTP)
+	r.Get("/healthcheck", healthcheck.HTTP)
+	r.Get("/metrics", expvar.Handler().ServeHTTP)
+	r.Get("/.well-known/jwks.json", s.serveHTTP)
+
+	// Handler decides which resources exist
+	r.Post("/*", s.serveHTTP)
+	r.Delete("/*", s.serveHTTP)
+
+	return r
+}
+
+// serveHTTP turn the request into what api gateway would send Handler
+func (s Service) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.Logger.Error("can't read body", Fields{"err": err})
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	headers := map[string]string{}
+	for k := range r.Header {
+		headers[k] = r.Header.Get(k)
+	}
+
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+
+	resp, err := s.Handler(r.Context(), events.APIGatewayProxyRequest{
+		Resource:   r.URL.Path,
+		Path:       r.URL.Path,
+		HTTPMethod: r.Method,
+		Headers:    headers,
+		Body:       string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID: middleware.GetReqID(r.Context()),
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP: sourceIP,
+			},
+		},
+	})
+	if err != nil {
+		s.Logger.Error("handler err", Fields{"err": err})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = w.Write([]byte(resp.Body))
+	if err != nil {
+		s.Logger.Error("write response", Fields{"err": err})
+	}
+}
@@ -0,0 +1,88 @@
+package service_test
+
+import (
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	s := service.NewService()
+	s.Verifications = service.NewMemoryVerificationStore()
+	srv := httptest.NewServer(s.Router())
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		expect string
+	}{
+		{
+			name:   "probe",
+			method: "GET",
+			path:   "/probe",
+			status: http.StatusOK,
+			expect: `{"status":"pass"}`,
+		},
+		{
+			name:   "register",
+			method: "POST",
+			path:   "/register",
+			body:   testsService[0].request.Body,
+			status: http.StatusOK,
+			expect: testsService[0].expect.Body,
+		},
+		{
+			name:   "login",
+			method: "POST",
+			path:   "/login",
+			body:   testsService[2].request.Body,
+			status: http.StatusOK,
+			expect: testsService[2].expect.Body,
+		},
+		{
+			name:   "allowed",
+			method: "POST",
+			path:   "/allowed",
+			body:   testsService[5].request.Body,
+			status: http.StatusOK,
+			expect: testsService[5].expect.Body,
+		},
+		{
+			name:   "unknown",
+			method: "POST",
+			path:   "/unknown",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+			assert.Nil(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			assert.Equal(t, test.status, resp.StatusCode)
+			if test.expect != "" {
+				assert.Equal(t, test.expect, withoutTokens(string(body)))
+			}
+			if test.path != "/probe" {
+				assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+
+	deleteAccount("5f46cf19-5399-55e3-aa62-0e7c19382250")
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// IdentityStore the login service keys a login by the email it was made with,
+// an account that has changed email keeps its identifier so this says which
+// login key an account is under now, accounts that never changed aren't in it
+type IdentityStore interface {
+	// Account the account a login key belongs to
+	Account(ident string) (string, bool, error)
+	// Login the login key an account is under
+	Login(account string) (string, bool, error)
+	// Move the account from one login key to another
+	Move(account, from, to string) error
+	// Forget the account, when it is deleted
+	Forget(account string) error
+}
+
+// newIdentityStore in the account table, without one there is nowhere durable
+// to keep moved accounts so emails can't be changed
+func newIdentityStore() IdentityStore {
+	table, ok := accountTable()
+	if !ok {
+		return nil
+	}
+
+	return DynamoIdentityStore{table}
+}
+
+// MemoryIdentityStore identity store that lives as long as the lambda is warm,
+// in production it needs a store that outlives it
+type MemoryIdentityStore struct {
+	sync.Mutex
+	accounts map[string]string
+	logins   map[string]string
+}
+
+// NewMemoryIdentityStore ...
+func NewMemoryIdentityStore() *MemoryIdentityStore {
+	return &MemoryIdentityStore{
+		accounts: map[string]string{},
+		logins:   map[string]string{},
+	}
+}
+
+// Account ...
+func (m *MemoryIdentityStore) Account(ident string) (string, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[ident]
+	return a, ok, nil
+}
+
+// Login ...
+func (m *MemoryIdentityStore) Login(account string) (string, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	l, ok := m.logins[account]
+	return l, ok, nil
+}
+
+// Move back to the key the account was made under needs no entry
+func (m *MemoryIdentityStore) Move(account, from, to string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.accounts, from)
+	if to == account {
+		delete(m.logins, account)
+		return nil
+	}
+	m.accounts[to] = account
+	m.logins[account] = to
+
+	return nil
+}
+
+// Forget ...
+func (m *MemoryIdentityStore) Forget(account string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.accounts, m.logins[account])
+	delete(m.logins, account)
+	return nil
+}
+
+// accountIdentifier the account a login key belongs to, the key itself unless
+// the account has changed email
+func (s Service) accountIdentifier(ident string) (string, error) {
+	if s.Identities == nil {
+		return ident, nil
+	}
+	account, ok, err := s.Identities.Account(ident)
+	if err != nil {
+		return "", fmt.Errorf("identity account: %w", err)
+	}
+	if !ok {
+		return ident, nil
+	}
+
+	return account, nil
+}
+
+// loginKey the key the login service has the account's login under
+func (s Service) loginKey(account string) (string, error) {
+	if s.Identities == nil {
+		return account, nil
+	}
+	ident, ok, err := s.Identities.Login(account)
+	if err != nil {
+		return "", fmt.Errorf("identity login: %w", err)
+	}
+	if !ok {
+		return account, nil
+	}
+
+	return ident, nil
+}
+
+// identifierTaken an account that has moved to another email still owns the
+// identifier its first email gives, so nobody else can register with that email
+func (s Service) identifierTaken(ident string) error {
+	if s.Identities == nil {
+		return nil
+	}
+	_, moved, err := s.Identities.Login(ident)
+	if err != nil {
+		return fmt.Errorf("identity login: %w", err)
+	}
+	if moved {
+		return WithKind(ErrConflict, fmt.Errorf("login already exists"))
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LockoutThreshold failures for an email before it is locked out
+	LockoutThreshold = 10
+	// LockoutIPThreshold failures from a source ip before it is locked out
+	LockoutIPThreshold = 100
+	// LockoutDelayAfter failures for an email before each attempt has to wait
+	LockoutDelayAfter = 3
+	// LockoutIPDelayAfter failures from a source ip before each attempt has to
+	// wait, higher as many people can share an address
+	LockoutIPDelayAfter = 30
+	// LockoutDelay the first wait, it doubles with every failure after that
+	LockoutDelay = time.Second
+	// LockoutMaxDelay the longest wait before the lockout
+	LockoutMaxDelay = time.Minute
+	// LockoutWindow how long failures are remembered, and so how long a lockout lasts
+	LockoutWindow = time.Minute * 15
+)
+
+// ErrLoginFailed the same for a wrong password and an unknown email
+var ErrLoginFailed = WithKind(ErrUnauthorized, fmt.Errorf("invalid email or password"))
+
+// throttledError when the attempt can be made again, it reads the same
+// whether the email has an account or not
+type throttledError struct {
+	wait time.Duration
+}
+
+// Error ...
+func (e throttledError) Error() string {
+	return "too many attempts, try again later"
+}
+
+// Is ...
+func (e throttledError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// RetryAfter ...
+func (e throttledError) RetryAfter() time.Duration {
+	return e.wait
+}
+
+// Lockout how failed logins are slowed down and then refused, a zero Lockout
+// doesn't limit anything
+type Lockout struct {
+	Threshold    int
+	IPThreshold  int
+	DelayAfter   int
+	IPDelayAfter int
+	Delay        time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+// NewLockout the default lockout, LOCKOUT_THRESHOLD and LOCKOUT_IP_THRESHOLD change the thresholds
+func NewLockout() Lockout {
+	return Lockout{
+		Threshold:    envInt("LOCKOUT_THRESHOLD", LockoutThreshold),
+		IPThreshold:  envInt("LOCKOUT_IP_THRESHOLD", LockoutIPThreshold),
+		DelayAfter:   LockoutDelayAfter,
+		IPDelayAfter: LockoutIPDelayAfter,
+		Delay:        LockoutDelay,
+		MaxDelay:     LockoutMaxDelay,
+		Window:       LockoutWindow,
+	}
+}
+
+func envInt(key string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || i <= 0 {
+		return def
+	}
+
+	return i
+}
+
+// attemptLimit when a counter starts delaying and when it locks out
+type attemptLimit struct {
+	delayAfter int
+	threshold  int
+}
+
+// wait how long until the next attempt is allowed after a.Failures
+func (l Lockout) wait(a Attempts, limit attemptLimit, now time.Time) time.Duration {
+	if l.Window == 0 || a.Failures == 0 || now.Sub(a.Last) >= l.Window {
+		return 0
+	}
+
+	until := a.Last
+	switch {
+	case limit.threshold > 0 && a.Failures >= limit.threshold:
+		until = a.Last.Add(l.Window)
+	case limit.delayAfter > 0 && a.Failures >= limit.delayAfter:
+		delay := time.Duration(float64(l.Delay) * math.Pow(2, float64(a.Failures-limit.delayAfter)))
+		if l.MaxDelay > 0 && (delay > l.MaxDelay || delay <= 0) {
+			delay = l.MaxDelay
+		}
+		until = a.Last.Add(delay)
+	}
+
+	return until.Sub(now)
+}
+
+// Attempts failed logins counted against a key
+type Attempts struct {
+	Failures int
+	Last     time.Time
+}
+
+// AttemptStore where failure counters are kept between requests
+type AttemptStore interface {
+	Get(key string) (Attempts, error)
+	// Fail count a failure, failures older than window are forgotten first
+	Fail(key string, now time.Time, window time.Duration) (Attempts, error)
+	Clear(key string) error
+}
+
+// newAttemptStore the store table when ACCOUNT_TABLE is set, otherwise each
+// warm lambda counts on its own
+func newAttemptStore() AttemptStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryAttemptStore()
+	}
+
+	return DynamoAttemptStore{table}
+}
+
+// MemoryAttemptStore attempt store that lives as long as the lambda is warm,
+// so each warm lambda counts on its own
+type MemoryAttemptStore struct {
+	sync.Mutex
+	attempts map[string]Attempts
+}
+
+// NewMemoryAttemptStore ...
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		attempts: map[string]Attempts{},
+	}
+}
+
+// Get ...
+func (m *MemoryAttemptStore) Get(key string) (Attempts, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.attempts[key], nil
+}
+
+// Fail ...
+func (m *MemoryAttemptStore) Fail(key string, now time.Time, window time.Duration) (Attempts, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a := m.attempts[key]
+	if now.Sub(a.Last) >= window {
+		a = Attempts{}
+	}
+	a.Failures++
+	a.Last = now
+	m.attempts[key] = a
+
+	// forget anything that has run out so the map doesn't keep growing
+	for k, old := range m.attempts {
+		if now.Sub(old.Last) >= window {
+			delete(m.attempts, k)
+		}
+	}
+
+	return a, nil
+}
+
+// Clear ...
+func (m *MemoryAttemptStore) Clear(key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.attempts, key)
+
+	return nil
+}
+
+// Reset forget every counter
+func (m *MemoryAttemptStore) Reset() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.attempts = map[string]Attempts{}
+}
+
+type sourceIPKey struct{}
+
+// WithSourceIP ctx carrying the address the request came from
+func WithSourceIP(ctx context.Context, ip string) context.Context {
+	if ip == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, sourceIPKey{}, ip)
+}
+
+// SourceIP the address the request came from, if known
+func SourceIP(ctx context.Context) string {
+	ip, _ := ctx.Value(sourceIPKey{}).(string)
+	return ip
+}
+
+func emailAttemptKey(email string) string {
+	return "email#" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip#" + ip
+}
+
+// attemptKeys the counters a login for email from ctx is checked against
+func (s Service) attemptKeys(ctx context.Context, email string) map[string]attemptLimit {
+	keys := map[string]attemptLimit{
+		emailAttemptKey(email): {
+			delayAfter: s.Lockout.DelayAfter,
+			threshold:  s.Lockout.Threshold,
+		},
+	}
+	if ip := SourceIP(ctx); ip != "" {
+		keys[ipAttemptKey(ip)] = attemptLimit{
+			delayAfter: s.Lockout.IPDelayAfter,
+			threshold:  s.Lockout.IPThreshold,
+		}
+	}
+
+	return keys
+}
+
+// throttled refuse the login while any of its counters says to wait, the
+// upstream isn't asked so the answer is the same for unknown emails
+func (s Service) throttled(ctx context.Context, email string) error {
+	if s.Attempts == nil {
+		return nil
+	}
+
+	wait := time.Duration(0)
+	for key, limit := range s.attemptKeys(ctx, email) {
+		a, err := s.Attempts.Get(key)
+		if err != nil {
+			return fmt.Errorf("attempts get: %w", err)
+		}
+		if w := s.Lockout.wait(a, limit, s.now()); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return throttledError{wait: wait}
+	}
+
+	return nil
+}
+
+// failed count a failed login against every counter
+func (s Service) failed(ctx context.Context, email string) {
+	if s.Attempts == nil || s.Lockout.Window == 0 {
+		return
+	}
+
+	for key, limit := range s.attemptKeys(ctx, email) {
+		a, err := s.Attempts.Fail(key, s.now(), s.Lockout.Window)
+		if err != nil {
+			s.Logger.Error("attempts fail", Fields{"err": err})
+			continue
+		}
+		if limit.threshold > 0 && a.Failures == limit.threshold {
+			s.Logger.Warn("login locked out", Fields{"counter": strings.SplitN(key, "#", 2)[0]})
+		}
+	}
+}
+
+// unlock forget the failures for email, after a login or a password reset
+func (s Service) unlock(email string) {
+	if s.Attempts == nil {
+		return
+	}
+
+	err := s.Attempts.Clear(emailAttemptKey(email))
+	if err != nil {
+		s.Logger.Error("attempts clear", Fields{"err": err})
+	}
+}
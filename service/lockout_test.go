@@ -0,0 +1,143 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// lockoutService a session service with its own attempt counters
+func lockoutService(t *testing.T) (service.Service, *time.Time) {
+	s, now := sessionService(t)
+	s.Attempts = service.NewMemoryAttemptStore()
+	s.Lockout = service.NewLockout()
+
+	return s, now
+}
+
+func loginAttempt(s service.Service, ip, email, password string) events.APIGatewayProxyResponse {
+	response, _ := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/login",
+		Body:     `{"email":"` + email + `","password":"` + password + `"}`,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP: ip,
+			},
+		},
+	})
+
+	return response
+}
+
+func TestLockout(t *testing.T) {
+	s, now := lockoutService(t)
+
+	// an email with an account and one without go through exactly the same
+	for _, email := range []string{"tester@carpark.ninja", "nobody@carpark.ninja"} {
+		t.Run(email, func(t *testing.T) {
+			for i := 0; i < service.LockoutDelayAfter; i++ {
+				response := loginAttempt(s, "10.0.0.1", email, "failure")
+				assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+				assert.Equal(t, `{"error":{"code":"unauthorized","message":"can't get login: invalid email or password","request_id":""}}`, response.Body)
+			}
+
+			// the delay doubles with every failure
+			response := loginAttempt(s, "10.0.0.1", email, "Carpark-Ninja-2019")
+			assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+			assert.Equal(t, "1", response.Headers["Retry-After"])
+			assert.Equal(t, `{"error":{"code":"too_many_attempts","message":"can't get login: too many attempts, try again later","request_id":""}}`, response.Body)
+
+			*now = now.Add(service.LockoutDelay)
+			response = loginAttempt(s, "10.0.0.1", email, "failure")
+			assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+			response = loginAttempt(s, "10.0.0.1", email, "failure")
+			assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+			assert.Equal(t, "2", response.Headers["Retry-After"])
+
+			for i := service.LockoutDelayAfter + 1; i < service.LockoutThreshold; i++ {
+				*now = now.Add(service.LockoutMaxDelay)
+				response = loginAttempt(s, "10.0.0.1", email, "failure")
+				assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+			}
+
+			// locked, even the right password is refused until the window passes
+			*now = now.Add(service.LockoutMaxDelay)
+			response = loginAttempt(s, "10.0.0.1", email, "Carpark-Ninja-2019")
+			assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+
+			*now = now.Add(service.LockoutWindow)
+		})
+	}
+
+	response := loginAttempt(s, "10.0.0.1", "tester@carpark.ninja", "Carpark-Ninja-2019")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	lo := sessionLogin(t, s)
+	deleteAccount(lo.Identifier)
+}
+
+func TestLockoutSourceIP(t *testing.T) {
+	s, _ := lockoutService(t)
+	s.Lockout.IPThreshold = 5
+	s.Lockout.IPDelayAfter = 5
+
+	// a different email each time still adds up for the address
+	for i := 0; i < s.Lockout.IPThreshold; i++ {
+		response := loginAttempt(s, "10.0.0.2", string(rune('a'+i))+"@carpark.ninja", "failure")
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	}
+
+	response := loginAttempt(s, "10.0.0.2", "tester@carpark.ninja", "Carpark-Ninja-2019")
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+
+	// other addresses aren't affected
+	response = loginAttempt(s, "10.0.0.3", "tester@carpark.ninja", "Carpark-Ninja-2019")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	lo := sessionLogin(t, s)
+	deleteAccount(lo.Identifier)
+}
+
+func TestLockoutReset(t *testing.T) {
+	s, now := lockoutService(t)
+	notifier := &captureNotifier{}
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	for i := 0; i < service.LockoutThreshold; i++ {
+		*now = now.Add(service.LockoutMaxDelay)
+		_, err := s.Login(context.Background(), login.LoginRequest{
+			Email:    "tester@carpark.ninja",
+			Password: "failure",
+		})
+		assert.Equal(t, service.ErrLoginFailed, err)
+	}
+	_, err := s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.True(t, errors.Is(err, service.ErrTooManyAttempts))
+
+	// a password reset proves who they are so it unlocks the email
+	_, err = s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	lo := sessionLogin(t, s)
+	assert.NotEmpty(t, lo.AccessToken)
+
+	deleteAccount(lo.Identifier)
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level how important a log line is
+type Level int
+
+// Levels, lines below the loggers level are dropped
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	}
+
+	return "error"
+}
+
+// ParseLevel level from its name, anything unknown is info
+func ParseLevel(name string) Level {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug
+	case "warn":
+		return LevelWarn
+	case "error":
+		return LevelError
+	}
+
+	return LevelInfo
+}
+
+// Fields extra context for a log line
+type Fields map[string]interface{}
+
+// Redacted what secrets are replaced with
+const Redacted = "[REDACTED]"
+
+// redactKeys fields that are never written, matched case insensitively
+var redactKeys = []string{
+	"password",
+	"verify",
+	"token",
+	"access_token",
+	"refresh_token",
+	"otp",
+	"recovery",
+	"recovery_code",
+	"recovery_codes",
+	"challenge",
+	"x-authorization",
+	"secret",
+	"crypt",
+}
+
+// redactJSON catches secrets in strings that hold json, even broken json
+var redactJSON = regexp.MustCompile(`(?i)("(?:password|verify|token|access_token|refresh_token|otp|recovery|recovery_code|recovery_codes|challenge|x-authorization|secret|crypt)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// Logger json lines logger that redacts secrets
+type Logger struct {
+	sync.Mutex
+	Out   io.Writer
+	Level Level
+}
+
+// NewLogger ...
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{
+		Out:   out,
+		Level: level,
+	}
+}
+
+// DefaultLogger writes to stdout so it ends up in cloudwatch, LOG_LEVEL sets the level
+var DefaultLogger = NewLogger(os.Stdout, ParseLevel(os.Getenv("LOG_LEVEL")))
+
+// Debug ...
+func (l *Logger) Debug(msg string, fields Fields) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info ...
+func (l *Logger) Info(msg string, fields Fields) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn ...
+func (l *Logger) Warn(msg string, fields Fields) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error ...
+func (l *Logger) Error(msg string, fields Fields) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields Fields) {
+	if l == nil {
+		l = DefaultLogger
+	}
+	if level < l.Level {
+		return
+	}
+
+	line := map[string]interface{}{}
+	for k, v := range fields {
+		line[k] = redact(k, v)
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = redactString(msg)
+
+	j, err := json.Marshal(line)
+	if err != nil {
+		j = []byte(fmt.Sprintf(`{"level":"error","msg":"can't marshall log line: %s"}`, err))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	_, _ = l.Out.Write(append(j, '\n'))
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range redactKeys {
+		if key == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redact the value of a field, structs are walked through their json form
+func redact(key string, v interface{}) interface{} {
+	if isSecretKey(key) {
+		return Redacted
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return redactString(t.Error())
+	case string:
+		return redactString(t)
+	case fmt.Stringer:
+		return redactString(t.String())
+	case bool, int, int64, float64, time.Duration:
+		return t
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		return redactString(fmt.Sprintf("%v", v))
+	}
+	var generic interface{}
+	err = json.Unmarshal(j, &generic)
+	if err != nil {
+		return Redacted
+	}
+
+	return redactValue(generic)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, iv := range t {
+			if isSecretKey(k) {
+				t[k] = Redacted
+				continue
+			}
+			t[k] = redactValue(iv)
+		}
+		return t
+	case []interface{}:
+		for i, iv := range t {
+			t[i] = redactValue(iv)
+		}
+		return t
+	case string:
+		return redactString(t)
+	}
+
+	return v
+}
+
+func redactString(s string) string {
+	return redactJSON.ReplaceAllString(s, fmt.Sprintf(`${1}"%s"`, Redacted))
+}
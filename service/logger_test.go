@@ -0,0 +1,202 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields service.Fields
+		expect map[string]interface{}
+	}{
+		{
+			name: "struct",
+			fields: service.Fields{
+				"request": login.RegisterRequest{
+					Email:    "tester@carpark.ninja",
+					Password: "hunter2",
+					Verify:   "hunter2",
+				},
+			},
+			expect: map[string]interface{}{
+				"request": map[string]interface{}{
+					"email":    "tester@carpark.ninja",
+					"password": service.Redacted,
+					"verify":   service.Redacted,
+					"crypt":    service.Redacted,
+				},
+			},
+		},
+		{
+			name: "headers",
+			fields: service.Fields{
+				"headers": map[string]string{
+					"X-Authorization": "hunter2",
+					"Content-Type":    "application/json",
+				},
+			},
+			expect: map[string]interface{}{
+				"headers": map[string]interface{}{
+					"X-Authorization": service.Redacted,
+					"Content-Type":    "application/json",
+				},
+			},
+		},
+		{
+			name: "secret key",
+			fields: service.Fields{
+				"token": "hunter2",
+			},
+			expect: map[string]interface{}{
+				"token": service.Redacted,
+			},
+		},
+		{
+			name: "json string",
+			fields: service.Fields{
+				"err": fmt.Errorf(`bad body: {"email":"tester@carpark.ninja","password":"hunter2"}`),
+			},
+			expect: map[string]interface{}{
+				"err": `bad body: {"email":"tester@carpark.ninja","password":"[REDACTED]"}`,
+			},
+		},
+		{
+			name: "broken json string",
+			fields: service.Fields{
+				"body": `{"email":"tester@carpark.ninja","Password":"hunter2`,
+			},
+			expect: map[string]interface{}{
+				"body": `{"email":"tester@carpark.ninja","Password":"[REDACTED]"`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			l := service.NewLogger(buf, service.LevelDebug)
+			l.Error("redact", test.fields)
+
+			line := map[string]interface{}{}
+			err := json.Unmarshal(buf.Bytes(), &line)
+			assert.Nil(t, err)
+			assert.NotContains(t, buf.String(), "hunter2")
+			for k, v := range test.expect {
+				assert.Equal(t, v, line[k])
+			}
+			assert.Equal(t, "error", line["level"])
+			assert.Equal(t, "redact", line["msg"])
+		})
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := service.NewLogger(buf, service.ParseLevel("warn"))
+
+	l.Debug("debug", nil)
+	l.Info("info", nil)
+	assert.Empty(t, buf.String())
+
+	l.Warn("warn", nil)
+	l.Error("error", nil)
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+}
+
+// TestLoggerNoSecrets runs every flow that handles secrets and fails if any
+// of them end up in the logs
+func TestLoggerNoSecrets(t *testing.T) {
+	buf := &bytes.Buffer{}
+	notifier := &captureNotifier{}
+	s := service.NewService()
+	s.Logger = service.NewLogger(buf, service.LevelDebug)
+	s.Notifier = service.LogNotifier{
+		Logger: s.Logger,
+	}
+	s.Resets = service.NewMemoryResetStore()
+	s.Verifications = service.NewMemoryVerificationStore()
+
+	password := "Secr3t-Passw0rd!"
+	newPassword := "N3w-Secr3t-Passw0rd!"
+	requests := []events.APIGatewayProxyRequest{
+		{
+			Resource: "/register",
+			Body:     fmt.Sprintf(`{"email":"tester@carpark.ninja","password":"%s","verify":"%s"}`, password, password),
+		},
+		{
+			Resource: "/register",
+			Body:     fmt.Sprintf(`{"email":"tester@carpark.ninja","password":"%s","verify":"%s"}`, password, password),
+		},
+		{
+			Resource: "/register",
+			Body:     fmt.Sprintf(`{"email":"tester@carpark.ninja","password":"%s","verify":`, password),
+		},
+		{
+			Resource: "/login",
+			Body:     fmt.Sprintf(`{"email":"tester@carpark.ninja","password":"%s"}`, newPassword),
+		},
+		{
+			Resource: "/login",
+			Body:     fmt.Sprintf(`{"email":"tester@carpark.ninja","password":"%s`, password),
+		},
+		{
+			Resource: "/reset",
+			Body:     `{"email":"tester@carpark.ninja"}`,
+		},
+	}
+	for _, request := range requests {
+		_, err := s.Handler(context.Background(), request)
+		assert.Nil(t, err)
+	}
+
+	// the tokens have to come from somewhere other than the logs
+	s.Notifier = notifier
+	_, err := s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+	resetToken := notifier.last().Token
+	s.Notifier = service.LogNotifier{
+		Logger: s.Logger,
+	}
+
+	requests = []events.APIGatewayProxyRequest{
+		{
+			Resource: "/reset/confirm",
+			Body:     fmt.Sprintf(`{"token":"%s","password":"%s","verify":"%s-"}`, resetToken, newPassword, newPassword),
+		},
+		{
+			Resource: "/reset/confirm",
+			Body:     fmt.Sprintf(`{"token":"%s-","password":"%s","verify":"%s"}`, resetToken, newPassword, newPassword),
+		},
+		{
+			Resource: "/verify",
+			Body:     fmt.Sprintf(`{"token":"%s"}`, resetToken),
+		},
+	}
+	for _, request := range requests {
+		_, err := s.Handler(context.Background(), request)
+		assert.Nil(t, err)
+	}
+
+	assert.NotEmpty(t, buf.String())
+	for _, line := range strings.Split(buf.String(), "\n") {
+		for _, secret := range []string{password, newPassword, resetToken, "login-auth", "permissions-auth"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("log line contains a secret: %s", line)
+			}
+		}
+	}
+
+	deleteAccount(login.GenerateIdent("tester@carpark.ninja"))
+}
@@ -1,41 +1,58 @@
 package service
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	login "github.com/carprks/login/service"
 	permissions "github.com/carprks/permissions/service"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"time"
 )
 
 // LoginObject ...
 type LoginObject struct {
 	Identifier  string                   `json:"identifier"`
 	Permissions []permissions.Permission `json:"permissions"`
+	Unverified  bool                     `json:"unverified,omitempty"`
+	Tokens
+
+	// Challenge set instead of the permissions and tokens when mfa is enabled
+	Challenge *MFAChallenge `json:"-"`
 }
 
 // LoginHandler ...
 func LoginHandler(body string) (string, error) {
+	return LoginHandlerContext(context.Background(), body)
+}
+
+// LoginHandlerContext LoginHandler bounded by ctx
+func LoginHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().LoginHandler(ctx, body)
+}
+
+// LoginHandler ...
+func (s Service) LoginHandler(ctx context.Context, body string) (string, error) {
 	r := login.LoginRequest{}
 	err := json.Unmarshal([]byte(body), &r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't unmarshall login: %v, %v", err, body))
-		return "", fmt.Errorf("can't unmarshall login: %w", err)
+		s.Logger.Error("can't unmarshall login", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall login: %w", WithKind(ErrValidation, err))
 	}
 
-	rf, err := Login(r)
+	rf, err := s.Login(ctx, r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't get login: %v, %v", err, r))
+		s.Logger.Error("can't get login", Fields{"err": err, "request": r})
 		return "", fmt.Errorf("can't get login: %w", err)
 	}
 
-	rfb, err := json.Marshal(rf)
+	var out interface{} = rf
+	if rf.Challenge != nil {
+		out = rf.Challenge
+	}
+
+	rfb, err := json.Marshal(out)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't marshall login: %v, %v", err, rf))
+		s.Logger.Error("can't marshall login", Fields{"err": err, "response": rf})
 		return "", fmt.Errorf("can't marshall login: %w", err)
 	}
 
@@ -44,131 +61,201 @@ func LoginHandler(body string) (string, error) {
 
 // Login ...
 func Login(l login.LoginRequest) (LoginObject, error) {
-	lo, err := LoginUser(l)
+	return LoginContext(context.Background(), l)
+}
+
+// LoginContext Login bounded by ctx
+func LoginContext(ctx context.Context, l login.LoginRequest) (LoginObject, error) {
+	return NewService().Login(ctx, l)
+}
+
+// Login check the credentials, failures slow down and then lock out further
+// attempts for the email and the source ip, until a password reset or the
+// failures are forgotten
+func (s Service) Login(ctx context.Context, l login.LoginRequest) (LoginObject, error) {
+	email := s.Emails.Normalise(l.Email)
+	err := s.throttled(ctx, email)
+	if err != nil {
+		s.Logger.Info("login throttled", Fields{"err": err})
+		return LoginObject{}, err
+	}
+
+	lo, err := s.LoginUser(ctx, l)
+	if errors.Is(err, ErrUnauthorized) {
+		// wrong password and unknown email look the same from outside
+		s.Logger.Info("login failed", Fields{"err": err})
+		s.failed(ctx, email)
+		return LoginObject{}, ErrLoginFailed
+	}
+	if err != nil {
+		s.Logger.Error("can't get login for user", Fields{"err": err, "email": email})
+		return LoginObject{}, fmt.Errorf("can't get login for user: %w", err)
+	}
+
+	_, err = s.verified(lo.Identifier)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't get login for user: %v, %v", err, l))
 		return LoginObject{}, fmt.Errorf("can't get login for user: %w", err)
 	}
 
-	resp, err := LoginPermissions(lo)
+	enabled, err := s.mfaEnabled(lo.Identifier)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't get permissions for user: %v, %v", err, lo))
+		return LoginObject{}, fmt.Errorf("can't get login for user: %w", err)
+	}
+	if enabled {
+		// the failures stay until the second step passes too
+		ch, err := s.challenge(lo.Identifier, email)
+		if err != nil {
+			s.Logger.Error("can't challenge login", Fields{"err": err})
+			return LoginObject{}, fmt.Errorf("can't challenge login: %w", err)
+		}
+		return LoginObject{
+			Identifier: lo.Identifier,
+			Challenge:  &ch,
+		}, nil
+	}
+	s.unlock(email)
+
+	return s.completeLogin(ctx, lo)
+}
+
+// completeLogin the permissions and tokens for a login that has passed every step
+func (s Service) completeLogin(ctx context.Context, lo login.Login) (LoginObject, error) {
+	_, pending, err := s.Deletions.Get(lo.Identifier)
+	if err != nil {
+		s.Logger.Error("can't get deletion", Fields{"err": err})
+		return LoginObject{}, fmt.Errorf("can't get login for user: %w", err)
+	}
+	if pending {
+		return LoginObject{}, ErrDeletionPending
+	}
+
+	verified, err := s.verified(lo.Identifier)
+	if err != nil {
+		return LoginObject{}, fmt.Errorf("can't get login for user: %w", err)
+	}
+
+	resp, err := s.LoginPermissions(ctx, lo)
+	if err != nil {
+		s.Logger.Error("can't get permissions for user", Fields{"err": err, "login": lo})
 		return LoginObject{}, fmt.Errorf("can't get permissions for user: %w", err)
 	}
 
+	tokens, err := s.issueTokens(ctx, lo.Identifier, resp, !verified)
+	if err != nil {
+		s.Logger.Error("can't issue tokens", Fields{"err": err})
+		return LoginObject{}, fmt.Errorf("can't issue tokens: %w", err)
+	}
+
 	return LoginObject{
 		Identifier:  lo.Identifier,
 		Permissions: resp,
+		Unverified:  !verified,
+		Tokens:      tokens,
 	}, nil
 }
 
 // LoginUser ...
 func LoginUser(l login.LoginRequest) (login.Login, error) {
-	lr := login.Login{}
+	return LoginUserContext(context.Background(), l)
+}
 
-	j, err := json.Marshal(&l)
-	if err != nil {
-		fmt.Println(fmt.Sprintf("can't unmarshall login: %v, %v", err, l))
-		return lr, fmt.Errorf("an't unmarshall login: %w", err)
-	}
+// LoginUserContext LoginUser bounded by ctx
+func LoginUserContext(ctx context.Context, l login.LoginRequest) (login.Login, error) {
+	return NewService().LoginUser(ctx, l)
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/login", os.Getenv("SERVICE_LOGIN")), bytes.NewBuffer(j))
-	if err != nil {
-		fmt.Println(fmt.Sprintf("req err: %v", err))
-		return lr, fmt.Errorf("login user req err: %w", err)
-	}
+// LoginUser ...
+func (s Service) LoginUser(ctx context.Context, l login.LoginRequest) (login.Login, error) {
+	lr, _, err := s.loginAs(ctx, l.Email, l.Password)
+	return lr, err
+}
 
-	req.Header.Set("X-Authorization", os.Getenv("AUTH_LOGIN"))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{
-		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     2 * time.Minute,
-		},
+// loginAs check the password against each form the email's login can be
+// under, and the form it was found under
+func (s Service) loginAs(ctx context.Context, email, password string) (login.Login, string, error) {
+	candidates := s.Emails.Candidates(email)
+	if len(candidates) == 0 {
+		candidates = []string{email}
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(fmt.Sprintf("login client err: %v", err))
-		return lr, fmt.Errorf("login client err: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, err := ioutil.ReadAll(resp.Body)
+
+	lr := login.Login{}
+	var err error
+	for _, c := range candidates {
+		err = s.call(ctx, s.LoginUpstream, true, func(ctx context.Context) error {
+			var err error
+			lr, err = s.LoginClient.Login(ctx, login.LoginRequest{
+				Email:    c,
+				Password: password,
+			})
+			return err
+		})
+		if errors.Is(err, ErrUnauthorized) {
+			continue
+		}
 		if err != nil {
-			fmt.Println(fmt.Sprintf("login resp err: %v", err))
-			return lr, fmt.Errorf("login resp err: %w", err)
+			break
 		}
 
-		err = json.Unmarshal(body, &lr)
+		lr.Identifier, err = s.accountIdentifier(lr.Identifier)
 		if err != nil {
-			fmt.Println(fmt.Sprintf("can't unmarshal login service: %v, %v", err, string(body)))
-			return lr, fmt.Errorf("can't unmarshal login service: %w", err)
+			s.Logger.Error("login user identity err", Fields{"err": err})
+			return lr, "", err
 		}
+		return lr, c, nil
+	}
+	s.Logger.Error("login user err", Fields{"err": err})
+
+	return lr, "", err
+}
 
-		if lr.Error != "" {
-			return lr, fmt.Errorf("login response err: %v", lr.Error)
+// accountFor the account an email has, and the form its login is under,
+// ErrNotFound when none of the forms has one
+func (s Service) accountFor(ctx context.Context, email string) (string, string, error) {
+	for _, c := range s.Emails.Candidates(email) {
+		ident, err := s.accountIdentifier(login.GenerateIdent(c))
+		if err != nil {
+			return "", "", err
+		}
+		_, err = s.LoginPermissions(ctx, login.Login{Identifier: ident})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("can't get permissions: %w", err)
 		}
 
-		return lr, nil
+		return ident, c, nil
 	}
 
-	return lr, fmt.Errorf("login came back with a different statuscode: %v", resp.StatusCode)
+	return "", "", WithKind(ErrNotFound, fmt.Errorf("no account for email"))
 }
 
 // LoginPermissions ...
 func LoginPermissions(l login.Login) ([]permissions.Permission, error) {
-	p := permissions.Permissions{
-		Identifier: l.Identifier,
-	}
-
-	j, err := json.Marshal(&p)
-	if err != nil {
-		return []permissions.Permission{}, err
-	}
+	return LoginPermissionsContext(context.Background(), l)
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/retrieve", os.Getenv("SERVICE_PERMISSIONS")), bytes.NewBuffer(j))
-	if err != nil {
-		fmt.Println(fmt.Sprintf("req err: %v", err))
-		return p.Permissions, fmt.Errorf("permissions req err: %w", err)
-	}
+// LoginPermissionsContext LoginPermissions bounded by ctx
+func LoginPermissionsContext(ctx context.Context, l login.Login) ([]permissions.Permission, error) {
+	return NewService().LoginPermissions(ctx, l)
+}
 
-	req.Header.Set("X-Authorization", os.Getenv("AUTH_PERMISSIONS"))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{
-		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     2 * time.Minute,
-		},
-	}
-	resp, err := client.Do(req)
+// LoginPermissions ...
+func (s Service) LoginPermissions(ctx context.Context, l login.Login) ([]permissions.Permission, error) {
+	p := permissions.Permissions{}
+	err := s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		var err error
+		p, err = s.PermissionsClient.Retrieve(ctx, l.Identifier)
+		return err
+	})
 	if err != nil {
-		fmt.Println(fmt.Sprintf("permissions client err: %v", err))
-		return p.Permissions, fmt.Errorf("permissions client err: %w", err)
+		s.Logger.Error("login permissions err", Fields{"err": err})
+		return p.Permissions, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println(fmt.Sprintf("permissions resp err: %v", err))
-			return p.Permissions, fmt.Errorf("permissions resp err: %w", err)
-		}
-
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			fmt.Println(fmt.Sprintf("can't unmarshall permissions body: %v, %v", err, string(body)))
-			return p.Permissions, fmt.Errorf("can't unmarshall permissions body: %w", err)
-		}
-
-		if p.Status != "" {
-			return p.Permissions, fmt.Errorf("permissions status err: %v", p.Status)
-		}
 
-		return p.Permissions, nil
+	if p.Status != "" {
+		return p.Permissions, WithKind(ErrNotFound, fmt.Errorf("permissions status err: %v", p.Status))
 	}
 
-	return p.Permissions, fmt.Errorf("permissions came back with different statuscode: %v", resp.StatusCode)
+	return p.Permissions, nil
 }
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	login "github.com/carprks/login/service"
+	"net/http"
+	"strings"
+)
+
+// LoginClient talks to the login service
+type LoginClient interface {
+	Register(ctx context.Context, r login.RegisterRequest) (login.Register, error)
+	Login(ctx context.Context, r login.LoginRequest) (login.Login, error)
+	Delete(ctx context.Context, ident string) error
+}
+
+// HTTPLoginClient the login service over http
+type HTTPLoginClient struct {
+	Address string
+	Auth    string
+	Client  *http.Client
+}
+
+// Register create the login
+func (c HTTPLoginClient) Register(ctx context.Context, r login.RegisterRequest) (login.Register, error) {
+	rt := login.Register{}
+
+	status, err := doJSON(ctx, c.Client, "POST", fmt.Sprintf("%s/register", c.Address), c.Auth, r, &rt)
+	if err != nil {
+		return rt, fmt.Errorf("create login %w", err)
+	}
+	if status != http.StatusOK {
+		return rt, WithKind(ErrUpstream, fmt.Errorf("can't create login"))
+	}
+
+	if rt.Error != "" {
+		if strings.Contains(rt.Error, "ErrCodeConditionalCheckFailedException") {
+			return rt, WithKind(ErrConflict, fmt.Errorf("login already exists"))
+		}
+		return rt, WithKind(ErrValidation, fmt.Errorf("unknown login error: %v", rt.Error))
+	}
+
+	return rt, nil
+}
+
+// Login check the credentials
+func (c HTTPLoginClient) Login(ctx context.Context, r login.LoginRequest) (login.Login, error) {
+	lr := login.Login{}
+
+	status, err := doJSON(ctx, c.Client, "POST", fmt.Sprintf("%s/login", c.Address), c.Auth, r, &lr)
+	if err != nil {
+		return lr, fmt.Errorf("login %w", err)
+	}
+	if status != http.StatusOK {
+		return lr, WithKind(ErrUpstream, fmt.Errorf("login came back with a different statuscode: %v", status))
+	}
+
+	if lr.Error != "" {
+		return lr, WithKind(ErrUnauthorized, fmt.Errorf("login response err: %v", lr.Error))
+	}
+
+	return lr, nil
+}
+
+// Delete remove the login
+func (c HTTPLoginClient) Delete(ctx context.Context, ident string) error {
+	dr := login.Delete{}
+
+	status, err := doJSON(ctx, c.Client, "DELETE", fmt.Sprintf("%s/delete", c.Address), c.Auth, login.Delete{
+		Identifier: ident,
+	}, &dr)
+	if err != nil {
+		return fmt.Errorf("delete login %w", err)
+	}
+	if status != http.StatusOK {
+		return WithKind(ErrUpstream, fmt.Errorf("delete login came back with a different statuscode: %v", status))
+	}
+
+	if dr.Error != "" {
+		return WithKind(ErrUpstream, fmt.Errorf("delete login error: %v", dr.Error))
+	}
+
+	return nil
+}
@@ -4,9 +4,8 @@ import (
 	"github.com/carprks/account/service"
 	login "github.com/carprks/login/service"
 	permissions "github.com/carprks/permissions/service"
-	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
-	"os"
+	"net/http"
 	"testing"
 )
 
@@ -20,7 +19,7 @@ var testsLogin = []struct {
 		name: "login: tester@carpark.ninja",
 		request: login.LoginRequest{
 			Email:    "tester@carpark.ninja",
-			Password: "tester",
+			Password: "Carpark-Ninja-2019",
 		},
 		expect: service.LoginObject{
 			Identifier: "5f46cf19-5399-55e3-aa62-0e7c19382250",
@@ -71,33 +70,27 @@ var testsLogin = []struct {
 }
 
 func TestLogin(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	r := login.RegisterRequest{
 		Email:    "tester@carpark.ninja",
-		Password: "tester",
-		Verify:   "tester",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
 	}
 	resp, err := service.Register(r)
 	if err != nil {
-		t.Errorf("login register failed: %w", err)
+		t.Errorf("login register failed: %v", err)
 	}
 
 	for _, test := range testsLogin {
 		t.Run(test.name, func(t *testing.T) {
 			response, err := service.Login(test.request)
+			if err == nil {
+				assert.NotEmpty(t, response.AccessToken)
+				assert.NotEmpty(t, response.RefreshToken)
+			}
+			response.Tokens = service.Tokens{}
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("login test err: %w, request: %v", err, test.request)
+				t.Errorf("login test err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -112,25 +105,14 @@ func TestLogin(t *testing.T) {
 func BenchmarkLogin(b *testing.B) {
 	b.ReportAllocs()
 
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					b.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	r := login.RegisterRequest{
 		Email:    "tester@carpark.ninja",
-		Password: "tester",
-		Verify:   "tester",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
 	}
 	resp, err := service.Register(r)
 	if err != nil {
-		b.Errorf("login register failed: %w", err)
+		b.Errorf("login register failed: %v", err)
 	}
 
 	b.ResetTimer()
@@ -139,9 +121,14 @@ func BenchmarkLogin(b *testing.B) {
 			t.StopTimer()
 
 			response, err := service.Login(test.request)
+			if err == nil {
+				assert.NotEmpty(t, response.AccessToken)
+				assert.NotEmpty(t, response.RefreshToken)
+			}
+			response.Tokens = service.Tokens{}
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("login test err: %w, request: %v", err, test.request)
+				t.Errorf("login test err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -156,27 +143,89 @@ func BenchmarkLogin(b *testing.B) {
 }
 
 func TestLoginUser(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
+	r := login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	}
+	resp, err := service.Register(r)
+	if err != nil {
+		t.Errorf("login register failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		request login.LoginRequest
+		expect  login.Login
+		err     string
+	}{
+		{
+			name: "login user: tester@carpark.ninja",
+			request: login.LoginRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "Carpark-Ninja-2019",
+			},
+			expect: login.Login{
+				Identifier: "5f46cf19-5399-55e3-aa62-0e7c19382250",
+			},
+		},
+		{
+			name: "login user: invalid password",
+			request: login.LoginRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "failure",
+			},
+			expect: login.Login{
+				Error: "invalid password",
+			},
+			err: "login response err: invalid password",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := service.LoginUser(test.request)
+			if test.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
 			}
-		}
+			assert.Equal(t, test.expect, response)
+		})
 	}
+
+	deleteAccount(resp.Identifier)
 }
 
 func TestLoginPermissions(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
+	requireFakes(t)
+
+	r := login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
 	}
+	resp, err := service.Register(r)
+	if err != nil {
+		t.Errorf("login register failed: %v", err)
+	}
+
+	perms, err := service.LoginPermissions(login.Login{
+		Identifier: resp.Identifier,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, testsLogin[0].expect.Permissions, perms)
+
+	permissionsService.Down("/retrieve", http.StatusBadGateway)
+	_, err = service.LoginPermissions(login.Login{
+		Identifier: resp.Identifier,
+	})
+	assert.EqualError(t, err, "permissions came back with different statuscode: 502")
+
+	_, err = service.LoginPermissions(login.Login{
+		Identifier: "failure",
+	})
+	assert.EqualError(t, err, "permissions status err: no permissions")
+
+	deleteAccount(resp.Identifier)
 }
@@ -0,0 +1,675 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	login "github.com/carprks/login/service"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TOTPPeriod how long each code lasts
+	TOTPPeriod = 30
+	// TOTPDigits how long each code is
+	TOTPDigits = 6
+	// TOTPSkew how many periods either side of now a code is accepted for
+	TOTPSkew = 1
+	// TOTPIssuer shown in authenticator apps
+	TOTPIssuer = "carprks"
+
+	// MFAChallengeTTL how long there is to answer a login challenge
+	MFAChallengeTTL = time.Minute * 5
+	// MFAChallengeAttempts wrong codes before a challenge can't be used
+	MFAChallengeAttempts = 5
+	// MFARecoveryCodes how many recovery codes are handed out
+	MFARecoveryCodes = 10
+)
+
+// ErrMFACode the code or recovery code is wrong
+var ErrMFACode = WithKind(ErrUnauthorized, fmt.Errorf("invalid mfa code"))
+
+// ErrMFAChallenge the challenge is unknown, used up or has expired
+var ErrMFAChallenge = WithKind(ErrUnauthorized, fmt.Errorf("invalid or expired mfa challenge"))
+
+// MFA an account's TOTP enrolment, recovery codes are only kept as hashes
+type MFA struct {
+	Identifier string
+	Secret     string
+	Enabled    bool
+	Recovery   []string
+	// LastStep the last period a code was used in, so codes can't be replayed
+	LastStep int64
+}
+
+// PendingLogin a login waiting for its second step, Email is what the
+// password step was throttled on so wrong codes count against it too
+type PendingLogin struct {
+	Hash       string
+	Identifier string
+	Email      string
+	Expires    time.Time
+	Attempts   int
+}
+
+// MFAStore where enrolments and pending logins are kept
+type MFAStore interface {
+	Get(ident string) (MFA, bool, error)
+	Save(m MFA) error
+	Delete(ident string) error
+	SavePending(p PendingLogin) error
+	// TakePending the pending login can only be taken once
+	TakePending(hash string) (PendingLogin, bool, error)
+}
+
+// newMFAStore the store table when ACCOUNT_TABLE is set, otherwise enrolments
+// only last as long as the lambda is warm
+func newMFAStore() MFAStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryMFAStore()
+	}
+
+	return DynamoMFAStore{table}
+}
+
+// MemoryMFAStore mfa store that lives as long as the lambda is warm
+type MemoryMFAStore struct {
+	sync.Mutex
+	mfas    map[string]MFA
+	pending map[string]PendingLogin
+}
+
+// NewMemoryMFAStore ...
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{
+		mfas:    map[string]MFA{},
+		pending: map[string]PendingLogin{},
+	}
+}
+
+// Get ...
+func (m *MemoryMFAStore) Get(ident string) (MFA, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	mfa, ok := m.mfas[ident]
+	return mfa, ok, nil
+}
+
+// Save ...
+func (m *MemoryMFAStore) Save(mfa MFA) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.mfas[mfa.Identifier] = mfa
+	return nil
+}
+
+// Delete ...
+func (m *MemoryMFAStore) Delete(ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.mfas, ident)
+	return nil
+}
+
+// SavePending ...
+func (m *MemoryMFAStore) SavePending(p PendingLogin) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.pending[p.Hash] = p
+	return nil
+}
+
+// TakePending ...
+func (m *MemoryMFAStore) TakePending(hash string) (PendingLogin, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	p, ok := m.pending[hash]
+	delete(m.pending, hash)
+	return p, ok, nil
+}
+
+// totp RFC 6238 code for the period step
+func totp(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, code%mod)
+}
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// checkTOTP the period the code is valid for, it has to be later than last
+func checkTOTP(secret string, code string, now time.Time, last int64) (int64, bool) {
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	step := now.Unix() / TOTPPeriod
+	for i := int64(-TOTPSkew); i <= TOTPSkew; i++ {
+		if step+i <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totp(key, step+i)), []byte(code)) == 1 {
+			return step + i, true
+		}
+	}
+
+	return 0, false
+}
+
+// normaliseRecovery recovery codes are accepted in any case, with or without the dash
+func normaliseRecovery(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+func generateRecovery() (string, error) {
+	b := make([]byte, 5)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32NoPad.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+// MFAEnrolRequest ask to enrol with the access token of the session
+type MFAEnrolRequest struct {
+	AccessToken string `json:"access_token"`
+}
+
+// MFAEnrolment what an authenticator app needs
+type MFAEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// MFAConfirmRequest the first code from the authenticator
+type MFAConfirmRequest struct {
+	AccessToken string `json:"access_token"`
+	OTP         string `json:"otp"`
+}
+
+// MFAConfirmed the recovery codes, they are only ever shown once
+type MFAConfirmed struct {
+	Status        string   `json:"status"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFAChallenge returned by login instead of the tokens when mfa is enabled
+type MFAChallenge struct {
+	Challenge string `json:"challenge"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// MFALoginRequest the second step of a login, either code will do
+type MFALoginRequest struct {
+	Challenge    string `json:"challenge"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFADisableRequest turn mfa off, the caller logs in again to do it and an admin
+// can name someone else's account
+type MFADisableRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+	Identifier   string `json:"identifier"`
+}
+
+// MFAObject ...
+type MFAObject struct {
+	Identifier string `json:"identifier,omitempty"`
+	Status     string `json:"status"`
+}
+
+// mfaHandler unmarshall the body into in, run fn and marshall what it returns
+func (s Service) mfaHandler(name, body string, in interface{}, fn func() (interface{}, error)) (string, error) {
+	err := json.Unmarshal([]byte(body), in)
+	if err != nil {
+		s.Logger.Error("can't unmarshall "+name, Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall %s: %w", name, WithKind(ErrValidation, err))
+	}
+
+	rf, err := fn()
+	if err != nil {
+		s.Logger.Error("can't "+name, Fields{"err": err})
+		return "", fmt.Errorf("can't %s: %w", name, err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall "+name, Fields{"err": err})
+		return "", fmt.Errorf("can't marshall %s: %w", name, err)
+	}
+
+	return string(rfb), nil
+}
+
+// MFAEnrolHandler ...
+func MFAEnrolHandler(body string) (string, error) {
+	return MFAEnrolHandlerContext(context.Background(), body)
+}
+
+// MFAEnrolHandlerContext MFAEnrolHandler bounded by ctx
+func MFAEnrolHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().MFAEnrolHandler(ctx, body)
+}
+
+// MFAEnrolHandler ...
+func (s Service) MFAEnrolHandler(ctx context.Context, body string) (string, error) {
+	r := MFAEnrolRequest{}
+	return s.mfaHandler("enrol mfa", body, &r, func() (interface{}, error) {
+		return s.MFAEnrol(ctx, r)
+	})
+}
+
+// MFAConfirmHandler ...
+func MFAConfirmHandler(body string) (string, error) {
+	return MFAConfirmHandlerContext(context.Background(), body)
+}
+
+// MFAConfirmHandlerContext MFAConfirmHandler bounded by ctx
+func MFAConfirmHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().MFAConfirmHandler(ctx, body)
+}
+
+// MFAConfirmHandler ...
+func (s Service) MFAConfirmHandler(ctx context.Context, body string) (string, error) {
+	r := MFAConfirmRequest{}
+	return s.mfaHandler("confirm mfa", body, &r, func() (interface{}, error) {
+		return s.MFAConfirm(ctx, r)
+	})
+}
+
+// MFALoginHandler ...
+func MFALoginHandler(body string) (string, error) {
+	return MFALoginHandlerContext(context.Background(), body)
+}
+
+// MFALoginHandlerContext MFALoginHandler bounded by ctx
+func MFALoginHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().MFALoginHandler(ctx, body)
+}
+
+// MFALoginHandler ...
+func (s Service) MFALoginHandler(ctx context.Context, body string) (string, error) {
+	r := MFALoginRequest{}
+	return s.mfaHandler("login mfa", body, &r, func() (interface{}, error) {
+		return s.MFALogin(ctx, r)
+	})
+}
+
+// MFADisableHandler ...
+func MFADisableHandler(body string) (string, error) {
+	return MFADisableHandlerContext(context.Background(), body)
+}
+
+// MFADisableHandlerContext MFADisableHandler bounded by ctx
+func MFADisableHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().MFADisableHandler(ctx, body)
+}
+
+// MFADisableHandler ...
+func (s Service) MFADisableHandler(ctx context.Context, body string) (string, error) {
+	r := MFADisableRequest{}
+	return s.mfaHandler("disable mfa", body, &r, func() (interface{}, error) {
+		return s.MFADisable(ctx, r)
+	})
+}
+
+// MFAEnrol start enrolment with a new secret, it isn't used until it's confirmed
+func MFAEnrol(r MFAEnrolRequest) (MFAEnrolment, error) {
+	return MFAEnrolContext(context.Background(), r)
+}
+
+// MFAEnrolContext MFAEnrol bounded by ctx
+func MFAEnrolContext(ctx context.Context, r MFAEnrolRequest) (MFAEnrolment, error) {
+	return NewService().MFAEnrol(ctx, r)
+}
+
+// MFAEnrol start enrolment with a new secret, it isn't used until it's confirmed
+func (s Service) MFAEnrol(ctx context.Context, r MFAEnrolRequest) (MFAEnrolment, error) {
+	claims, err := s.Tokens.Parse(r.AccessToken, s.now())
+	if err != nil {
+		return MFAEnrolment{}, err
+	}
+
+	m, ok, err := s.MFAs.Get(claims.Subject)
+	if err != nil {
+		return MFAEnrolment{}, fmt.Errorf("mfa get: %w", err)
+	}
+	if ok && m.Enabled {
+		return MFAEnrolment{}, WithKind(ErrConflict, fmt.Errorf("mfa already enabled"))
+	}
+
+	key := make([]byte, 20)
+	_, err = rand.Read(key)
+	if err != nil {
+		return MFAEnrolment{}, fmt.Errorf("can't generate secret: %w", err)
+	}
+	secret := base32NoPad.EncodeToString(key)
+
+	err = s.MFAs.Save(MFA{
+		Identifier: claims.Subject,
+		Secret:     secret,
+	})
+	if err != nil {
+		return MFAEnrolment{}, fmt.Errorf("mfa save: %w", err)
+	}
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(TOTPPeriod))
+
+	return MFAEnrolment{
+		Secret: secret,
+		URI:    fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(TOTPIssuer), url.PathEscape(claims.Subject), v.Encode()),
+	}, nil
+}
+
+// MFAConfirm turn mfa on once the authenticator has produced a code
+func MFAConfirm(r MFAConfirmRequest) (MFAConfirmed, error) {
+	return MFAConfirmContext(context.Background(), r)
+}
+
+// MFAConfirmContext MFAConfirm bounded by ctx
+func MFAConfirmContext(ctx context.Context, r MFAConfirmRequest) (MFAConfirmed, error) {
+	return NewService().MFAConfirm(ctx, r)
+}
+
+// MFAConfirm turn mfa on once the authenticator has produced a code
+func (s Service) MFAConfirm(ctx context.Context, r MFAConfirmRequest) (MFAConfirmed, error) {
+	claims, err := s.Tokens.Parse(r.AccessToken, s.now())
+	if err != nil {
+		return MFAConfirmed{}, err
+	}
+
+	m, ok, err := s.MFAs.Get(claims.Subject)
+	if err != nil {
+		return MFAConfirmed{}, fmt.Errorf("mfa get: %w", err)
+	}
+	if !ok {
+		return MFAConfirmed{}, WithKind(ErrValidation, fmt.Errorf("mfa not enrolled"))
+	}
+	if m.Enabled {
+		return MFAConfirmed{}, WithKind(ErrConflict, fmt.Errorf("mfa already enabled"))
+	}
+
+	step, ok := checkTOTP(m.Secret, r.OTP, s.now(), m.LastStep)
+	if !ok {
+		return MFAConfirmed{}, ErrMFACode
+	}
+
+	codes := []string{}
+	m.Recovery = []string{}
+	for i := 0; i < MFARecoveryCodes; i++ {
+		code, err := generateRecovery()
+		if err != nil {
+			return MFAConfirmed{}, fmt.Errorf("can't generate recovery code: %w", err)
+		}
+		codes = append(codes, code)
+		m.Recovery = append(m.Recovery, hashToken(normaliseRecovery(code)))
+	}
+	m.Enabled = true
+	m.LastStep = step
+
+	err = s.MFAs.Save(m)
+	if err != nil {
+		return MFAConfirmed{}, fmt.Errorf("mfa save: %w", err)
+	}
+
+	return MFAConfirmed{
+		Status:        "enabled",
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// mfaEnabled whether the account needs a second step to login
+func (s Service) mfaEnabled(ident string) (bool, error) {
+	m, ok, err := s.MFAs.Get(ident)
+	if err != nil {
+		return false, fmt.Errorf("mfa get: %w", err)
+	}
+
+	return ok && m.Enabled, nil
+}
+
+// challenge start the second step of a login
+func (s Service) challenge(ident, email string) (MFAChallenge, error) {
+	token, err := generateToken()
+	if err != nil {
+		return MFAChallenge{}, fmt.Errorf("can't generate challenge: %w", err)
+	}
+
+	err = s.MFAs.SavePending(PendingLogin{
+		Hash:       hashToken(token),
+		Identifier: ident,
+		Email:      email,
+		Expires:    s.now().Add(MFAChallengeTTL),
+	})
+	if err != nil {
+		return MFAChallenge{}, fmt.Errorf("mfa save pending: %w", err)
+	}
+
+	return MFAChallenge{
+		Challenge: token,
+		ExpiresIn: int64(MFAChallengeTTL / time.Second),
+	}, nil
+}
+
+// checkMFA use a code or a recovery code, a used recovery code is gone
+func (s Service) checkMFA(ident, otp, recovery string) error {
+	m, ok, err := s.MFAs.Get(ident)
+	if err != nil {
+		return fmt.Errorf("mfa get: %w", err)
+	}
+	if !ok || !m.Enabled {
+		return ErrMFACode
+	}
+
+	if otp != "" {
+		step, ok := checkTOTP(m.Secret, otp, s.now(), m.LastStep)
+		if !ok {
+			return ErrMFACode
+		}
+		m.LastStep = step
+		return s.MFAs.Save(m)
+	}
+
+	if recovery != "" {
+		hash := hashToken(normaliseRecovery(recovery))
+		for i, h := range m.Recovery {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				m.Recovery = append(m.Recovery[:i:i], m.Recovery[i+1:]...)
+				return s.MFAs.Save(m)
+			}
+		}
+	}
+
+	return ErrMFACode
+}
+
+// MFALogin finish a login that was challenged
+func MFALogin(r MFALoginRequest) (LoginObject, error) {
+	return MFALoginContext(context.Background(), r)
+}
+
+// MFALoginContext MFALogin bounded by ctx
+func MFALoginContext(ctx context.Context, r MFALoginRequest) (LoginObject, error) {
+	return NewService().MFALogin(ctx, r)
+}
+
+// MFALogin finish a login that was challenged, wrong codes count towards the
+// lockout the same as wrong passwords and the failures are only forgotten
+// once a code is right
+func (s Service) MFALogin(ctx context.Context, r MFALoginRequest) (LoginObject, error) {
+	p, ok, err := s.MFAs.TakePending(hashToken(r.Challenge))
+	if err != nil {
+		return LoginObject{}, fmt.Errorf("mfa take pending: %w", err)
+	}
+	if !ok || !s.now().Before(p.Expires) {
+		return LoginObject{}, ErrMFAChallenge
+	}
+
+	err = s.throttled(ctx, p.Email)
+	if err != nil {
+		s.Logger.Info("mfa login throttled", Fields{"err": err})
+		s.keepPending(p)
+		return LoginObject{}, err
+	}
+
+	err = s.checkMFA(p.Identifier, r.OTP, r.RecoveryCode)
+	if errors.Is(err, ErrMFACode) {
+		s.Logger.Info("mfa login failed", Fields{"err": err})
+		s.failed(ctx, p.Email)
+		// the challenge can be tried again until it runs out of attempts
+		p.Attempts++
+		if p.Attempts < MFAChallengeAttempts {
+			s.keepPending(p)
+		}
+		return LoginObject{}, err
+	}
+	if err != nil {
+		return LoginObject{}, err
+	}
+	s.unlock(p.Email)
+
+	return s.completeLogin(ctx, login.Login{
+		Identifier: p.Identifier,
+	})
+}
+
+// keepPending put a taken challenge back so it can be tried again
+func (s Service) keepPending(p PendingLogin) {
+	err := s.MFAs.SavePending(p)
+	if err != nil {
+		s.Logger.Error("mfa save pending", Fields{"err": err})
+	}
+}
+
+// MFADisable turn mfa off
+func MFADisable(r MFADisableRequest) (MFAObject, error) {
+	return MFADisableContext(context.Background(), r)
+}
+
+// MFADisableContext MFADisable bounded by ctx
+func MFADisableContext(ctx context.Context, r MFADisableRequest) (MFAObject, error) {
+	return NewService().MFADisable(ctx, r)
+}
+
+// MFADisable turn mfa off for the caller, or for someone else when the caller
+// is an admin, the caller's own code is needed whenever they have mfa
+func (s Service) MFADisable(ctx context.Context, r MFADisableRequest) (MFAObject, error) {
+	ident, _, err := s.reauthenticate(ctx, r.Email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return MFAObject{}, err
+	}
+
+	enabled, err := s.mfaEnabled(ident)
+	if err != nil {
+		return MFAObject{}, err
+	}
+
+	target := r.Identifier
+	if target == "" {
+		target = ident
+	}
+	if target != ident {
+		admin, err := s.isAdmin(ctx, login.Login{Identifier: ident}, target)
+		if err != nil {
+			return MFAObject{}, err
+		}
+		if !admin {
+			return MFAObject{}, WithKind(ErrUnauthorized, fmt.Errorf("not allowed to disable mfa for %s", target))
+		}
+		s.Logger.Info("admin disabled mfa", Fields{"admin": ident, "identifier": target})
+	} else if !enabled {
+		return MFAObject{}, WithKind(ErrValidation, fmt.Errorf("mfa not enabled"))
+	}
+
+	err = s.MFAs.Delete(target)
+	if err != nil {
+		return MFAObject{}, fmt.Errorf("mfa delete: %w", err)
+	}
+
+	return MFAObject{
+		Identifier: target,
+		Status:     "disabled",
+	}, nil
+}
+
+// isAdmin whether the login has account admin over target
+func (s Service) isAdmin(ctx context.Context, lo login.Login, target string) (bool, error) {
+	perms, err := s.LoginPermissions(ctx, lo)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range perms {
+		if p.Name == "account" && p.Action == "admin" && (p.Identifier == "*" || p.Identifier == target) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// requireAdmin the request's access token has to belong to an account admin
+// over target, the permissions are read again rather than taken from the token
+// so a revoked admin can't keep using one
+func (s Service) requireAdmin(ctx context.Context, target string) error {
+	token := AccessToken(ctx)
+	if token == "" {
+		return WithKind(ErrUnauthorized, fmt.Errorf("missing access token"))
+	}
+	claims, err := s.Tokens.Parse(token, s.now())
+	if err != nil {
+		return err
+	}
+
+	admin, err := s.isAdmin(ctx, login.Login{Identifier: claims.Subject}, target)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return WithKind(ErrUnauthorized, fmt.Errorf("%s is not an admin for %s", claims.Subject, target))
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package service_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// totpCode what an authenticator app would show for the secret at t
+func totpCode(secret string, t time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(t.Unix()/service.TOTPPeriod))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	assert.Equal(t, "287082", totpCode(secret, time.Unix(59, 0)))
+	assert.Equal(t, "081804", totpCode(secret, time.Unix(1111111109, 0)))
+}
+
+// mfaService a session service with its own mfa store and mfa enabled for the account
+func mfaService(t *testing.T) (service.Service, *time.Time, string, []string) {
+	s, now := sessionService(t)
+	s.MFAs = service.NewMemoryMFAStore()
+	s.Attempts = service.NewMemoryAttemptStore()
+	lo := sessionLogin(t, s)
+
+	enrol, err := s.MFAEnrol(context.Background(), service.MFAEnrolRequest{
+		AccessToken: lo.AccessToken,
+	})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enrol.URI, "otpauth://totp/"))
+	assert.Contains(t, enrol.URI, "secret="+enrol.Secret)
+
+	_, err = s.MFAConfirm(context.Background(), service.MFAConfirmRequest{
+		AccessToken: lo.AccessToken,
+		OTP:         "000000",
+	})
+	assert.Equal(t, service.ErrMFACode, err)
+
+	confirmed, err := s.MFAConfirm(context.Background(), service.MFAConfirmRequest{
+		AccessToken: lo.AccessToken,
+		OTP:         totpCode(enrol.Secret, *now),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "enabled", confirmed.Status)
+	assert.Equal(t, service.MFARecoveryCodes, len(confirmed.RecoveryCodes))
+
+	*now = now.Add(service.TOTPPeriod * time.Second)
+
+	return s, now, enrol.Secret, confirmed.RecoveryCodes
+}
+
+func mfaChallenge(t *testing.T, s service.Service) string {
+	lo := sessionLogin(t, s)
+	assert.Empty(t, lo.AccessToken)
+	assert.NotNil(t, lo.Challenge)
+
+	return lo.Challenge.Challenge
+}
+
+func TestMFALogin(t *testing.T) {
+	s, now, secret, recovery := mfaService(t)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/login",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Body, `"challenge":`)
+	assert.Contains(t, response.Body, `"expires_in":300`)
+	assert.NotContains(t, response.Body, "access_token")
+
+	code := totpCode(secret, *now)
+	lo, err := s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: mfaChallenge(t, s),
+		OTP:       code,
+	})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, lo.AccessToken)
+	assert.NotEmpty(t, lo.RefreshToken)
+
+	// a code can't be used twice
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: mfaChallenge(t, s),
+		OTP:       code,
+	})
+	assert.Equal(t, service.ErrMFACode, err)
+
+	// recovery codes work once, whatever the case
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge:    mfaChallenge(t, s),
+		RecoveryCode: strings.ToUpper(recovery[0]),
+	})
+	assert.Nil(t, err)
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge:    mfaChallenge(t, s),
+		RecoveryCode: recovery[0],
+	})
+	assert.Equal(t, service.ErrMFACode, err)
+
+	// a challenge is single use
+	challenge := mfaChallenge(t, s)
+	*now = now.Add(service.TOTPPeriod * time.Second)
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: challenge,
+		OTP:       totpCode(secret, *now),
+	})
+	assert.Nil(t, err)
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: challenge,
+		OTP:       totpCode(secret, *now),
+	})
+	assert.Equal(t, service.ErrMFAChallenge, err)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestMFAChallengeLimits(t *testing.T) {
+	s, now, secret, _ := mfaService(t)
+
+	// wrong codes burn attempts until the challenge is gone, waiting out the
+	// delay they add each time
+	wait := service.LockoutDelay * (1 << (service.MFAChallengeAttempts - service.LockoutDelayAfter))
+	challenge := mfaChallenge(t, s)
+	for i := 0; i < service.MFAChallengeAttempts; i++ {
+		*now = now.Add(wait)
+		_, err := s.MFALogin(context.Background(), service.MFALoginRequest{
+			Challenge: challenge,
+			OTP:       "000000",
+		})
+		assert.Equal(t, service.ErrMFACode, err)
+	}
+	*now = now.Add(wait)
+	_, err := s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: challenge,
+		OTP:       totpCode(secret, *now),
+	})
+	assert.Equal(t, service.ErrMFAChallenge, err)
+
+	// challenges expire
+	challenge = mfaChallenge(t, s)
+	*now = now.Add(service.MFAChallengeTTL)
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: challenge,
+		OTP:       totpCode(secret, *now),
+	})
+	assert.Equal(t, service.ErrMFAChallenge, err)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/login/mfa",
+		Body:     `{"challenge":"unknown","otp":"000000"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	lo, _ := s.LoginUser(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	deleteAccount(lo.Identifier)
+}
+
+func TestMFALockout(t *testing.T) {
+	s, now, secret, _ := mfaService(t)
+	s.Lockout = service.Lockout{
+		Threshold: 3,
+		Window:    service.LockoutWindow,
+	}
+
+	// the password being right doesn't forget the wrong codes
+	for i := 0; i < 3; i++ {
+		_, err := s.MFALogin(context.Background(), service.MFALoginRequest{
+			Challenge: mfaChallenge(t, s),
+			OTP:       "000000",
+		})
+		assert.Equal(t, service.ErrMFACode, err)
+	}
+	_, err := s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.True(t, errors.Is(err, service.ErrTooManyAttempts))
+
+	// a challenge from before the lockout can't be used to get round it
+	*now = now.Add(service.LockoutWindow)
+	challenge := mfaChallenge(t, s)
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: mfaChallenge(t, s),
+		OTP:       "000000",
+	})
+	assert.Equal(t, service.ErrMFACode, err)
+	s.Lockout.Threshold = 1
+	_, err = s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: challenge,
+		OTP:       totpCode(secret, *now),
+	})
+	assert.True(t, errors.Is(err, service.ErrTooManyAttempts))
+
+	// once the window has passed a right code forgets the failures
+	*now = now.Add(service.LockoutWindow)
+	s.Lockout.Threshold = 3
+	lo, err := s.MFALogin(context.Background(), service.MFALoginRequest{
+		Challenge: mfaChallenge(t, s),
+		OTP:       totpCode(secret, *now),
+	})
+	assert.Nil(t, err)
+	a, err := s.Attempts.Get("email#tester@carpark.ninja")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, a.Failures)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestMFADisable(t *testing.T) {
+	s, now, secret, _ := mfaService(t)
+
+	tests := []struct {
+		name    string
+		request service.MFADisableRequest
+		err     bool
+	}{
+		{
+			name: "wrong password",
+			request: service.MFADisableRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "wrong",
+				OTP:      totpCode(secret, *now),
+			},
+			err: true,
+		},
+		{
+			name: "no code",
+			request: service.MFADisableRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "Carpark-Ninja-2019",
+			},
+			err: true,
+		},
+		{
+			name: "password and code",
+			request: service.MFADisableRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "Carpark-Ninja-2019",
+				OTP:      totpCode(secret, *now),
+			},
+		},
+	}
+
+	ident := ""
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := s.MFADisable(context.Background(), test.request)
+			assert.Equal(t, test.err, err != nil)
+			if err == nil {
+				assert.Equal(t, "disabled", response.Status)
+				ident = response.Identifier
+			}
+		})
+	}
+
+	lo := sessionLogin(t, s)
+	assert.Nil(t, lo.Challenge)
+	assert.NotEmpty(t, lo.AccessToken)
+	assert.Equal(t, ident, lo.Identifier)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestMFADisableAdmin(t *testing.T) {
+	requireFakes(t)
+	s, _, _, _ := mfaService(t)
+	target := sessionLogin(t, s).Challenge
+	assert.NotNil(t, target)
+
+	user, _ := s.LoginUser(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+
+	_, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "admin@carpark.ninja",
+		Password: "Spaced-0ut-Parking",
+		Verify:   "Spaced-0ut-Parking",
+	})
+	assert.Nil(t, err)
+	admin, _ := s.LoginUser(context.Background(), login.LoginRequest{
+		Email:    "admin@carpark.ninja",
+		Password: "Spaced-0ut-Parking",
+	})
+
+	request := service.MFADisableRequest{
+		Email:      "admin@carpark.ninja",
+		Password:   "Spaced-0ut-Parking",
+		Identifier: user.Identifier,
+	}
+
+	// not an admin yet
+	_, err = s.MFADisable(context.Background(), request)
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+
+	permissionsService.memory.Lock()
+	permissionsService.memory.perms[admin.Identifier] = append(permissionsService.memory.perms[admin.Identifier], permissions.Permission{
+		Name:       "account",
+		Action:     "admin",
+		Identifier: "*",
+	})
+	permissionsService.memory.Unlock()
+
+	response, err := s.MFADisable(context.Background(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, service.MFAObject{
+		Identifier: user.Identifier,
+		Status:     "disabled",
+	}, response)
+
+	lo := sessionLogin(t, s)
+	assert.Nil(t, lo.Challenge)
+
+	deleteAccount(user.Identifier)
+	deleteAccount(admin.Identifier)
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Notification something that needs sending to the account holder
+type Notification struct {
+	Type  string `json:"type"`
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+const (
+	// NotificationReset sent when a password reset is requested
+	NotificationReset = "reset"
+	// NotificationVerify sent to verify the email address
+	NotificationVerify = "verify"
+	// NotificationExport sent with the download token once an export is ready
+	NotificationExport = "export"
+	// NotificationEmailChangeOld sent to the current address to confirm an email change
+	NotificationEmailChangeOld = "email_change_old"
+	// NotificationEmailChangeNew sent to the new address to confirm an email change
+	NotificationEmailChangeNew = "email_change_new"
+)
+
+// NotifyTimeout how long the notify service has to take a notification
+const NotifyTimeout = time.Second * 10
+
+// ErrNotifier SERVICE_NOTIFY isn't set
+var ErrNotifier = fmt.Errorf("SERVICE_NOTIFY isn't set")
+
+// Notifier sends notifications to account holders, e.g. by email
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// NewNotifier the notify service in SERVICE_NOTIFY, tokens only reach the
+// account holder through it
+func NewNotifier() (Notifier, error) {
+	address := os.Getenv("SERVICE_NOTIFY")
+	if address == "" {
+		return nil, ErrNotifier
+	}
+
+	return HTTPNotifier{
+		Address: address,
+		Auth:    os.Getenv("AUTH_NOTIFY"),
+		Client:  NewHTTPClient(NotifyTimeout),
+	}, nil
+}
+
+// notify loaded once, main checks NewNotifier before starting so without one
+// notifications are only logged
+var notify = func() Notifier {
+	n, err := NewNotifier()
+	if err != nil {
+		DefaultLogger.Error("can't load notifier", Fields{"err": err})
+		return LogNotifier{Logger: DefaultLogger}
+	}
+
+	return n
+}()
+
+// HTTPNotifier a service that sends the notification on, it is posted the
+// notification as json
+type HTTPNotifier struct {
+	Address string
+	Auth    string
+	Client  *http.Client
+}
+
+// Notify ...
+func (h HTTPNotifier) Notify(n Notification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), NotifyTimeout)
+	defer cancel()
+
+	status, err := doJSON(ctx, h.Client, "POST", h.Address, h.Auth, n, nil)
+	if err != nil {
+		return fmt.Errorf("notify %w", err)
+	}
+	if status != http.StatusOK {
+		return WithKind(ErrUpstream, fmt.Errorf("notify came back with different statuscode: %v", status))
+	}
+
+	return nil
+}
+
+// LogNotifier only records that a notification would have been sent, the
+// token is never logged
+type LogNotifier struct {
+	Logger *Logger
+}
+
+// Notify ...
+func (l LogNotifier) Notify(n Notification) error {
+	l.Logger.Info("notification", Fields{
+		"type":  n.Type,
+		"email": n.Email,
+	})
+	return nil
+}
@@ -0,0 +1,52 @@
+package service_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHTTPNotifier(t *testing.T) {
+	received := []service.Notification{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "notify-auth", r.Header.Get("X-Authorization"))
+		n := service.Notification{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&n))
+		if n.Email == "broken@carpark.ninja" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received = append(received, n)
+	}))
+	defer upstream.Close()
+
+	_ = os.Unsetenv("SERVICE_NOTIFY")
+	_, err := service.NewNotifier()
+	assert.Equal(t, service.ErrNotifier, err)
+
+	_ = os.Setenv("SERVICE_NOTIFY", upstream.URL)
+	_ = os.Setenv("AUTH_NOTIFY", "notify-auth")
+	defer os.Unsetenv("SERVICE_NOTIFY")
+	defer os.Unsetenv("AUTH_NOTIFY")
+	n, err := service.NewNotifier()
+	assert.Nil(t, err)
+
+	sent := service.Notification{
+		Type:  service.NotificationReset,
+		Email: "tester@carpark.ninja",
+		Token: "token",
+	}
+	assert.Nil(t, n.Notify(sent))
+	assert.Equal(t, []service.Notification{sent}, received)
+
+	err = n.Notify(service.Notification{
+		Type:  service.NotificationReset,
+		Email: "broken@carpark.ninja",
+	})
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// PasswordMinLength the shortest password accepted
+	PasswordMinLength = 10
+	// PasswordMaxLength the longest password accepted, longer ones are refused
+	// before anything else looks at them
+	PasswordMaxLength = 128
+	// PasswordMinScore the weakest password accepted, from 0 (too guessable) to 4 (very unguessable)
+	PasswordMinScore = 3
+)
+
+// FieldError what is wrong with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError a request with fields that aren't valid, it is an ErrValidation
+type ValidationError struct {
+	Fields []FieldError
+}
+
+// Error ...
+func (e ValidationError) Error() string {
+	msgs := []string{}
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Message)
+	}
+
+	return strings.Join(msgs, ", ")
+}
+
+// Is ...
+func (e ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// PasswordPolicy what a new password has to meet, a zero PasswordPolicy only
+// checks that the password and verify match
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	MinScore  int
+	// Blocklist rank of each common password, 1 is the most common
+	Blocklist map[string]int
+	// RejectEmail refuse passwords that contain the local part of the email
+	RejectEmail bool
+}
+
+// NewPasswordPolicy the default policy, PASSWORD_MIN_LENGTH and PASSWORD_MIN_SCORE change the limits
+func NewPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:   envInt("PASSWORD_MIN_LENGTH", PasswordMinLength),
+		MaxLength:   PasswordMaxLength,
+		MinScore:    envInt("PASSWORD_MIN_SCORE", PasswordMinScore),
+		Blocklist:   commonPasswordRanks,
+		RejectEmail: true,
+	}
+}
+
+// commonPasswordRanks commonPasswords parsed once
+var commonPasswordRanks = func() map[string]int {
+	ranks := map[string]int{}
+	for _, p := range strings.Split(commonPasswords, "\n") {
+		p = strings.TrimSpace(p)
+		if _, ok := ranks[p]; p != "" && !ok {
+			ranks[p] = len(ranks) + 1
+		}
+	}
+
+	return ranks
+}()
+
+// Check every problem with password, checked before anything is sent upstream
+func (p PasswordPolicy) Check(email, password, verify string) error {
+	if p.MaxLength > 0 && utf8.RuneCountInString(password) > p.MaxLength {
+		return ValidationError{
+			Fields: []FieldError{{
+				Field:   "password",
+				Code:    "too_long",
+				Message: fmt.Sprintf("password must be at most %d characters", p.MaxLength),
+			}},
+		}
+	}
+
+	fields := []FieldError{}
+
+	if password != verify {
+		fields = append(fields, FieldError{
+			Field:   "verify",
+			Code:    "mismatch",
+			Message: "passwords don't match",
+		})
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		fields = append(fields, FieldError{
+			Field:   "password",
+			Code:    "too_short",
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+		})
+	}
+
+	if p.Blocklist != nil {
+		_, common := p.Blocklist[strings.ToLower(password)]
+		_, leet := p.Blocklist[unleet(password)]
+		if common || leet {
+			fields = append(fields, FieldError{
+				Field:   "password",
+				Code:    "common",
+				Message: "password is too common",
+			})
+		}
+	}
+
+	local := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+	if p.RejectEmail && len(local) >= 3 && strings.Contains(unleet(password), unleet(local)) {
+		fields = append(fields, FieldError{
+			Field:   "password",
+			Code:    "contains_email",
+			Message: "password can't contain your email address",
+		})
+	}
+
+	if p.MinScore > 0 && PasswordScore(password, p.Blocklist) < p.MinScore {
+		fields = append(fields, FieldError{
+			Field:   "password",
+			Code:    "too_weak",
+			Message: "password is too easy to guess",
+		})
+	}
+
+	if len(fields) >= 1 {
+		return ValidationError{
+			Fields: fields,
+		}
+	}
+
+	return nil
+}
+
+// unleet lower case with the usual character swaps undone, each character
+// stays a single character so positions line up with the original
+func unleet(s string) string {
+	return strings.NewReplacer(
+		"4", "a", "@", "a",
+		"3", "e",
+		"1", "i", "!", "i",
+		"0", "o",
+		"5", "s", "$", "s",
+		"7", "t",
+	).Replace(strings.ToLower(s))
+}
+
+// keyboard rows and runs that are as easy to guess as a repeated character
+var sequences = []string{
+	"abcdefghijklmnopqrstuvwxyz",
+	"01234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+}
+
+// PasswordScore how hard password is to guess from 0 to 4, the same scale as
+// zxcvbn, common words, repeats and sequences count for little
+func PasswordScore(password string, blocklist map[string]int) int {
+	if password == "" {
+		return 0
+	}
+
+	// the size of the alphabet the password is drawn from
+	lower, upper, digit, symbol := false, false, false, false
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	alphabet := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}} {
+		if c.used {
+			alphabet += c.size
+		}
+	}
+
+	// each character is a guess over the alphabet, unless it is part of a
+	// common word, repeats the one before or carries on a sequence
+	guesses := 0.0
+	plain := []rune(strings.ToLower(password))
+	leet := []rune(unleet(password))
+	longest := longestWord(blocklist)
+	for i := 0; i < len(plain); {
+		word, rank := commonWord(plain[i:], blocklist, longest)
+		if lw, lr := commonWord(leet[i:], blocklist, longest); lw > word {
+			word, rank = lw, lr
+		}
+		if word > 0 {
+			guesses += math.Log10(float64(rank) + 1)
+			i += word
+			continue
+		}
+		if i > 0 && predictable(plain[i-1], plain[i]) {
+			guesses += math.Log10(2)
+			i++
+			continue
+		}
+		guesses += math.Log10(float64(alphabet))
+		i++
+	}
+
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	}
+
+	return 4
+}
+
+// longestWord the length of the longest common password
+func longestWord(blocklist map[string]int) int {
+	longest := 0
+	for w := range blocklist {
+		if l := utf8.RuneCountInString(w); l > longest {
+			longest = l
+		}
+	}
+
+	return longest
+}
+
+// commonWord the length and rank of the longest common password s starts
+// with, nothing longer than longest is looked up
+func commonWord(s []rune, blocklist map[string]int, longest int) (int, int) {
+	l := len(s)
+	if l > longest {
+		l = longest
+	}
+	for ; l >= 4; l-- {
+		if rank, ok := blocklist[string(s[:l])]; ok {
+			return l, rank
+		}
+	}
+
+	return 0, 0
+}
+
+// predictable whether b follows a by repeating it or carrying on a sequence
+func predictable(a, b rune) bool {
+	if a == b {
+		return true
+	}
+
+	for _, seq := range sequences {
+		i := strings.IndexRune(seq, a)
+		if i < 0 {
+			continue
+		}
+		if i+1 < len(seq) && rune(seq[i+1]) == b {
+			return true
+		}
+		if i > 0 && rune(seq[i-1]) == b {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,235 @@
+package service
+
+// commonPasswords the most used passwords, most common first, one per line
+const commonPasswords = `123456
+password
+12345678
+qwerty
+123456789
+12345
+1234
+111111
+1234567
+dragon
+123123
+baseball
+abc123
+football
+monkey
+letmein
+696969
+shadow
+master
+666666
+qwertyuiop
+123321
+mustang
+1234567890
+michael
+654321
+superman
+1qaz2wsx
+7777777
+121212
+000000
+qazwsx
+123qwe
+killer
+trustno1
+jordan
+jennifer
+zxcvbnm
+asdfgh
+hunter
+buster
+soccer
+harley
+batman
+andrew
+tigger
+sunshine
+iloveyou
+2000
+charlie
+robert
+thomas
+hockey
+ranger
+daniel
+starwars
+klaster
+112233
+george
+computer
+michelle
+jessica
+pepper
+1111
+zxcvbn
+555555
+11111111
+131313
+freedom
+777777
+pass
+maggie
+159753
+aaaaaa
+ginger
+princess
+joshua
+cheese
+amanda
+summer
+love
+ashley
+nicole
+chelsea
+biteme
+matthew
+access
+yankees
+987654321
+dallas
+austin
+thunder
+taylor
+matrix
+mobilemail
+mom
+monitor
+monitoring
+montana
+moon
+moscow
+welcome
+welcome1
+password1
+password123
+passw0rd
+p@ssw0rd
+admin
+admin123
+administrator
+root
+toor
+changeme
+secret
+letmein1
+login
+qwerty123
+qwerty1
+1q2w3e4r
+1q2w3e4r5t
+q1w2e3r4
+zaq12wsx
+asdf
+asdfghjkl
+asdf1234
+abcdef
+abcd1234
+abc12345
+1qazxsw2
+samsung
+google
+apple
+orange
+banana
+flower
+hello
+hello123
+whatever
+nothing
+football1
+baseball1
+iloveyou1
+princess1
+sunshine1
+starwars1
+dragon1
+master1
+monkey1
+shadow1
+superman1
+batman1
+trustno11
+liverpool
+arsenal
+chelsea1
+manchester
+london
+england
+scotland
+carpark
+parking
+car
+cars
+ninja
+test
+test123
+testing
+tester
+guest
+user
+demo
+default
+temp
+temporary
+qwertyui
+azerty
+solo
+loveme
+lovely
+666666666
+888888
+99999999
+00000000
+123654
+147258369
+987654
+11223344
+121212121
+fuckyou
+fuckoff
+jesus
+god
+angel
+angels
+bailey
+buddy
+cookie
+cooper
+daisy
+dakota
+diamond
+ferrari
+porsche
+mercedes
+corvette
+midnight
+mickey
+minnie
+pokemon
+pikachu
+naruto
+blink182
+metallica
+nirvana
+slipknot
+winter
+spring
+autumn
+january
+february
+march
+april
+june
+july
+august
+september
+october
+november
+december
+monday
+friday
+`
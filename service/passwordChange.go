@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	login "github.com/carprks/login/service"
+)
+
+// PasswordRequest change the caller's password, the current one and, when mfa
+// is on, a code are needed
+type PasswordRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+	RecoveryCode string `json:"recovery_code"`
+	NewPassword  string `json:"new_password"`
+	Verify       string `json:"verify"`
+	// RevokeSessions log out every session, the caller gets a new one back
+	RevokeSessions bool `json:"revoke_sessions"`
+}
+
+// PasswordObject ...
+type PasswordObject struct {
+	Identifier string `json:"identifier"`
+	Status     string `json:"status"`
+	// Tokens the caller's new session when the others were revoked
+	*Tokens
+}
+
+// PasswordHandler ...
+func PasswordHandler(body string) (string, error) {
+	return PasswordHandlerContext(context.Background(), body)
+}
+
+// PasswordHandlerContext PasswordHandler bounded by ctx
+func PasswordHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().PasswordHandler(ctx, body)
+}
+
+// PasswordHandler ...
+func (s Service) PasswordHandler(ctx context.Context, body string) (string, error) {
+	r := PasswordRequest{}
+	return s.mfaHandler("change password", body, &r, func() (interface{}, error) {
+		return s.ChangePassword(ctx, r)
+	})
+}
+
+// ChangePassword ...
+func ChangePassword(r PasswordRequest) (PasswordObject, error) {
+	return ChangePasswordContext(context.Background(), r)
+}
+
+// ChangePasswordContext ChangePassword bounded by ctx
+func ChangePasswordContext(ctx context.Context, r PasswordRequest) (PasswordObject, error) {
+	return NewService().ChangePassword(ctx, r)
+}
+
+// ChangePassword set a new password for a caller who knows the current one
+func (s Service) ChangePassword(ctx context.Context, r PasswordRequest) (PasswordObject, error) {
+	email := s.Emails.Normalise(r.Email)
+	err := s.Passwords.Check(email, r.NewPassword, r.Verify)
+	if err != nil {
+		return PasswordObject{}, err
+	}
+	if r.NewPassword == r.Password {
+		return PasswordObject{}, WithKind(ErrValidation, fmt.Errorf("new password is the same as the current one"))
+	}
+
+	ident, under, err := s.reauthenticate(ctx, r.Email, r.Password, r.OTP, r.RecoveryCode)
+	if err != nil {
+		return PasswordObject{}, err
+	}
+
+	_, err = s.setPassword(ctx, under, r.NewPassword, r.Password)
+	if err != nil {
+		s.Logger.Error("password set err", Fields{"err": err})
+		return PasswordObject{}, fmt.Errorf("can't set password: %w", err)
+	}
+	s.unlock(email)
+	s.Logger.Info("password changed", Fields{"identifier": ident})
+
+	po := PasswordObject{
+		Identifier: ident,
+		Status:     "changed",
+	}
+	if !r.RevokeSessions {
+		return po, nil
+	}
+
+	err = s.Sessions.RevokeAll(ctx, ident)
+	if err != nil {
+		return PasswordObject{}, fmt.Errorf("can't revoke sessions: %w", err)
+	}
+	lo, err := s.completeLogin(ctx, login.Login{
+		Identifier: ident,
+	})
+	if err != nil {
+		return PasswordObject{}, err
+	}
+	po.Tokens = &lo.Tokens
+
+	return po, nil
+}
@@ -0,0 +1,144 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+var passwordRequest = service.PasswordRequest{
+	Email:       "tester@carpark.ninja",
+	Password:    "Carpark-Ninja-2019",
+	NewPassword: "Spaced-0ut-Parking",
+	Verify:      "Spaced-0ut-Parking",
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(r *service.PasswordRequest)
+		expect error
+	}{
+		{
+			name: "wrong password",
+			change: func(r *service.PasswordRequest) {
+				r.Password = "wrong"
+			},
+			expect: service.ErrUnauthorized,
+		},
+		{
+			name: "weak password",
+			change: func(r *service.PasswordRequest) {
+				r.NewPassword = "tester12345"
+				r.Verify = "tester12345"
+			},
+			expect: service.ErrValidation,
+		},
+		{
+			name: "verify differs",
+			change: func(r *service.PasswordRequest) {
+				r.Verify = "Spaced-0ut-Parking!"
+			},
+			expect: service.ErrValidation,
+		},
+		{
+			name: "same password",
+			change: func(r *service.PasswordRequest) {
+				r.NewPassword = r.Password
+				r.Verify = r.Password
+			},
+			expect: service.ErrValidation,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _, logins, _, _ := deleteService(t, 0)
+			r := passwordRequest
+			test.change(&r)
+
+			_, err := s.ChangePassword(context.Background(), r)
+			assert.True(t, errors.Is(err, test.expect), err)
+			assert.Equal(t, "Carpark-Ninja-2019", logins.logins[login.GenerateIdent(r.Email)].Password)
+		})
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	s, now, logins, _, _ := deleteService(t, 0)
+
+	wrong := passwordRequest
+	wrong.Password = "wrong"
+	for i := 0; i < service.LockoutDelayAfter; i++ {
+		_, err := s.ChangePassword(context.Background(), wrong)
+		assert.True(t, errors.Is(err, service.ErrUnauthorized))
+	}
+
+	// guessing the old password is held up the same as logins
+	_, err := s.ChangePassword(context.Background(), passwordRequest)
+	assert.True(t, errors.Is(err, service.ErrTooManyAttempts))
+	assert.Equal(t, "Carpark-Ninja-2019", logins.logins[login.GenerateIdent(passwordRequest.Email)].Password)
+
+	*now = now.Add(service.LockoutDelay)
+	_, err = s.ChangePassword(context.Background(), passwordRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, "Spaced-0ut-Parking", logins.logins[login.GenerateIdent(passwordRequest.Email)].Password)
+}
+
+func TestChangePasswordSessions(t *testing.T) {
+	s, _, _, _, ident := deleteService(t, 0)
+	first := sessionLogin(t, s)
+
+	resp, err := s.ChangePassword(context.Background(), passwordRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, service.PasswordObject{
+		Identifier: ident,
+		Status:     "changed",
+	}, resp)
+
+	_, err = s.Login(context.Background(), login.LoginRequest{Email: "tester@carpark.ninja", Password: "Carpark-Ninja-2019"})
+	assert.Equal(t, service.ErrLoginFailed, err)
+	second, err := s.Login(context.Background(), login.LoginRequest{Email: "tester@carpark.ninja", Password: "Spaced-0ut-Parking"})
+	assert.Nil(t, err)
+
+	// the sessions carry on unless asked otherwise
+	_, err = s.Refresh(context.Background(), first.RefreshToken)
+	assert.Nil(t, err)
+
+	r := passwordRequest
+	r.Password, r.NewPassword, r.Verify = "Spaced-0ut-Parking", "Carpark-Ninja-2019", "Carpark-Ninja-2019"
+	r.RevokeSessions = true
+	resp, err = s.ChangePassword(context.Background(), r)
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.Tokens)
+
+	_, err = s.Refresh(context.Background(), second.RefreshToken)
+	assert.True(t, errors.Is(err, service.ErrUnauthorized))
+	_, err = s.Refresh(context.Background(), resp.RefreshToken)
+	assert.Nil(t, err)
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	s, _, _, _, _ := deleteService(t, 0)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/password",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","new_password":"Spaced-0ut-Parking","verify":"Spaced-0ut-Parking","revoke_sessions":true}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, response.Body, `"status":"changed"`)
+	assert.Contains(t, response.Body, `"refresh_token"`)
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/password",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","new_password":"Carpark-Ninja-2020","verify":"Carpark-Ninja-2020"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
@@ -0,0 +1,162 @@
+package service_test
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		verify   string
+		codes    []string
+	}{
+		{
+			name:     "strong",
+			password: "Carpark-Ninja-2019",
+			verify:   "Carpark-Ninja-2019",
+		},
+		{
+			name:     "mismatch",
+			password: "Carpark-Ninja-2019",
+			verify:   "Carpark-Ninja-2018",
+			codes:    []string{"mismatch"},
+		},
+		{
+			name:     "short and common",
+			password: "password",
+			verify:   "password",
+			codes:    []string{"too_short", "common", "too_weak"},
+		},
+		{
+			name:     "common with swaps",
+			password: "P@55w0rd",
+			verify:   "P@55w0rd",
+			codes:    []string{"too_short", "common", "too_weak"},
+		},
+		{
+			name:     "common word with digits",
+			password: "P@ssw0rd123",
+			verify:   "P@ssw0rd123",
+			codes:    []string{"too_weak"},
+		},
+		{
+			name:     "sequence",
+			password: "qwerty123456",
+			verify:   "qwerty123456",
+			codes:    []string{"too_weak"},
+		},
+		{
+			name:     "too long",
+			password: strings.Repeat("Carpark-Ninja-2019", 8),
+			verify:   strings.Repeat("Carpark-Ninja-2018", 8),
+			codes:    []string{"too_long"},
+		},
+		{
+			name:     "email",
+			password: "Sup3r-T3ster-Pass",
+			verify:   "Sup3r-T3ster-Pass",
+			codes:    []string{"contains_email"},
+		},
+	}
+
+	policy := service.NewPasswordPolicy()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Check("tester@carpark.ninja", test.password, test.verify)
+			if len(test.codes) == 0 {
+				assert.Nil(t, err)
+				return
+			}
+
+			codes := []string{}
+			if ve, ok := err.(service.ValidationError); assert.True(t, ok) {
+				for _, f := range ve.Fields {
+					codes = append(codes, f.Code)
+				}
+			}
+			assert.Equal(t, test.codes, codes)
+		})
+	}
+
+	// right at the limit is still checked as usual
+	long := strings.Repeat("Carpark-Ninja-2019", 8)[:service.PasswordMaxLength]
+	assert.Nil(t, policy.Check("tester@carpark.ninja", long, long))
+
+	// a zero policy still wants them to match
+	assert.Nil(t, service.PasswordPolicy{}.Check("tester@carpark.ninja", "a", "a"))
+	assert.NotNil(t, service.PasswordPolicy{}.Check("tester@carpark.ninja", "a", "b"))
+}
+
+func TestPasswordScore(t *testing.T) {
+	policy := service.NewPasswordPolicy()
+	tests := []struct {
+		password string
+		score    int
+	}{
+		{"", 0},
+		{"123456", 0},
+		{"aaaaaaaaaaaa", 1},
+		{"carparkninja", 1},
+		{"Tr0ub4dor&3", 4},
+		{"correct horse battery staple", 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.password, func(t *testing.T) {
+			assert.Equal(t, test.score, service.PasswordScore(test.password, policy.Blocklist))
+		})
+	}
+}
+
+func TestRegisterPasswordPolicy(t *testing.T) {
+	requireFakes(t)
+
+	response, err := service.NewService().Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/register",
+		Body:     `{"email":"tester@carpark.ninja","password":"tester","verify":"tester"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, `{"error":{"code":"validation","message":"can't register: password must be at least 10 characters, password is too common, password can't contain your email address, password is too easy to guess","request_id":"","fields":[{"field":"password","code":"too_short","message":"password must be at least 10 characters"},{"field":"password","code":"common","message":"password is too common"},{"field":"password","code":"contains_email","message":"password can't contain your email address"},{"field":"password","code":"too_weak","message":"password is too easy to guess"}]}}`, response.Body)
+
+	// refused before the login service is asked
+	assert.Equal(t, 0, loginService.Calls("/register"))
+}
+
+func TestResetPasswordPolicy(t *testing.T) {
+	notifier := &captureNotifier{}
+	s := service.NewService()
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	resp, err := s.Register(context.Background(), testsRegister[0].request)
+	assert.Nil(t, err)
+	_, err = s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "tester12345",
+		Verify:   "tester12345",
+	})
+	assert.EqualError(t, err, "password can't contain your email address, password is too easy to guess")
+
+	// the refused password didn't use up the token
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Spaced-0ut-Parking",
+		Verify:   "Spaced-0ut-Parking",
+	})
+	assert.Nil(t, err)
+
+	deleteAccount(resp.Identifier)
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	permissions "github.com/carprks/permissions/service"
+	"sync"
+	"time"
+)
+
+// PermissionsCacheSize how many identifiers are kept when PERMISSIONS_CACHE_SIZE isn't set
+const PermissionsCacheSize = 1000
+
+// PermissionsCache each identifier's permission set so Allowed can be answered
+// without asking the permissions service, it lives as long as the lambda is
+// warm and only this lambda's changes invalidate it, so TTL is how stale
+// another lambda's changes can be
+type PermissionsCache struct {
+	TTL  time.Duration
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order most recently used at the front
+	order *list.List
+}
+
+type permissionsCacheEntry struct {
+	ident   string
+	perms   []permissions.Permission
+	expires time.Time
+}
+
+// NewPermissionsCache ...
+func NewPermissionsCache(ttl time.Duration, size int) *PermissionsCache {
+	return &PermissionsCache{
+		TTL:     ttl,
+		Size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// newPermissionsCache nil, so Allowed goes to the permissions service, unless
+// PERMISSIONS_CACHE_TTL is set in seconds
+func newPermissionsCache() *PermissionsCache {
+	ttl := envInt("PERMISSIONS_CACHE_TTL", 0)
+	if ttl == 0 {
+		return nil
+	}
+
+	return NewPermissionsCache(time.Duration(ttl)*time.Second, envInt("PERMISSIONS_CACHE_SIZE", PermissionsCacheSize))
+}
+
+// Get the permissions of ident if they are cached and haven't expired
+func (c *PermissionsCache) Get(ident string, now time.Time) ([]permissions.Permission, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[ident]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*permissionsCacheEntry)
+	if !now.Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, ident)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+
+	return e.perms, true
+}
+
+// Set cache the permissions of ident, the least recently used go once it is full
+func (c *PermissionsCache) Set(ident string, perms []permissions.Permission, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &permissionsCacheEntry{
+		ident:   ident,
+		perms:   perms,
+		expires: now.Add(c.TTL),
+	}
+	if el, ok := c.entries[ident]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[ident] = c.order.PushFront(e)
+
+	for c.Size > 0 && c.order.Len() > c.Size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*permissionsCacheEntry).ident)
+	}
+}
+
+// Invalidate forget ident, for when its permissions change
+func (c *PermissionsCache) Invalidate(ident string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[ident]; ok {
+		c.order.Remove(el)
+		delete(c.entries, ident)
+	}
+}
+
+// Len how many identifiers are cached
+func (c *PermissionsCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Reset forget everything
+func (c *PermissionsCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// AllowedBy the same rules as the permissions service, a check passes when a
+// stored permission has its name and action, or "*" for either, on the
+// identifier being checked or "*"
+func AllowedBy(stored []permissions.Permission, p permissions.Permissions) bool {
+	for _, perm := range stored {
+		for _, cperm := range p.Permissions {
+			if ok, _ := permissionMatches(perm, cperm, p.Identifier); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// permissionMatches whether the stored perm allows ident cperm, and which of
+// its fields were a "*" that it relied on
+func permissionMatches(perm, cperm permissions.Permission, ident string) (bool, []string) {
+	if perm.Name == "*" {
+		return true, []string{"name"}
+	}
+	if perm.Name != cperm.Name {
+		return false, nil
+	}
+	if perm.Action == "*" {
+		return true, []string{"action"}
+	}
+	if perm.Action != cperm.Action {
+		return false, nil
+	}
+	if perm.Identifier == ident {
+		return true, nil
+	}
+	if perm.Identifier == "*" {
+		return true, []string{"identifier"}
+	}
+
+	return false, nil
+}
+
+// storedPermissions the whole set for ident, from the cache when there is one
+func (s Service) storedPermissions(ctx context.Context, ident string) ([]permissions.Permission, error) {
+	if s.Cache != nil {
+		if stored, ok := s.Cache.Get(ident, s.now()); ok {
+			return stored, nil
+		}
+	}
+
+	current := permissions.Permissions{}
+	err := s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		var err error
+		current, err = s.PermissionsClient.Retrieve(ctx, ident)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a status means there are none, so everything is denied
+	var stored []permissions.Permission
+	if current.Status == "" {
+		stored = current.Permissions
+	}
+	if s.Cache != nil {
+		s.Cache.Set(ident, stored, s.now())
+	}
+
+	return stored, nil
+}
+
+// allowedCached answer Allowed from the cache, fetching the whole set on a miss
+func (s Service) allowedCached(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	stored, err := s.storedPermissions(ctx, p.Identifier)
+	if err != nil {
+		return permissions.Permissions{}, err
+	}
+
+	status := "denied"
+	if AllowedBy(stored, p) {
+		status = "allowed"
+	}
+
+	return permissions.Permissions{
+		Identifier: p.Identifier,
+		Status:     status,
+	}, nil
+}
+
+// invalidatePermissions after changing the permissions of ident
+func (s Service) invalidatePermissions(ident string) {
+	if s.Cache != nil {
+		s.Cache.Invalidate(ident)
+	}
+}
@@ -0,0 +1,174 @@
+package service_test
+
+import (
+	"context"
+	"github.com/carprks/account/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAllowedBy(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored []permissions.Permission
+		check  permissions.Permission
+		expect bool
+	}{
+		{
+			name:   "own",
+			stored: []permissions.Permission{{Name: "account", Action: "login", Identifier: "ident"}},
+			check:  permissions.Permission{Name: "account", Action: "login"},
+			expect: true,
+		},
+		{
+			name:   "someone else's",
+			stored: []permissions.Permission{{Name: "account", Action: "login", Identifier: "other"}},
+			check:  permissions.Permission{Name: "account", Action: "login"},
+		},
+		{
+			name:   "other action",
+			stored: []permissions.Permission{{Name: "account", Action: "login", Identifier: "ident"}},
+			check:  permissions.Permission{Name: "account", Action: "edit"},
+		},
+		{
+			name:   "any identifier",
+			stored: []permissions.Permission{{Name: "carparks", Action: "book", Identifier: "*"}},
+			check:  permissions.Permission{Name: "carparks", Action: "book", Identifier: "carpark-1"},
+			expect: true,
+		},
+		{
+			name:   "any action",
+			stored: []permissions.Permission{{Name: "carparks", Action: "*", Identifier: "other"}},
+			check:  permissions.Permission{Name: "carparks", Action: "create"},
+			expect: true,
+		},
+		{
+			name:   "any name",
+			stored: []permissions.Permission{{Name: "*", Action: "view", Identifier: "other"}},
+			check:  permissions.Permission{Name: "payments", Action: "report"},
+			expect: true,
+		},
+		{
+			name:  "none",
+			check: permissions.Permission{Name: "account", Action: "login"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := permissions.Permissions{
+				Identifier:  "ident",
+				Permissions: []permissions.Permission{test.check},
+			}
+			assert.Equal(t, test.expect, service.AllowedBy(test.stored, p))
+
+			// the same answer as the permissions service
+			m := newMemoryPermissions()
+			if len(test.stored) >= 1 {
+				m.perms["ident"] = test.stored
+			}
+			pr, err := m.Allowed(context.Background(), p)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, pr.Status == "allowed")
+		})
+	}
+}
+
+func TestPermissionsCache(t *testing.T) {
+	now := time.Now()
+	c := service.NewPermissionsCache(time.Minute, 2)
+	perms := []permissions.Permission{{Name: "account", Action: "login", Identifier: "a"}}
+
+	c.Set("a", perms, now)
+	got, ok := c.Get("a", now.Add(time.Second*59))
+	assert.True(t, ok)
+	assert.Equal(t, perms, got)
+	_, ok = c.Get("a", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// b is the least recently used when d comes in
+	c.Set("b", nil, now)
+	c.Set("c", nil, now)
+	_, ok = c.Get("b", now)
+	assert.True(t, ok)
+	c.Set("d", nil, now)
+	assert.Equal(t, 2, c.Len())
+	_, ok = c.Get("c", now)
+	assert.False(t, ok)
+	_, ok = c.Get("b", now)
+	assert.True(t, ok)
+
+	c.Invalidate("b")
+	_, ok = c.Get("b", now)
+	assert.False(t, ok)
+
+	c.Reset()
+	assert.Equal(t, 0, c.Len())
+}
+
+// countingPermissions counts calls that reach the permissions service
+type countingPermissions struct {
+	*memoryPermissions
+	mu       sync.Mutex
+	retrieve int
+	allowed  int
+}
+
+func (c *countingPermissions) Retrieve(ctx context.Context, ident string) (permissions.Permissions, error) {
+	c.mu.Lock()
+	c.retrieve++
+	c.mu.Unlock()
+
+	return c.memoryPermissions.Retrieve(ctx, ident)
+}
+
+func (c *countingPermissions) Allowed(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	c.mu.Lock()
+	c.allowed++
+	c.mu.Unlock()
+
+	return c.memoryPermissions.Allowed(ctx, p)
+}
+
+func TestAllowedCached(t *testing.T) {
+	perms := &countingPermissions{
+		memoryPermissions: newMemoryPermissions(),
+	}
+	s, _ := reconcileService(t)
+	s.PermissionsClient = perms
+	s.Cache = service.NewPermissionsCache(time.Minute, 10)
+
+	login := permissions.Permissions{
+		Identifier:  "ident",
+		Permissions: []permissions.Permission{{Name: "account", Action: "login"}},
+	}
+
+	// nothing stored yet, the empty set is cached too
+	pr, err := s.Allowed(context.Background(), login)
+	assert.Nil(t, err)
+	assert.Equal(t, "denied", pr.Status)
+
+	_, err = s.ReconcileAccount(context.Background(), service.ReconcileAccount{
+		Identifier: "ident",
+	}, service.ReconcileOptions{})
+	assert.Nil(t, err)
+	perms.retrieve = 0
+
+	for i := 0; i < 3; i++ {
+		pr, err = s.Allowed(context.Background(), login)
+		assert.Nil(t, err)
+		assert.Equal(t, "allowed", pr.Status)
+	}
+	assert.Equal(t, 1, perms.retrieve)
+	assert.Equal(t, 0, perms.allowed)
+
+	err = s.DeletePermissions(context.Background(), "ident")
+	assert.Nil(t, err)
+	pr, err = s.Allowed(context.Background(), login)
+	assert.Nil(t, err)
+	assert.Equal(t, "denied", pr.Status)
+	assert.Equal(t, 2, perms.retrieve)
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	permissions "github.com/carprks/permissions/service"
+	"net/http"
+)
+
+// PermissionsClient talks to the permissions service
+type PermissionsClient interface {
+	Create(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error)
+	Retrieve(ctx context.Context, ident string) (permissions.Permissions, error)
+	Allowed(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error)
+	Delete(ctx context.Context, ident string) error
+}
+
+// HTTPPermissionsClient the permissions service over http
+type HTTPPermissionsClient struct {
+	Address string
+	Auth    string
+	Client  *http.Client
+}
+
+// Create store the permissions
+func (c HTTPPermissionsClient) Create(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	pr := permissions.Permissions{}
+
+	status, err := doJSON(ctx, c.Client, "POST", fmt.Sprintf("%s/create", c.Address), c.Auth, p, &pr)
+	if err != nil {
+		return pr, fmt.Errorf("create permissions %w", err)
+	}
+	if status != http.StatusOK {
+		return pr, WithKind(ErrUpstream, fmt.Errorf("can't create permissions"))
+	}
+
+	return pr, nil
+}
+
+// Retrieve get the permissions for the identifier
+func (c HTTPPermissionsClient) Retrieve(ctx context.Context, ident string) (permissions.Permissions, error) {
+	pr := permissions.Permissions{}
+
+	status, err := doJSON(ctx, c.Client, "POST", fmt.Sprintf("%s/retrieve", c.Address), c.Auth, permissions.Permissions{
+		Identifier: ident,
+	}, &pr)
+	if err != nil {
+		return pr, fmt.Errorf("permissions %w", err)
+	}
+	if status != http.StatusOK {
+		return pr, WithKind(ErrUpstream, fmt.Errorf("permissions came back with different statuscode: %v", status))
+	}
+
+	return pr, nil
+}
+
+// Allowed check the permissions
+func (c HTTPPermissionsClient) Allowed(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	pr := permissions.Permissions{}
+
+	status, err := doJSON(ctx, c.Client, "POST", fmt.Sprintf("%s/allowed", c.Address), c.Auth, p, &pr)
+	if err != nil {
+		return pr, fmt.Errorf("allowed %w", err)
+	}
+	if status != http.StatusOK {
+		return pr, WithKind(ErrUpstream, fmt.Errorf("allowed came back with a different statuscode: %v", status))
+	}
+
+	return pr, nil
+}
+
+// Delete remove every permission of the identifier
+func (c HTTPPermissionsClient) Delete(ctx context.Context, ident string) error {
+	pr := permissions.Permissions{}
+
+	status, err := doJSON(ctx, c.Client, "DELETE", fmt.Sprintf("%s/delete", c.Address), c.Auth, permissions.Permissions{
+		Identifier: ident,
+	}, &pr)
+	if err != nil {
+		return fmt.Errorf("delete permissions %w", err)
+	}
+	if status != http.StatusOK {
+		return WithKind(ErrUpstream, fmt.Errorf("delete permissions came back with a different statuscode: %v", status))
+	}
+
+	return nil
+}
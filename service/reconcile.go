@@ -0,0 +1,338 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	permissions "github.com/carprks/permissions/service"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Reconcile statuses
+const (
+	ReconcileUnchanged   = "unchanged"
+	ReconcileChanged     = "changed"
+	ReconcileWouldChange = "would_change"
+	ReconcileFailed      = "failed"
+)
+
+// ReconcileAccount an account to bring in line with its role template
+type ReconcileAccount struct {
+	Identifier string `json:"identifier"`
+	// Role the template to compare against, the default role when empty
+	Role string `json:"role,omitempty"`
+}
+
+// ReconcileResult what was, or would be, changed for an account
+type ReconcileResult struct {
+	Identifier string                   `json:"identifier"`
+	Role       string                   `json:"role"`
+	Status     string                   `json:"status"`
+	Added      []permissions.Permission `json:"added,omitempty"`
+	Removed    []permissions.Permission `json:"removed,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+}
+
+// ReconcileOptions ...
+type ReconcileOptions struct {
+	// DryRun report the differences without changing anything
+	DryRun bool
+	// RemoveExtra take away permissions that aren't in the template too, by
+	// default they are left as accounts can have been granted more by hand
+	RemoveExtra bool
+}
+
+// ErrReconcileEmpty the permissions were deleted and neither the new set nor
+// the old one could be created again, the account has none until it is rerun
+var ErrReconcileEmpty = errors.New("account left without permissions")
+
+// ReconcileAccount compare the account's permissions to its role template and
+// apply the difference, the permissions service can only replace a whole set
+// so it is deleted and created again, the old set is put back when the new
+// one can't be created
+func (s Service) ReconcileAccount(ctx context.Context, a ReconcileAccount, opts ReconcileOptions) (ReconcileResult, error) {
+	if a.Role == "" {
+		a.Role = s.Roles.Default
+	}
+	res := ReconcileResult{
+		Identifier: a.Identifier,
+		Role:       a.Role,
+	}
+
+	want, err := s.Roles.Render(a.Role, a.Identifier)
+	if err != nil {
+		return res, err
+	}
+
+	current := permissions.Permissions{}
+	err = s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		var err error
+		current, err = s.PermissionsClient.Retrieve(ctx, a.Identifier)
+		return err
+	})
+	if err != nil {
+		return res, fmt.Errorf("can't retrieve permissions: %w", err)
+	}
+	// a status means there are none, possibly from a run that stopped between delete and create
+	have := current.Permissions
+	if current.Status != "" {
+		have = nil
+	}
+
+	res.Added = permissionsMissing(want, have)
+	if opts.RemoveExtra {
+		res.Removed = permissionsMissing(have, want)
+	}
+	if len(res.Added) == 0 && len(res.Removed) == 0 {
+		res.Status = ReconcileUnchanged
+		return res, nil
+	}
+	if opts.DryRun {
+		res.Status = ReconcileWouldChange
+		return res, nil
+	}
+
+	next := append(permissionsMissing(have, res.Removed), res.Added...)
+	if len(have) >= 1 {
+		err = s.DeletePermissions(ctx, a.Identifier)
+		if err != nil {
+			return res, fmt.Errorf("can't delete permissions: %w", err)
+		}
+	}
+	err = s.replacePermissions(ctx, a.Identifier, next)
+	if err != nil {
+		if len(have) == 0 {
+			return res, fmt.Errorf("can't create permissions: %w", err)
+		}
+		rerr := s.replacePermissions(ctx, a.Identifier, have)
+		if rerr != nil {
+			s.Logger.Error("reconcile left account without permissions", Fields{"err": rerr, "identifier": a.Identifier})
+			return res, fmt.Errorf("can't create permissions: %v, can't restore them: %w", err, WithKind(ErrReconcileEmpty, rerr))
+		}
+		return res, fmt.Errorf("can't create permissions, restored them: %w", err)
+	}
+
+	res.Status = ReconcileChanged
+	return res, nil
+}
+
+// replacePermissions create the set for an account that has none, a create
+// isn't safe to send twice so it isn't retried
+func (s Service) replacePermissions(ctx context.Context, ident string, perms []permissions.Permission) error {
+	err := s.call(ctx, s.PermissionsUpstream, false, func(ctx context.Context) error {
+		_, err := s.PermissionsClient.Create(ctx, permissions.Permissions{
+			Identifier:  ident,
+			Permissions: perms,
+		})
+		return err
+	})
+	s.invalidatePermissions(ident)
+
+	return err
+}
+
+// permissionsMissing the permissions in a that aren't in b, in the order of a
+func permissionsMissing(a, b []permissions.Permission) []permissions.Permission {
+	seen := map[permissions.Permission]bool{}
+	for _, p := range b {
+		seen[p] = true
+	}
+
+	var out []permissions.Permission
+	for _, p := range a {
+		if !seen[p] {
+			out = append(out, p)
+			seen[p] = true
+		}
+	}
+
+	return out
+}
+
+// ReconcileSummary the outcome of a run
+type ReconcileSummary struct {
+	DryRun    bool   `json:"dry_run"`
+	Accounts  int    `json:"accounts"`
+	Skipped   int    `json:"skipped"`
+	Unchanged int    `json:"unchanged"`
+	Changed   int    `json:"changed"`
+	Failed    int    `json:"failed"`
+	Stopped   string `json:"stopped,omitempty"`
+	// Results the accounts that differed or failed
+	Results []ReconcileResult `json:"results"`
+}
+
+// Reconciler run ReconcileAccount over a list of accounts, one per line as
+// "identifier" or "identifier role", blank lines and # comments are skipped
+type Reconciler struct {
+	Service ReconcileService
+	Options ReconcileOptions
+	// Interval the least time between accounts, to spare the permissions service
+	Interval time.Duration
+	// Checkpoint file recording how far through the list a run got, a run
+	// picks up after it and it is removed once the list is finished
+	Checkpoint string
+}
+
+// ReconcileService what the reconciler needs from Service
+type ReconcileService interface {
+	ReconcileAccount(ctx context.Context, a ReconcileAccount, opts ReconcileOptions) (ReconcileResult, error)
+}
+
+type reconcileCheckpoint struct {
+	Line int `json:"line"`
+}
+
+// Run go through in, a cancelled ctx stops after the current account with the
+// checkpoint saved
+func (r Reconciler) Run(ctx context.Context, in io.Reader) (ReconcileSummary, error) {
+	sum := ReconcileSummary{
+		DryRun:  r.Options.DryRun,
+		Results: []ReconcileResult{},
+	}
+
+	start, err := r.loadCheckpoint()
+	if err != nil {
+		return sum, err
+	}
+
+	var tick <-chan time.Time
+	if r.Interval > 0 {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	scanner := bufio.NewScanner(in)
+	line := 0
+	first := true
+	for scanner.Scan() {
+		line++
+		if line <= start {
+			sum.Skipped++
+			continue
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		a := ReconcileAccount{
+			Identifier: fields[0],
+		}
+		if len(fields) >= 2 {
+			a.Role = fields[1]
+		}
+
+		if tick != nil && !first {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		first = false
+		if ctx.Err() != nil {
+			sum.Stopped = ctx.Err().Error()
+			return sum, nil
+		}
+
+		res, err := r.Service.ReconcileAccount(ctx, a, r.Options)
+		sum.Accounts++
+		switch {
+		case errors.Is(err, ErrReconcileEmpty):
+			// the checkpoint stays before the account so the next run starts with it
+			res.Status = ReconcileFailed
+			res.Error = err.Error()
+			sum.Failed++
+			sum.Results = append(sum.Results, res)
+			sum.Stopped = err.Error()
+			return sum, fmt.Errorf("reconcile %s: %w", a.Identifier, err)
+		case err != nil:
+			res.Status = ReconcileFailed
+			res.Error = err.Error()
+			sum.Failed++
+		case res.Status == ReconcileUnchanged:
+			sum.Unchanged++
+		default:
+			sum.Changed++
+		}
+		if res.Status != ReconcileUnchanged {
+			sum.Results = append(sum.Results, res)
+		}
+
+		// a dry run doesn't move the checkpoint, the real run still has everything to do
+		if !r.Options.DryRun {
+			err = r.saveCheckpoint(line)
+			if err != nil {
+				return sum, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sum, fmt.Errorf("can't read accounts: %w", err)
+	}
+
+	if !r.Options.DryRun && r.Checkpoint != "" {
+		err = os.Remove(r.Checkpoint)
+		if err != nil && !os.IsNotExist(err) {
+			return sum, fmt.Errorf("can't remove checkpoint: %w", err)
+		}
+	}
+
+	return sum, nil
+}
+
+func (r Reconciler) loadCheckpoint() (int, error) {
+	if r.Checkpoint == "" {
+		return 0, nil
+	}
+
+	j, err := ioutil.ReadFile(r.Checkpoint)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("can't read checkpoint: %w", err)
+	}
+
+	cp := reconcileCheckpoint{}
+	err = json.Unmarshal(j, &cp)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse checkpoint: %w", err)
+	}
+
+	return cp.Line, nil
+}
+
+// saveCheckpoint written aside and renamed so a crash can't leave half a file
+func (r Reconciler) saveCheckpoint(line int) error {
+	if r.Checkpoint == "" {
+		return nil
+	}
+
+	j, err := json.Marshal(reconcileCheckpoint{
+		Line: line,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(r.Checkpoint), "."+filepath.Base(r.Checkpoint)+".tmp")
+	err = ioutil.WriteFile(tmp, j, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write checkpoint: %w", err)
+	}
+	err = os.Rename(tmp, r.Checkpoint)
+	if err != nil {
+		return fmt.Errorf("can't write checkpoint: %w", err)
+	}
+
+	return nil
+}
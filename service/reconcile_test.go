@@ -0,0 +1,299 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/carprks/account/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reconcileService permissions in memory, driver is login and view of the account
+func reconcileService(t *testing.T) (service.Service, *memoryPermissions) {
+	perms := newMemoryPermissions()
+	s := service.NewService()
+	s.PermissionsClient = perms
+
+	rt, err := service.ParseRoleTemplates([]byte(`
+default: driver
+roles:
+  driver:
+    - {name: account, action: login, identifier: "{identifier}"}
+    - {name: account, action: view, identifier: "{identifier}"}
+  support:
+    - {name: account, action: view, identifier: "*"}
+`))
+	assert.Nil(t, err)
+	s.Roles = rt
+
+	return s, perms
+}
+
+func TestReconcileAccount(t *testing.T) {
+	login := permissions.Permission{Name: "account", Action: "login", Identifier: "ident"}
+	view := permissions.Permission{Name: "account", Action: "view", Identifier: "ident"}
+	edit := permissions.Permission{Name: "account", Action: "edit", Identifier: "ident"}
+	admin := permissions.Permission{Name: "account", Action: "admin", Identifier: "*"}
+
+	tests := []struct {
+		name   string
+		have   []permissions.Permission
+		role   string
+		opts   service.ReconcileOptions
+		expect service.ReconcileResult
+		after  []permissions.Permission
+	}{
+		{
+			name: "unchanged",
+			have: []permissions.Permission{view, login},
+			expect: service.ReconcileResult{
+				Status: service.ReconcileUnchanged,
+			},
+			after: []permissions.Permission{view, login},
+		},
+		{
+			name: "added and removed",
+			have: []permissions.Permission{login, edit},
+			opts: service.ReconcileOptions{
+				RemoveExtra: true,
+			},
+			expect: service.ReconcileResult{
+				Status:  service.ReconcileChanged,
+				Added:   []permissions.Permission{view},
+				Removed: []permissions.Permission{edit},
+			},
+			after: []permissions.Permission{login, view},
+		},
+		{
+			name: "dry run",
+			have: []permissions.Permission{login, edit},
+			opts: service.ReconcileOptions{
+				DryRun:      true,
+				RemoveExtra: true,
+			},
+			expect: service.ReconcileResult{
+				Status:  service.ReconcileWouldChange,
+				Added:   []permissions.Permission{view},
+				Removed: []permissions.Permission{edit},
+			},
+			after: []permissions.Permission{login, edit},
+		},
+		{
+			name: "extra kept",
+			have: []permissions.Permission{admin, login},
+			expect: service.ReconcileResult{
+				Status: service.ReconcileChanged,
+				Added:  []permissions.Permission{view},
+			},
+			after: []permissions.Permission{admin, login, view},
+		},
+		{
+			name: "none at all",
+			expect: service.ReconcileResult{
+				Status: service.ReconcileChanged,
+				Added:  []permissions.Permission{login, view},
+			},
+			after: []permissions.Permission{login, view},
+		},
+		{
+			name: "other role",
+			have: []permissions.Permission{login, view},
+			role: "support",
+			opts: service.ReconcileOptions{
+				RemoveExtra: true,
+			},
+			expect: service.ReconcileResult{
+				Role:    "support",
+				Status:  service.ReconcileChanged,
+				Added:   []permissions.Permission{{Name: "account", Action: "view", Identifier: "*"}},
+				Removed: []permissions.Permission{login, view},
+			},
+			after: []permissions.Permission{{Name: "account", Action: "view", Identifier: "*"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, perms := reconcileService(t)
+			if len(test.have) >= 1 {
+				perms.perms["ident"] = test.have
+			}
+
+			res, err := s.ReconcileAccount(context.Background(), service.ReconcileAccount{
+				Identifier: "ident",
+				Role:       test.role,
+			}, test.opts)
+			assert.Nil(t, err)
+
+			test.expect.Identifier = "ident"
+			if test.expect.Role == "" {
+				test.expect.Role = "driver"
+			}
+			assert.Equal(t, test.expect, res)
+			assert.Equal(t, test.after, perms.perms["ident"])
+		})
+	}
+
+	s, _ := reconcileService(t)
+	_, err := s.ReconcileAccount(context.Background(), service.ReconcileAccount{
+		Identifier: "ident",
+		Role:       "unknown",
+	}, service.ReconcileOptions{})
+	assert.EqualError(t, err, "unknown role: unknown")
+}
+
+// failingCreate permissions that can't be created after the first fail ones
+type failingCreate struct {
+	*memoryPermissions
+	fail int
+}
+
+func (f *failingCreate) Create(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	if f.fail >= 1 {
+		f.fail--
+		return permissions.Permissions{}, service.WithKind(service.ErrUpstream, fmt.Errorf("permissions came back with different statuscode: 502"))
+	}
+
+	return f.memoryPermissions.Create(ctx, p)
+}
+
+func TestReconcileAccountCreateFails(t *testing.T) {
+	login := permissions.Permission{Name: "account", Action: "login", Identifier: "ident"}
+	edit := permissions.Permission{Name: "account", Action: "edit", Identifier: "ident"}
+
+	// the old permissions are put back
+	s, perms := reconcileService(t)
+	perms.perms["ident"] = []permissions.Permission{login, edit}
+	s.PermissionsClient = &failingCreate{memoryPermissions: perms, fail: 1}
+	_, err := s.ReconcileAccount(context.Background(), service.ReconcileAccount{Identifier: "ident"}, service.ReconcileOptions{})
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, service.ErrReconcileEmpty))
+	assert.Equal(t, []permissions.Permission{login, edit}, perms.perms["ident"])
+
+	// neither can be created, the run stops on the account so it is done again
+	perms.perms["ident"] = []permissions.Permission{login, edit}
+	s.PermissionsClient = &failingCreate{memoryPermissions: perms, fail: 2}
+	dir, err := ioutil.TempDir("", "reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+
+	sum, err := service.Reconciler{
+		Service:    s,
+		Checkpoint: checkpoint,
+	}.Run(context.Background(), strings.NewReader("ident\nident-2\n"))
+	assert.True(t, errors.Is(err, service.ErrReconcileEmpty))
+	assert.Equal(t, 1, sum.Accounts)
+	assert.Equal(t, 1, sum.Failed)
+	assert.NotEqual(t, "", sum.Stopped)
+	_, ok := perms.perms["ident"]
+	assert.False(t, ok)
+
+	sum, err = service.Reconciler{
+		Service:    s,
+		Checkpoint: checkpoint,
+	}.Run(context.Background(), strings.NewReader("ident\nident-2\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sum.Skipped)
+	assert.Equal(t, 2, sum.Changed)
+	assert.Len(t, perms.perms["ident"], 2)
+}
+
+// stopReconcile reconciles every account, cancelling once it gets to stop
+type stopReconcile struct {
+	service.Service
+	stop   string
+	cancel context.CancelFunc
+	seen   []string
+}
+
+func (s *stopReconcile) ReconcileAccount(ctx context.Context, a service.ReconcileAccount, opts service.ReconcileOptions) (service.ReconcileResult, error) {
+	s.seen = append(s.seen, a.Identifier)
+	if a.Identifier == s.stop {
+		s.cancel()
+	}
+	if a.Identifier == "broken" {
+		return service.ReconcileResult{Identifier: a.Identifier}, fmt.Errorf("permissions came back with different statuscode: 502")
+	}
+
+	return s.Service.ReconcileAccount(ctx, a, opts)
+}
+
+func TestReconciler(t *testing.T) {
+	s, perms := reconcileService(t)
+	perms.perms["ident-2"] = []permissions.Permission{
+		{Name: "account", Action: "login", Identifier: "ident-2"},
+		{Name: "account", Action: "view", Identifier: "ident-2"},
+	}
+
+	dir, err := ioutil.TempDir("", "reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+
+	list := `# accounts to check
+ident-1
+ident-2
+
+broken
+ident-3 support
+ident-4
+`
+
+	// a dry run changes nothing and doesn't checkpoint
+	sum, err := service.Reconciler{
+		Service: s,
+		Options: service.ReconcileOptions{
+			DryRun: true,
+		},
+		Checkpoint: checkpoint,
+	}.Run(context.Background(), strings.NewReader(strings.Replace(list, "broken\n", "", 1)))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, sum.Accounts)
+	assert.Equal(t, 1, sum.Unchanged)
+	assert.Equal(t, 3, sum.Changed)
+	assert.Equal(t, service.ReconcileWouldChange, sum.Results[0].Status)
+	assert.Len(t, perms.perms, 1)
+	_, err = os.Stat(checkpoint)
+	assert.True(t, os.IsNotExist(err))
+
+	// stopped part way, the next run carries on after the last account done
+	ctx, cancel := context.WithCancel(context.Background())
+	stopper := &stopReconcile{
+		Service: s,
+		stop:    "broken",
+		cancel:  cancel,
+	}
+	sum, err = service.Reconciler{
+		Service:    stopper,
+		Checkpoint: checkpoint,
+		Interval:   time.Millisecond,
+	}.Run(ctx, strings.NewReader(list))
+	assert.Nil(t, err)
+	assert.Equal(t, "context canceled", sum.Stopped)
+	assert.Equal(t, []string{"ident-1", "ident-2", "broken"}, stopper.seen)
+	assert.Equal(t, 1, sum.Failed)
+	assert.Equal(t, service.ReconcileFailed, sum.Results[1].Status)
+
+	stopper.seen = nil
+	sum, err = service.Reconciler{
+		Service:    stopper,
+		Checkpoint: checkpoint,
+	}.Run(context.Background(), strings.NewReader(list))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ident-3", "ident-4"}, stopper.seen)
+	assert.Equal(t, 5, sum.Skipped)
+	assert.Equal(t, 2, sum.Changed)
+	assert.Equal(t, []permissions.Permission{{Name: "account", Action: "view", Identifier: "*"}}, perms.perms["ident-3"])
+
+	// finished so the checkpoint is gone
+	_, err = os.Stat(checkpoint)
+	assert.True(t, os.IsNotExist(err))
+}
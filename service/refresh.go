@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	login "github.com/carprks/login/service"
+)
+
+// RefreshRequest the refresh token of the session
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutObject ...
+type LogoutObject struct {
+	Identifier string `json:"identifier,omitempty"`
+	Status     string `json:"status"`
+}
+
+// RefreshHandler ...
+func RefreshHandler(body string) (string, error) {
+	return RefreshHandlerContext(context.Background(), body)
+}
+
+// RefreshHandlerContext RefreshHandler bounded by ctx
+func RefreshHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().RefreshHandler(ctx, body)
+}
+
+// RefreshHandler ...
+func (s Service) RefreshHandler(ctx context.Context, body string) (string, error) {
+	r := RefreshRequest{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall refresh", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall refresh: %w", WithKind(ErrValidation, err))
+	}
+
+	rf, err := s.Refresh(ctx, r.RefreshToken)
+	if err != nil {
+		s.Logger.Error("can't refresh", Fields{"err": err})
+		return "", fmt.Errorf("can't refresh: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall refresh", Fields{"err": err})
+		return "", fmt.Errorf("can't marshall refresh: %w", err)
+	}
+
+	return string(rfb), nil
+}
+
+// Refresh ...
+func Refresh(token string) (Tokens, error) {
+	return RefreshContext(context.Background(), token)
+}
+
+// RefreshContext Refresh bounded by ctx
+func RefreshContext(ctx context.Context, token string) (Tokens, error) {
+	return NewService().Refresh(ctx, token)
+}
+
+// Refresh swap the refresh token for a new one and a new access token, the
+// old refresh token can't be used again and if it is the session is revoked
+func (s Service) Refresh(ctx context.Context, token string) (Tokens, error) {
+	sess, err := s.currentSession(ctx, token)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	// permissions and verification can have changed since the login, done before
+	// rotating so a failure doesn't cost the client its refresh token
+	verified, err := s.verified(sess.Identifier)
+	if err != nil {
+		return Tokens{}, err
+	}
+	perms, err := s.LoginPermissions(ctx, login.Login{
+		Identifier: sess.Identifier,
+	})
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't get permissions for user: %w", err)
+	}
+
+	refresh, err := generateToken()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't generate refresh token: %w", err)
+	}
+	err = s.Sessions.Rotate(ctx, sess.ID, sess.RefreshHash, hashToken(refresh))
+	if errors.Is(err, ErrRefreshRotated) {
+		// another refresh got there first with the same token
+		return Tokens{}, s.reused(ctx, sess)
+	}
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't rotate session: %w", err)
+	}
+
+	return s.sessionTokens(sess, refresh, perms, !verified)
+}
+
+// currentSession the session the refresh token is current for
+func (s Service) currentSession(ctx context.Context, token string) (Session, error) {
+	if token == "" {
+		return Session{}, WithKind(ErrValidation, fmt.Errorf("missing refresh token"))
+	}
+
+	hash := hashToken(token)
+	sess, ok, err := s.Sessions.Find(ctx, hash)
+	if err != nil {
+		return Session{}, fmt.Errorf("can't find session: %w", err)
+	}
+	if !ok || sess.Revoked {
+		return Session{}, ErrRefreshToken
+	}
+	if sess.RefreshHash != hash {
+		return Session{}, s.reused(ctx, sess)
+	}
+	if !s.now().Before(sess.Expires) {
+		return Session{}, ErrRefreshToken
+	}
+
+	return sess, nil
+}
+
+// reused a rotated refresh token came back so it has probably been stolen,
+// revoke the session so neither copy works
+func (s Service) reused(ctx context.Context, sess Session) error {
+	s.Logger.Warn("refresh token reused, revoking session", Fields{"session": sess.ID, "identifier": sess.Identifier})
+
+	err := s.Sessions.Revoke(ctx, sess.ID)
+	if err != nil {
+		s.Logger.Error("can't revoke session", Fields{"err": err, "session": sess.ID})
+	}
+
+	return ErrRefreshToken
+}
+
+// LogoutHandler ...
+func LogoutHandler(body string) (string, error) {
+	return LogoutHandlerContext(context.Background(), body)
+}
+
+// LogoutHandlerContext LogoutHandler bounded by ctx
+func LogoutHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().LogoutHandler(ctx, body)
+}
+
+// LogoutHandler ...
+func (s Service) LogoutHandler(ctx context.Context, body string) (string, error) {
+	return s.logoutHandler(ctx, body, s.Logout)
+}
+
+// LogoutAllHandler ...
+func LogoutAllHandler(body string) (string, error) {
+	return LogoutAllHandlerContext(context.Background(), body)
+}
+
+// LogoutAllHandlerContext LogoutAllHandler bounded by ctx
+func LogoutAllHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().LogoutAllHandler(ctx, body)
+}
+
+// LogoutAllHandler ...
+func (s Service) LogoutAllHandler(ctx context.Context, body string) (string, error) {
+	return s.logoutHandler(ctx, body, s.LogoutAll)
+}
+
+func (s Service) logoutHandler(ctx context.Context, body string, logout func(ctx context.Context, token string) (LogoutObject, error)) (string, error) {
+	r := RefreshRequest{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall logout", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall logout: %w", WithKind(ErrValidation, err))
+	}
+
+	rf, err := logout(ctx, r.RefreshToken)
+	if err != nil {
+		s.Logger.Error("can't logout", Fields{"err": err})
+		return "", fmt.Errorf("can't logout: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall logout", Fields{"err": err, "response": rf})
+		return "", fmt.Errorf("can't marshall logout: %w", err)
+	}
+
+	return string(rfb), nil
+}
+
+// Logout ...
+func Logout(token string) (LogoutObject, error) {
+	return LogoutContext(context.Background(), token)
+}
+
+// LogoutContext Logout bounded by ctx
+func LogoutContext(ctx context.Context, token string) (LogoutObject, error) {
+	return NewService().Logout(ctx, token)
+}
+
+// Logout revoke the session the refresh token belongs to, access tokens
+// already issued for it last until they expire
+func (s Service) Logout(ctx context.Context, token string) (LogoutObject, error) {
+	if token == "" {
+		return LogoutObject{}, WithKind(ErrValidation, fmt.Errorf("missing refresh token"))
+	}
+
+	sess, ok, err := s.Sessions.Find(ctx, hashToken(token))
+	if err != nil {
+		return LogoutObject{}, fmt.Errorf("can't find session: %w", err)
+	}
+	if !ok {
+		return LogoutObject{}, ErrRefreshToken
+	}
+
+	err = s.Sessions.Revoke(ctx, sess.ID)
+	if err != nil {
+		return LogoutObject{}, fmt.Errorf("can't revoke session: %w", err)
+	}
+
+	return LogoutObject{
+		Status: "logged_out",
+	}, nil
+}
+
+// LogoutAll ...
+func LogoutAll(token string) (LogoutObject, error) {
+	return LogoutAllContext(context.Background(), token)
+}
+
+// LogoutAllContext LogoutAll bounded by ctx
+func LogoutAllContext(ctx context.Context, token string) (LogoutObject, error) {
+	return NewService().LogoutAll(ctx, token)
+}
+
+// LogoutAll revoke every session of the account the refresh token belongs to
+func (s Service) LogoutAll(ctx context.Context, token string) (LogoutObject, error) {
+	sess, err := s.currentSession(ctx, token)
+	if err != nil {
+		return LogoutObject{}, err
+	}
+
+	err = s.Sessions.RevokeAll(ctx, sess.Identifier)
+	if err != nil {
+		return LogoutObject{}, fmt.Errorf("can't revoke sessions: %w", err)
+	}
+
+	return LogoutObject{
+		Identifier: sess.Identifier,
+		Status:     "logged_out",
+	}, nil
+}
@@ -0,0 +1,155 @@
+package service_test
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// sessionService a service with its own sessions and a registered account
+func sessionService(t *testing.T) (service.Service, *time.Time) {
+	now := time.Now()
+	s := service.NewService()
+	s.Verifications = service.NewMemoryVerificationStore()
+	s.Sessions = service.NewMemorySessionStore()
+	s.Clock = func() time.Time {
+		return now
+	}
+
+	_, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	return s, &now
+}
+
+func sessionLogin(t *testing.T, s service.Service) service.LoginObject {
+	lo, err := s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	return lo
+}
+
+func TestRefresh(t *testing.T) {
+	s, _ := sessionService(t)
+	lo := sessionLogin(t, s)
+
+	tokens, err := s.Refresh(context.Background(), lo.RefreshToken)
+	assert.Nil(t, err)
+	assert.NotEqual(t, lo.RefreshToken, tokens.RefreshToken)
+	assert.NotEqual(t, lo.AccessToken, tokens.AccessToken)
+
+	first, err := s.Tokens.Parse(lo.AccessToken, time.Now())
+	assert.Nil(t, err)
+	claims, err := s.Tokens.Parse(tokens.AccessToken, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, lo.Identifier, claims.Subject)
+	assert.Equal(t, first.Session, claims.Session)
+	assert.Equal(t, lo.Permissions, claims.Permissions)
+
+	tokens, err = s.Refresh(context.Background(), tokens.RefreshToken)
+	assert.Nil(t, err)
+
+	// reusing a rotated token revokes the session, so the current one stops working too
+	_, err = s.Refresh(context.Background(), lo.RefreshToken)
+	assert.Equal(t, service.ErrRefreshToken, err)
+	_, err = s.Refresh(context.Background(), tokens.RefreshToken)
+	assert.Equal(t, service.ErrRefreshToken, err)
+
+	// other sessions aren't touched
+	other := sessionLogin(t, s)
+	_, err = s.Refresh(context.Background(), other.RefreshToken)
+	assert.Nil(t, err)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestRefreshExpired(t *testing.T) {
+	s, now := sessionService(t)
+	lo := sessionLogin(t, s)
+
+	*now = now.Add(s.Tokens.RefreshTTL)
+	_, err := s.Refresh(context.Background(), lo.RefreshToken)
+	assert.Equal(t, service.ErrRefreshToken, err)
+
+	_, err = s.Refresh(context.Background(), "unknown")
+	assert.Equal(t, service.ErrRefreshToken, err)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestRefreshUpstreamDown(t *testing.T) {
+	requireFakes(t)
+	s, _ := sessionService(t)
+	lo := sessionLogin(t, s)
+
+	// a failed refresh leaves the refresh token usable
+	permissionsService.Down("/retrieve", http.StatusBadGateway)
+	_, err := s.Refresh(context.Background(), lo.RefreshToken)
+	assert.NotNil(t, err)
+
+	_, err = s.Refresh(context.Background(), lo.RefreshToken)
+	assert.Nil(t, err)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestLogout(t *testing.T) {
+	s, _ := sessionService(t)
+	lo := sessionLogin(t, s)
+	other := sessionLogin(t, s)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/logout",
+		Body:     `{"refresh_token":"` + lo.RefreshToken + `"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, `{"status":"logged_out"}`, response.Body)
+
+	_, err = s.Refresh(context.Background(), lo.RefreshToken)
+	assert.Equal(t, service.ErrRefreshToken, err)
+	_, err = s.Refresh(context.Background(), other.RefreshToken)
+	assert.Nil(t, err)
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/logout",
+		Body:     `{"refresh_token":"unknown"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestLogoutAll(t *testing.T) {
+	s, _ := sessionService(t)
+	lo := sessionLogin(t, s)
+	other := sessionLogin(t, s)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/logout/all",
+		Body:     `{"refresh_token":"` + lo.RefreshToken + `"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, `{"identifier":"`+lo.Identifier+`","status":"logged_out"}`, response.Body)
+
+	for _, token := range []string{lo.RefreshToken, other.RefreshToken} {
+		_, err = s.Refresh(context.Background(), token)
+		assert.Equal(t, service.ErrRefreshToken, err)
+	}
+
+	deleteAccount(lo.Identifier)
+}
@@ -1,16 +1,13 @@
 package service
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	login "github.com/carprks/login/service"
 	permissions "github.com/carprks/permissions/service"
-	"io/ioutil"
-	"net/http"
-	"os"
 	"strings"
-	"time"
 )
 
 // RegisterObject ...
@@ -20,42 +17,265 @@ type RegisterObject struct {
 	Permissions []permissions.Permission `json:"permissions"`
 }
 
+// RegisterRequest a signup, Channel and Invite pick the role template
+type RegisterRequest struct {
+	login.RegisterRequest
+	Channel string `json:"channel,omitempty"`
+	Invite  string `json:"invite,omitempty"`
+}
+
 // RegisterHandler what is used by service
 func RegisterHandler(body string) (string, error) {
-	r := login.RegisterRequest{}
+	return RegisterHandlerContext(context.Background(), body)
+}
+
+// RegisterHandlerContext RegisterHandler bounded by ctx
+func RegisterHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().RegisterHandler(ctx, body)
+}
+
+// RegisterHandler what is used by service
+func (s Service) RegisterHandler(ctx context.Context, body string) (string, error) {
+	r := RegisterRequest{}
 	err := json.Unmarshal([]byte(body), &r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't unmarshall register: %v, %v", err, body))
-		return "", fmt.Errorf("can't unmarshall register: %w", err)
+		s.Logger.Error("can't unmarshall register", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall register: %w", WithKind(ErrValidation, err))
 	}
 
-	rf, err := Register(r)
+	rf, err := s.RegisterAs(ctx, r)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't register: %v, %v", err, r))
+		s.Logger.Error("can't register", Fields{"err": err, "request": r})
 		return "", fmt.Errorf("can't register: %w", err)
 	}
 
 	rfb, err := json.Marshal(rf)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't marshall register: %v, %v", err, rf))
-		return "", fmt.Errorf("can't unmarshall register: %w", err)
+		s.Logger.Error("can't marshall register", Fields{"err": err, "response": rf})
+		return "", fmt.Errorf("can't unmarshall register: %w", WithKind(ErrValidation, err))
 	}
 
 	return string(rfb), nil
 }
 
+// RegisterError is returned when a step of Register fails, it records the
+// compensation steps that were run to undo the steps that had succeeded
+type RegisterError struct {
+	Step          string   `json:"step"`
+	Compensations []string `json:"compensations,omitempty"`
+	Failed        []string `json:"failed,omitempty"`
+	CompensateErr error    `json:"-"`
+	Err           error    `json:"-"`
+}
+
+// Error ...
+func (e RegisterError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Step, e.Err)
+	if len(e.Compensations) >= 1 {
+		msg = fmt.Sprintf("%s, rolled back: %s", msg, strings.Join(e.Compensations, ", "))
+	}
+	if e.CompensateErr != nil {
+		msg = fmt.Sprintf("%s, rollback failed: %v", msg, e.CompensateErr)
+	}
+
+	return msg
+}
+
+// Unwrap ...
+func (e RegisterError) Unwrap() error {
+	return e.Err
+}
+
+// Partial whether the register left anything behind that couldn't be undone
+func (e RegisterError) Partial() bool {
+	return e.CompensateErr != nil
+}
+
+// compensateErrors every compensation that failed, errors.Is and errors.As
+// match any of them
+type compensateErrors []error
+
+// Error ...
+func (e compensateErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Is ...
+func (e compensateErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As ...
+func (e compensateErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type compensation struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+type registerSaga struct {
+	logger        *Logger
+	budget        Budget
+	compensations []compensation
+}
+
+func (s *registerSaga) onFailure(name string, undo func(ctx context.Context) error) {
+	s.compensations = append(s.compensations, compensation{
+		name: name,
+		undo: undo,
+	})
+}
+
+// fail run the compensations in reverse order of the steps that succeeded,
+// they get their own budget since the request's may be what ran out, one
+// failing doesn't stop the rest being tried
+func (s *registerSaga) fail(step string, err error) RegisterError {
+	re := RegisterError{
+		Step: step,
+		Err:  err,
+	}
+
+	ctx, cancel := s.budget.compensate()
+	defer cancel()
+
+	var errs compensateErrors
+	for i := len(s.compensations) - 1; i >= 0; i-- {
+		c := s.compensations[i]
+		cerr := c.undo(ctx)
+		if cerr != nil {
+			s.logger.Error("compensation failed", Fields{"err": cerr, "compensation": c.name})
+			re.Failed = append(re.Failed, c.name)
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, cerr))
+			continue
+		}
+		re.Compensations = append(re.Compensations, c.name)
+	}
+	if len(errs) >= 1 {
+		re.CompensateErr = errs
+	}
+
+	return re
+}
+
 // Register underlying functions
 func Register(r login.RegisterRequest) (RegisterObject, error) {
-	ro, err := CreateLogin(r)
+	return RegisterContext(context.Background(), r)
+}
+
+// RegisterContext Register bounded by ctx
+func RegisterContext(ctx context.Context, r login.RegisterRequest) (RegisterObject, error) {
+	return NewService().Register(ctx, r)
+}
+
+// Register underlying functions, the account gets the default role
+func (s Service) Register(ctx context.Context, r login.RegisterRequest) (RegisterObject, error) {
+	return s.register(ctx, r, s.Roles.Default)
+}
+
+// RegisterAs ...
+func RegisterAs(r RegisterRequest) (RegisterObject, error) {
+	return RegisterAsContext(context.Background(), r)
+}
+
+// RegisterAsContext RegisterAs bounded by ctx
+func RegisterAsContext(ctx context.Context, r RegisterRequest) (RegisterObject, error) {
+	return NewService().RegisterAs(ctx, r)
+}
+
+// RegisterAs register with the role the invite or signup channel picks
+func (s Service) RegisterAs(ctx context.Context, r RegisterRequest) (RegisterObject, error) {
+	role, err := s.Roles.Select(r.Channel, r.Invite)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't get create login: %v, %v", err, r))
-		return RegisterObject{}, fmt.Errorf("can't get create login: %w", err)
+		s.Logger.Info("register role refused", Fields{"err": err, "channel": r.Channel})
+		return RegisterObject{}, err
 	}
 
-	resp, err := CreatePermissions(ro)
+	return s.register(ctx, r.RegisterRequest, role)
+}
+
+func (s Service) register(ctx context.Context, r login.RegisterRequest, role string) (RegisterObject, error) {
+	typed := r.Email
+	r.Email = s.Emails.Normalise(r.Email)
+	err := s.Emails.Check(ctx, r.Email)
+	if err != nil {
+		s.Logger.Info("register email refused", Fields{"err": err})
+		return RegisterObject{}, err
+	}
+	err = s.Passwords.Check(r.Email, r.Password, r.Verify)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't create permissions: %v, %v", err, ro))
-		return RegisterObject{}, fmt.Errorf("can't create permissions: %w", err)
+		s.Logger.Info("register password refused", Fields{"err": err})
+		return RegisterObject{}, err
+	}
+	err = s.identifierTaken(login.GenerateIdent(r.Email))
+	if err != nil {
+		s.Logger.Info("register identifier taken", Fields{"err": err})
+		return RegisterObject{}, err
+	}
+	// the login service only refuses the normalised form, an account made
+	// before emails were normalised is under one of the others
+	for _, c := range s.Emails.Candidates(typed)[1:] {
+		_, err = s.LoginPermissions(ctx, login.Login{Identifier: login.GenerateIdent(c)})
+		if err == nil {
+			s.Logger.Info("register legacy email taken", nil)
+			return RegisterObject{}, WithKind(ErrConflict, fmt.Errorf("login already exists"))
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return RegisterObject{}, fmt.Errorf("can't get permissions: %w", err)
+		}
+	}
+
+	saga := registerSaga{
+		logger: s.Logger,
+		budget: s.Budget,
+	}
+
+	ro, err := s.CreateLogin(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't get create login", Fields{"err": err, "request": r})
+		return RegisterObject{}, saga.fail("can't get create login", err)
+	}
+	saga.onFailure("delete login", func(ctx context.Context) error {
+		return s.DeleteLogin(ctx, ro.Identifier)
+	})
+
+	// a create whose answer was lost can still have landed, left behind it
+	// would stop the email ever registering again
+	saga.onFailure("delete permissions", func(ctx context.Context) error {
+		return s.DeletePermissions(ctx, ro.Identifier)
+	})
+
+	resp, err := s.createPermissions(ctx, ro.Identifier, role)
+	if err != nil {
+		s.Logger.Error("can't create permissions", Fields{"err": err, "login": ro})
+		return RegisterObject{}, saga.fail("can't create permissions", err)
+	}
+
+	// verification can be resent so it doesn't fail the register
+	err = s.sendVerification(Verification{
+		Identifier: ro.Identifier,
+		Email:      ro.Email,
+	})
+	if err != nil {
+		s.Logger.Error("can't send verification", Fields{"err": err})
 	}
 
 	return RegisterObject{
@@ -67,102 +287,114 @@ func Register(r login.RegisterRequest) (RegisterObject, error) {
 
 // CreateLogin create the login
 func CreateLogin(r login.RegisterRequest) (login.Register, error) {
-	rr := login.Register{}
+	return CreateLoginContext(context.Background(), r)
+}
 
-	j, err := json.Marshal(&r)
-	if err != nil {
-		fmt.Println(fmt.Sprintf("can't marshall register: %v, %v", err, r))
-		return rr, fmt.Errorf("can't marshall register: %w", err)
-	}
+// CreateLoginContext CreateLogin bounded by ctx
+func CreateLoginContext(ctx context.Context, r login.RegisterRequest) (login.Register, error) {
+	return NewService().CreateLogin(ctx, r)
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/register", os.Getenv("SERVICE_LOGIN")), bytes.NewBuffer(j))
+// CreateLogin create the login
+func (s Service) CreateLogin(ctx context.Context, r login.RegisterRequest) (login.Register, error) {
+	// a retried register can only be told apart from a new one with a key
+	rt := login.Register{}
+	err := s.call(ctx, s.LoginUpstream, IdempotencyKey(ctx) != "", func(ctx context.Context) error {
+		var err error
+		rt, err = s.LoginClient.Register(ctx, r)
+		return err
+	})
 	if err != nil {
-		fmt.Println(fmt.Sprintf("req err: %v", err))
-		return rr, fmt.Errorf("create login req err: %w", err)
+		s.Logger.Error("create login err", Fields{"err": err})
+		return rt, err
 	}
 
-	req.Header.Set("X-Authorization", os.Getenv("AUTH_LOGIN"))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{
-		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     2 * time.Minute,
-		},
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(fmt.Sprintf("client err: %v", err))
-		return rr, fmt.Errorf("create login client err: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println(fmt.Sprintf("account resp err: %v", err))
-			return rr, fmt.Errorf("account resp err: %w", err)
-		}
-
-		rt := login.Register{}
-
-		err = json.Unmarshal(body, &rt)
-		if err != nil {
-			fmt.Println(fmt.Sprintf("can't unmarshal register body: %v, %v", err, string(body)))
-			return rt, fmt.Errorf("can't unmarshal register body: %w", err)
-		}
+	return rt, nil
+}
 
-		if rt.Error != "" {
-			if strings.Contains(rt.Error, "ErrCodeConditionalCheckFailedException") {
-				return rt, fmt.Errorf("login already exists")
-			}
-			return rt, fmt.Errorf("unknown login error: %w", rt.Error)
-		}
+// CreatePermissions ...
+func CreatePermissions(r login.Register) ([]permissions.Permission, error) {
+	return CreatePermissionsContext(context.Background(), r)
+}
 
-		return rt, nil
-	}
+// CreatePermissionsContext CreatePermissions bounded by ctx
+func CreatePermissionsContext(ctx context.Context, r login.Register) ([]permissions.Permission, error) {
+	return NewService().CreatePermissions(ctx, r)
+}
 
-	return rr, fmt.Errorf("can't create login")
+// CreatePermissions the permissions of the default role
+func (s Service) CreatePermissions(ctx context.Context, r login.Register) ([]permissions.Permission, error) {
+	return s.createPermissions(ctx, r.Identifier, s.Roles.Default)
 }
 
-// CreatePermissions ...
-func CreatePermissions(r login.Register) ([]permissions.Permission, error) {
+func (s Service) createPermissions(ctx context.Context, ident, role string) ([]permissions.Permission, error) {
+	perms, err := s.Roles.Render(role, ident)
+	if err != nil {
+		return []permissions.Permission{}, err
+	}
 	p := permissions.Permissions{
-		Identifier:  r.Identifier,
-		Permissions: getDefaultPerms(r.Identifier),
+		Identifier:  ident,
+		Permissions: perms,
 	}
 
-	j, err := json.Marshal(&p)
+	// a create isn't safe to send twice, one whose answer was lost is undone
+	// by the rollback instead
+	err = s.call(ctx, s.PermissionsUpstream, false, func(ctx context.Context) error {
+		_, err := s.PermissionsClient.Create(ctx, p)
+		return err
+	})
+	s.invalidatePermissions(ident)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("can't marshall permissions: %v, %v", err, p))
-		return []permissions.Permission{}, fmt.Errorf("can't unmarshall permissions: %w", err)
+		s.Logger.Error("create permissions err", Fields{"err": err})
+		return []permissions.Permission{}, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/create", os.Getenv("SERVICE_PERMISSIONS")), bytes.NewBuffer(j))
+	return p.Permissions, nil
+}
+
+// DeleteLogin remove the login, used to undo CreateLogin
+func DeleteLogin(ident string) error {
+	return DeleteLoginContext(context.Background(), ident)
+}
+
+// DeleteLoginContext DeleteLogin bounded by ctx
+func DeleteLoginContext(ctx context.Context, ident string) error {
+	return NewService().DeleteLogin(ctx, ident)
+}
+
+// DeleteLogin remove the login, used to undo CreateLogin
+func (s Service) DeleteLogin(ctx context.Context, ident string) error {
+	err := s.call(ctx, s.LoginUpstream, true, func(ctx context.Context) error {
+		return s.LoginClient.Delete(ctx, ident)
+	})
 	if err != nil {
-		fmt.Println(fmt.Sprintf("req err: %v", err))
-		return []permissions.Permission{}, fmt.Errorf("create permissions req err: %w", err)
+		s.Logger.Error("delete login err", Fields{"err": err})
+		return err
 	}
 
-	req.Header.Set("X-Authorization", os.Getenv("AUTH_PERMISSIONS"))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{
-		Timeout: time.Second * 30,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     2 * time.Minute,
-		},
-	}
-	resp, err := client.Do(req)
+	return nil
+}
+
+// DeletePermissions remove every permission of the identifier
+func DeletePermissions(ident string) error {
+	return DeletePermissionsContext(context.Background(), ident)
+}
+
+// DeletePermissionsContext DeletePermissions bounded by ctx
+func DeletePermissionsContext(ctx context.Context, ident string) error {
+	return NewService().DeletePermissions(ctx, ident)
+}
+
+// DeletePermissions remove every permission of the identifier
+func (s Service) DeletePermissions(ctx context.Context, ident string) error {
+	err := s.call(ctx, s.PermissionsUpstream, true, func(ctx context.Context) error {
+		return s.PermissionsClient.Delete(ctx, ident)
+	})
+	s.invalidatePermissions(ident)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("client err: %v", err))
-		return []permissions.Permission{}, fmt.Errorf("create permissions client err: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		return getDefaultPerms(r.Identifier), nil
+		s.Logger.Error("delete permissions err", Fields{"err": err})
+		return err
 	}
 
-	return []permissions.Permission{}, fmt.Errorf("can't create permissions")
+	return nil
 }
@@ -1,12 +1,14 @@
 package service_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/carprks/account/service"
 	login "github.com/carprks/login/service"
 	permissions "github.com/carprks/permissions/service"
-	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
-	"os"
+	"net/http"
 	"testing"
 )
 
@@ -20,8 +22,8 @@ var testsRegister = []struct {
 		name: "register: tester@carpark.ninja",
 		request: login.RegisterRequest{
 			Email:    "tester@carpark.ninja",
-			Password: "tester",
-			Verify:   "tester",
+			Password: "Carpark-Ninja-2019",
+			Verify:   "Carpark-Ninja-2019",
 		},
 		expect: service.RegisterObject{
 			Identifier: "5f46cf19-5399-55e3-aa62-0e7c19382250",
@@ -73,23 +75,12 @@ var testsRegister = []struct {
 }
 
 func TestRegister(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	for _, test := range testsRegister {
 		t.Run(test.name, func(t *testing.T) {
 			response, err := service.Register(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("register create register test err: %w, request: %v", err, test.request)
+				t.Errorf("register create register test err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -101,11 +92,11 @@ func TestRegister(t *testing.T) {
 			}
 			err = r.deleteLogin()
 			if err != nil {
-				t.Errorf("delete login: %w", err)
+				t.Errorf("delete login: %v", err)
 			}
 			err = r.deletePermission()
 			if err != nil {
-				t.Errorf("delete permission: %w", err)
+				t.Errorf("delete permission: %v", err)
 			}
 		})
 	}
@@ -114,17 +105,6 @@ func TestRegister(t *testing.T) {
 func BenchmarkRegister(b *testing.B) {
 	b.ReportAllocs()
 
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					b.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	b.ResetTimer()
 	for _, test := range testsRegister {
 		b.Run(test.name, func(t *testing.B) {
@@ -133,7 +113,7 @@ func BenchmarkRegister(b *testing.B) {
 			response, err := service.Register(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("register create register test err: %w, request: %v", err, test.request)
+				t.Errorf("register create register test err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -145,11 +125,11 @@ func BenchmarkRegister(b *testing.B) {
 			}
 			err = r.deleteLogin()
 			if err != nil {
-				t.Errorf("delete login: %w", err)
+				t.Errorf("delete login: %v", err)
 			}
 			err = r.deletePermission()
 			if err != nil {
-				t.Errorf("delete permission: %w", err)
+				t.Errorf("delete permission: %v", err)
 			}
 
 			t.StartTimer()
@@ -215,23 +195,12 @@ var testsCreatePermissions = []struct {
 }
 
 func TestCreatePermissions(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	for _, test := range testsCreatePermissions {
 		t.Run(test.name, func(t *testing.T) {
 			response, err := service.CreatePermissions(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("register create permissions test err: %w, request: %v", err, test.request)
+				t.Errorf("register create permissions test err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -243,7 +212,7 @@ func TestCreatePermissions(t *testing.T) {
 			}
 			err = r.deletePermission()
 			if err != nil {
-				t.Errorf("delete permission: %w", err)
+				t.Errorf("delete permission: %v", err)
 			}
 		})
 	}
@@ -252,17 +221,6 @@ func TestCreatePermissions(t *testing.T) {
 func BenchmarkCreatePermissionsa(b *testing.B) {
 	b.ReportAllocs()
 
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					b.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	b.ResetTimer()
 	for _, test := range testsCreatePermissions {
 		b.Run(test.name, func(t *testing.B) {
@@ -271,7 +229,7 @@ func BenchmarkCreatePermissionsa(b *testing.B) {
 			response, err := service.CreatePermissions(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("register create permissions test err: %w, request: %v", err, test.request)
+				t.Errorf("register create permissions test err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -283,7 +241,7 @@ func BenchmarkCreatePermissionsa(b *testing.B) {
 			}
 			err = r.deletePermission()
 			if err != nil {
-				t.Errorf("delete permission: %w", err)
+				t.Errorf("delete permission: %v", err)
 			}
 
 			t.StartTimer()
@@ -301,8 +259,8 @@ var testsCreateLogin = []struct {
 		name: "create login tester@carpark.ninia",
 		request: login.RegisterRequest{
 			Email:    "tester@carpark.ninja",
-			Password: "tester",
-			Verify:   "tester",
+			Password: "Carpark-Ninja-2019",
+			Verify:   "Carpark-Ninja-2019",
 		},
 		expect: login.Register{
 			Identifier: "5f46cf19-5399-55e3-aa62-0e7c19382250",
@@ -313,23 +271,12 @@ var testsCreateLogin = []struct {
 }
 
 func TestCreateLogin(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	for _, test := range testsCreateLogin {
 		t.Run(test.name, func(t *testing.T) {
 			response, err := service.CreateLogin(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("register create login test err: %w, request: %v", err, test.request)
+				t.Errorf("register create login test err: %v, request: %v", err, test.request)
 			}
 
 			passed = assert.Equal(t, test.expect, response)
@@ -342,7 +289,7 @@ func TestCreateLogin(t *testing.T) {
 			}
 			err = r.deleteLogin()
 			if err != nil {
-				t.Errorf("delete login: %w", err)
+				t.Errorf("delete login: %v", err)
 			}
 		})
 	}
@@ -351,17 +298,6 @@ func TestCreateLogin(t *testing.T) {
 func BenchmarkCreateLogin(b *testing.B) {
 	b.ReportAllocs()
 
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					b.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	b.ResetTimer()
 	for _, test := range testsCreateLogin {
 		b.Run(test.name, func(t *testing.B) {
@@ -370,7 +306,7 @@ func BenchmarkCreateLogin(b *testing.B) {
 			response, err := service.CreateLogin(test.request)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("register create login test err: %w, request: %v", err, test.request)
+				t.Errorf("register create login test err: %v, request: %v", err, test.request)
 			}
 
 			passed = assert.Equal(t, test.expect, response)
@@ -383,10 +319,123 @@ func BenchmarkCreateLogin(b *testing.B) {
 			}
 			err = r.deleteLogin()
 			if err != nil {
-				t.Errorf("delete login: %w", err)
+				t.Errorf("delete login: %v", err)
 			}
 
 			b.StartTimer()
 		})
 	}
 }
+
+func TestRegisterRollback(t *testing.T) {
+	requireFakes(t)
+	permissionsService.Fail("/create", http.StatusBadGateway)
+
+	response, err := service.Register(login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Equal(t, service.RegisterObject{}, response)
+	assert.Equal(t, 1, permissionsService.Calls("/create"))
+	assert.Equal(t, 1, loginService.Calls("/delete"))
+	assert.False(t, loginService.Exists("5f46cf19-5399-55e3-aa62-0e7c19382250"))
+
+	re := service.RegisterError{}
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, "can't create permissions", re.Step)
+		assert.Equal(t, []string{"delete permissions", "delete login"}, re.Compensations)
+		assert.False(t, re.Partial())
+		assert.Equal(t, "can't create permissions: can't create permissions, rolled back: delete permissions, delete login", err.Error())
+	}
+}
+
+// lostPermissions creates the permissions and then loses the answer
+type lostPermissions struct {
+	*memoryPermissions
+}
+
+func (l lostPermissions) Create(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	_, err := l.memoryPermissions.Create(ctx, p)
+	if err != nil {
+		return permissions.Permissions{}, err
+	}
+
+	return permissions.Permissions{}, service.WithKind(service.ErrUpstream, fmt.Errorf("create permissions came back with a different statuscode: 504"))
+}
+
+func TestRegisterRollbackLanded(t *testing.T) {
+	s, _, logins, perms, ident := deleteService(t, 0)
+	delete(logins.logins, ident)
+	delete(perms.perms, ident)
+	s.PermissionsClient = lostPermissions{perms.memoryPermissions}
+
+	_, err := s.Register(context.Background(), testsRegister[0].request)
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+	assert.Len(t, logins.logins, 0)
+	assert.Len(t, perms.perms, 0)
+
+	// nothing was left behind to stop the email registering
+	s.PermissionsClient = perms
+	resp, err := s.Register(context.Background(), testsRegister[0].request)
+	assert.Nil(t, err)
+	assert.Equal(t, ident, resp.Identifier)
+}
+
+func TestRegisterRollbackFailed(t *testing.T) {
+	requireFakes(t)
+	permissionsService.Fail("/create", http.StatusBadGateway)
+	for i := 0; i < service.RetryAttempts; i++ {
+		loginService.FailWith("/delete", `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","error":"ResourceNotFoundException"}`)
+	}
+
+	_, err := service.Register(login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+
+	re := service.RegisterError{}
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, "can't create permissions", re.Step)
+		assert.Equal(t, []string{"delete permissions"}, re.Compensations)
+		assert.Equal(t, []string{"delete login"}, re.Failed)
+		assert.True(t, re.Partial())
+	}
+
+	err = deleteAccount("5f46cf19-5399-55e3-aa62-0e7c19382250")
+	assert.Nil(t, err)
+}
+
+// downPermissions a permissions service whose creates and deletes both fail
+type downPermissions struct {
+	*memoryPermissions
+}
+
+func (d downPermissions) Create(ctx context.Context, p permissions.Permissions) (permissions.Permissions, error) {
+	return permissions.Permissions{}, service.WithKind(service.ErrUpstream, fmt.Errorf("create permissions came back with a different statuscode: 502"))
+}
+
+func (d downPermissions) Delete(ctx context.Context, ident string) error {
+	return service.WithKind(service.ErrUpstream, fmt.Errorf("delete permissions came back with a different statuscode: 502"))
+}
+
+func TestRegisterRollbackContinues(t *testing.T) {
+	s, _, logins, perms, ident := deleteService(t, 0)
+	delete(logins.logins, ident)
+	delete(perms.perms, ident)
+	s.PermissionsClient = downPermissions{perms.memoryPermissions}
+
+	_, err := s.Register(context.Background(), testsRegister[0].request)
+
+	// the permissions delete failing doesn't leave the login behind
+	re := service.RegisterError{}
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, "can't create permissions", re.Step)
+		assert.Equal(t, []string{"delete login"}, re.Compensations)
+		assert.Equal(t, []string{"delete permissions"}, re.Failed)
+		assert.True(t, re.Partial())
+		assert.True(t, errors.Is(re.CompensateErr, service.ErrUpstream))
+	}
+	assert.Len(t, logins.logins, 0)
+}
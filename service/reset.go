@@ -1,6 +1,378 @@
 package service
 
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	login "github.com/carprks/login/service"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ResetTTL how long a reset token can be used for
+	ResetTTL = time.Hour
+	// ResetLimit how many resets can be requested for an email within ResetWindow
+	ResetLimit = 3
+	// ResetWindow the period ResetLimit applies to
+	ResetWindow = time.Hour
+)
+
+// ResetRequest start a reset
+type ResetRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetConfirm finish a reset with the token that was sent
+type ResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+	Verify   string `json:"verify"`
+}
+
+// ResetObject ...
+type ResetObject struct {
+	Identifier string `json:"identifier,omitempty"`
+	Status     string `json:"status"`
+}
+
+// ResetToken a stored reset, only the hash of the token is kept
+type ResetToken struct {
+	Hash  string
+	Email string
+	// Typed the email as it was asked for, an account made before emails were
+	// normalised can be under it
+	Typed   string
+	Created time.Time
+	Expires time.Time
+	Used    bool
+}
+
+// ResetStore where reset tokens are kept between requests
+type ResetStore interface {
+	Save(t ResetToken) error
+	// Peek returns the token without using it
+	Peek(hash string) (ResetToken, error)
+	// Take returns the token and marks it used, so it can only be taken once
+	Take(hash string) (ResetToken, error)
+	// Requested how many tokens have been created for the email since
+	Requested(email string, since time.Time) (int, error)
+}
+
+// ErrResetToken the token doesn't exist, has expired or has been used
+var ErrResetToken = WithKind(ErrValidation, fmt.Errorf("invalid or expired token"))
+
+// newResetStore in the account table when there is one, a token can be
+// confirmed on another instance and every instance counts the same requests
+func newResetStore() ResetStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryResetStore()
+	}
+
+	return DynamoResetStore{table}
+}
+
+// MemoryResetStore reset store that lives as long as the lambda is warm
+type MemoryResetStore struct {
+	sync.Mutex
+	tokens map[string]ResetToken
+}
+
+// NewMemoryResetStore ...
+func NewMemoryResetStore() *MemoryResetStore {
+	return &MemoryResetStore{
+		tokens: map[string]ResetToken{},
+	}
+}
+
+// Save store the token, any older tokens for the email can no longer be used
+func (m *MemoryResetStore) Save(t ResetToken) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for hash, old := range m.tokens {
+		if old.Email == t.Email {
+			old.Used = true
+			m.tokens[hash] = old
+		}
+	}
+	m.tokens[t.Hash] = t
+
+	return nil
+}
+
+// Peek ...
+func (m *MemoryResetStore) Peek(hash string) (ResetToken, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	t, ok := m.tokens[hash]
+	if !ok || t.Used {
+		return ResetToken{}, ErrResetToken
+	}
+
+	return t, nil
+}
+
+// Take ...
+func (m *MemoryResetStore) Take(hash string) (ResetToken, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	t, ok := m.tokens[hash]
+	if !ok || t.Used {
+		return ResetToken{}, ErrResetToken
+	}
+	t.Used = true
+	m.tokens[hash] = t
+
+	return t, nil
+}
+
+// Requested ...
+func (m *MemoryResetStore) Requested(email string, since time.Time) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	count := 0
+	for hash, t := range m.tokens {
+		if t.Email != email {
+			continue
+		}
+		if t.Created.After(since) {
+			count++
+			continue
+		}
+		if t.Expires.Before(since) {
+			delete(m.tokens, hash)
+		}
+	}
+
+	return count, nil
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
 // ResetHandler ...
 func ResetHandler(body string) (string, error) {
-	return "", nil
+	return ResetHandlerContext(context.Background(), body)
+}
+
+// ResetHandlerContext ResetHandler bounded by ctx
+func ResetHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().ResetHandler(ctx, body)
+}
+
+// ResetHandler ...
+func (s Service) ResetHandler(ctx context.Context, body string) (string, error) {
+	r := ResetRequest{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall reset", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall reset: %w", WithKind(ErrValidation, err))
+	}
+
+	rf, err := s.Reset(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't reset", Fields{"err": err})
+		return "", fmt.Errorf("can't reset: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall reset", Fields{"err": err, "response": rf})
+		return "", fmt.Errorf("can't marshall reset: %w", err)
+	}
+
+	return string(rfb), nil
+}
+
+// Reset issue a reset token for the email, the response is the same
+// whether or not there is an account so it can't be used to find accounts
+func (s Service) Reset(ctx context.Context, r ResetRequest) (ResetObject, error) {
+	ro := ResetObject{
+		Status: "requested",
+	}
+	typed := strings.TrimSpace(r.Email)
+	r.Email = s.Emails.Normalise(r.Email)
+	if r.Email == "" {
+		return ResetObject{}, WithKind(ErrValidation, fmt.Errorf("missing email address"))
+	}
+
+	now := s.now()
+	count, err := s.Resets.Requested(r.Email, now.Add(-ResetWindow))
+	if err != nil {
+		return ResetObject{}, fmt.Errorf("reset requested: %w", err)
+	}
+	if count >= ResetLimit {
+		s.Logger.Info("reset limit reached", nil)
+		return ro, nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return ResetObject{}, fmt.Errorf("reset token: %w", err)
+	}
+
+	err = s.Resets.Save(ResetToken{
+		Hash:    hashToken(token),
+		Email:   r.Email,
+		Typed:   typed,
+		Created: now,
+		Expires: now.Add(ResetTTL),
+	})
+	if err != nil {
+		return ResetObject{}, fmt.Errorf("reset save: %w", err)
+	}
+
+	err = s.Notifier.Notify(Notification{
+		Type:  NotificationReset,
+		Email: r.Email,
+		Token: token,
+	})
+	if err != nil {
+		s.Logger.Error("reset notify err", Fields{"err": err})
+	}
+
+	return ro, nil
+}
+
+// ResetConfirmHandler ...
+func ResetConfirmHandler(body string) (string, error) {
+	return ResetConfirmHandlerContext(context.Background(), body)
+}
+
+// ResetConfirmHandlerContext ResetConfirmHandler bounded by ctx
+func ResetConfirmHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().ResetConfirmHandler(ctx, body)
+}
+
+// ResetConfirmHandler ...
+func (s Service) ResetConfirmHandler(ctx context.Context, body string) (string, error) {
+	r := ResetConfirm{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Info("can't unmarshall reset confirm", nil)
+		return "", fmt.Errorf("can't unmarshall reset confirm: %w", WithKind(ErrValidation, err))
+	}
+
+	rf, err := s.ResetConfirm(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't confirm reset", Fields{"err": err})
+		return "", fmt.Errorf("can't confirm reset: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall reset confirm", Fields{"err": err, "response": rf})
+		return "", fmt.Errorf("can't marshall reset confirm: %w", err)
+	}
+
+	return string(rfb), nil
+}
+
+// ResetConfirm use the token to set the new password, the token is only used
+// up once the password is set, so a policy refusal or an upstream failure can
+// be tried again with it
+func (s Service) ResetConfirm(ctx context.Context, r ResetConfirm) (ResetObject, error) {
+	hash := hashToken(r.Token)
+	t, err := s.Resets.Peek(hash)
+	if err != nil {
+		return ResetObject{}, err
+	}
+	if !s.now().Before(t.Expires) {
+		return ResetObject{}, ErrResetToken
+	}
+	err = s.Passwords.Check(t.Email, r.Password, r.Verify)
+	if err != nil {
+		return ResetObject{}, err
+	}
+
+	// setting the password registers the login again, which would make one
+	// for an email that never had an account
+	typed := t.Typed
+	if typed == "" {
+		typed = t.Email
+	}
+	ident, email, err := s.accountFor(ctx, typed)
+	if errors.Is(err, ErrNotFound) {
+		return ResetObject{}, ErrResetToken
+	}
+	if err != nil {
+		return ResetObject{}, err
+	}
+
+	_, err = s.setPassword(ctx, email, r.Password, "")
+	if err != nil {
+		s.Logger.Error("reset set password err", Fields{"err": err})
+		return ResetObject{}, fmt.Errorf("can't set password: %w", err)
+	}
+	_, err = s.Resets.Take(hash)
+	if err != nil {
+		// the password is set, a token used at the same time can lose the race
+		s.Logger.Error("reset take token err", Fields{"err": err})
+	}
+	s.unlock(t.Email)
+
+	return ResetObject{
+		Identifier: ident,
+		Status:     "reset",
+	}, nil
+}
+
+// setPassword the login service has no update, so the login is deleted and
+// registered again under the same key with the new password, previous puts
+// the old password back when registering again fails, without it or when that
+// fails too the login is lost, a reset token isn't used up until it works so
+// the holder can set it again
+func (s Service) setPassword(ctx context.Context, email, password, previous string) (login.Register, error) {
+	ident := login.GenerateIdent(email)
+	err := s.DeleteLogin(ctx, ident)
+	if err != nil {
+		return login.Register{}, fmt.Errorf("can't delete login: %w", err)
+	}
+
+	lr, err := s.CreateLogin(ctx, login.RegisterRequest{
+		Email:    email,
+		Password: password,
+		Verify:   password,
+	})
+	if err == nil {
+		return lr, nil
+	}
+
+	if previous != "" {
+		_, rerr := s.CreateLogin(ctx, login.RegisterRequest{
+			Email:    email,
+			Password: previous,
+			Verify:   previous,
+		})
+		if rerr == nil {
+			return login.Register{}, fmt.Errorf("can't create login: %w", err)
+		}
+		s.Logger.Error("can't restore login", Fields{"err": rerr})
+	}
+
+	s.Logger.Error("login lost", Fields{"err": err, "identifier": ident})
+	return login.Register{}, WithKind(ErrLoginLost, fmt.Errorf("can't create login: %w", err))
 }
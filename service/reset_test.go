@@ -1 +1,240 @@
 package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type captureNotifier struct {
+	sync.Mutex
+	sent []service.Notification
+}
+
+func (c *captureNotifier) Notify(n service.Notification) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+func (c *captureNotifier) last() service.Notification {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.sent) == 0 {
+		return service.Notification{}
+	}
+	return c.sent[len(c.sent)-1]
+}
+
+func TestReset(t *testing.T) {
+	notifier := &captureNotifier{}
+	s := service.NewService()
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	resp, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	if err != nil {
+		t.Errorf("reset register failed: %v", err)
+	}
+
+	body, err := s.ResetHandler(context.Background(), `{"email":"tester@carpark.ninja"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"status":"requested"}`, body)
+	token := notifier.last().Token
+	assert.Equal(t, service.NotificationReset, notifier.last().Type)
+	assert.NotEmpty(t, token)
+
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    token,
+		Password: "Spaced-0ut-Parking",
+		Verify:   "different",
+	})
+	assert.EqualError(t, err, "passwords don't match")
+
+	ro, err := s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    token,
+		Password: "Spaced-0ut-Parking",
+		Verify:   "Spaced-0ut-Parking",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, service.ResetObject{
+		Identifier: resp.Identifier,
+		Status:     "reset",
+	}, ro)
+
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Spaced-0ut-Parking",
+	})
+	assert.Nil(t, err)
+
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    token,
+		Password: "Another-Strong-Pass9",
+		Verify:   "Another-Strong-Pass9",
+	})
+	assert.Equal(t, service.ErrResetToken, err)
+
+	deleteAccount(resp.Identifier)
+}
+
+func TestResetUnknownAccount(t *testing.T) {
+	notifier := &captureNotifier{}
+	s := service.NewService()
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	body, err := s.ResetHandler(context.Background(), `{"email":"failure@carpark.ninja"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"status":"requested"}`, body)
+
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Error(t, err)
+}
+
+func TestResetUpstreamFailure(t *testing.T) {
+	s, _, logins, _, ident := deleteService(t, 0)
+	notifier := &captureNotifier{}
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	_, err := s.Reset(context.Background(), service.ResetRequest{Email: "tester@carpark.ninja"})
+	assert.Nil(t, err)
+	confirm := service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Spaced-0ut-Parking",
+		Verify:   "Spaced-0ut-Parking",
+	}
+
+	logins.fail = true
+	_, err = s.ResetConfirm(context.Background(), confirm)
+	assert.True(t, errors.Is(err, service.ErrUpstream))
+
+	// the token wasn't used up by the failure
+	logins.fail = false
+	ro, err := s.ResetConfirm(context.Background(), confirm)
+	assert.Nil(t, err)
+	assert.Equal(t, ident, ro.Identifier)
+	assert.Equal(t, "Spaced-0ut-Parking", logins.logins[ident].Password)
+
+	_, err = s.ResetConfirm(context.Background(), confirm)
+	assert.Equal(t, service.ErrResetToken, err)
+}
+
+func TestResetLoginLost(t *testing.T) {
+	s, _, logins, _, ident := deleteService(t, 0)
+	notifier := &captureNotifier{}
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	_, err := s.Reset(context.Background(), service.ResetRequest{Email: "tester@carpark.ninja"})
+	assert.Nil(t, err)
+	confirm := service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Spaced-0ut-Parking",
+		Verify:   "Spaced-0ut-Parking",
+	}
+
+	// deleted but not registered again
+	logins.failCreate = true
+	_, err = s.ResetConfirm(context.Background(), confirm)
+	assert.True(t, errors.Is(err, service.ErrLoginLost))
+	_, ok := logins.logins[ident]
+	assert.False(t, ok)
+
+	// the token can still put it back
+	logins.failCreate = false
+	ro, err := s.ResetConfirm(context.Background(), confirm)
+	assert.Nil(t, err)
+	assert.Equal(t, ident, ro.Identifier)
+	assert.Equal(t, "Spaced-0ut-Parking", logins.logins[ident].Password)
+}
+
+func TestResetExpired(t *testing.T) {
+	notifier := &captureNotifier{}
+	now := time.Now()
+	s := service.NewService()
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+	s.Clock = func() time.Time {
+		return now
+	}
+
+	_, err := s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+
+	now = now.Add(service.ResetTTL)
+	_, err = s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    notifier.last().Token,
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Equal(t, service.ErrResetToken, err)
+}
+
+func TestResetLimit(t *testing.T) {
+	notifier := &captureNotifier{}
+	now := time.Now()
+	s := service.NewService()
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+	s.Clock = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < service.ResetLimit+2; i++ {
+		ro, err := s.Reset(context.Background(), service.ResetRequest{
+			Email: "tester@carpark.ninja",
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "requested", ro.Status)
+	}
+	assert.Len(t, notifier.sent, service.ResetLimit)
+
+	now = now.Add(service.ResetWindow + time.Minute)
+	_, err := s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, notifier.sent, service.ResetLimit+1)
+}
+
+func TestResetOnlyLatestToken(t *testing.T) {
+	notifier := &captureNotifier{}
+	s := service.NewService()
+	s.Resets = service.NewMemoryResetStore()
+	s.Notifier = notifier
+
+	_, _ = s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+	first := notifier.last().Token
+	_, _ = s.Reset(context.Background(), service.ResetRequest{
+		Email: "tester@carpark.ninja",
+	})
+
+	_, err := s.ResetConfirm(context.Background(), service.ResetConfirm{
+		Token:    first,
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Equal(t, service.ErrResetToken, err)
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"fmt"
+	permissions "github.com/carprks/permissions/service"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RoleIdentifier the placeholder replaced with the new account's identifier
+const RoleIdentifier = "{identifier}"
+
+// defaultRoleTemplates used when ROLE_TEMPLATES and ROLE_TEMPLATES_FILE aren't set
+const defaultRoleTemplates = `
+default: driver
+channels:
+  web: driver
+  app: driver
+roles:
+  driver:
+    - {name: account, action: login, identifier: "{identifier}"}
+    - {name: account, action: edit, identifier: "{identifier}"}
+    - {name: account, action: view, identifier: "{identifier}"}
+    - {name: payments, action: create, identifier: "{identifier}"}
+    - {name: payments, action: view, identifier: "{identifier}"}
+    - {name: payments, action: report, identifier: "{identifier}"}
+    - {name: carparks, action: book, identifier: "*"}
+    - {name: carparks, action: report, identifier: "*"}
+  carpark-operator:
+    - {name: account, action: login, identifier: "{identifier}"}
+    - {name: account, action: edit, identifier: "{identifier}"}
+    - {name: account, action: view, identifier: "{identifier}"}
+    - {name: payments, action: view, identifier: "{identifier}"}
+    - {name: carparks, action: manage, identifier: "{identifier}"}
+    - {name: carparks, action: report, identifier: "{identifier}"}
+  fleet-manager:
+    - {name: account, action: login, identifier: "{identifier}"}
+    - {name: account, action: edit, identifier: "{identifier}"}
+    - {name: account, action: view, identifier: "{identifier}"}
+    - {name: payments, action: create, identifier: "{identifier}"}
+    - {name: payments, action: view, identifier: "{identifier}"}
+    - {name: payments, action: report, identifier: "{identifier}"}
+    - {name: fleet, action: manage, identifier: "{identifier}"}
+    - {name: carparks, action: book, identifier: "*"}
+    - {name: carparks, action: report, identifier: "*"}
+  support:
+    - {name: account, action: login, identifier: "{identifier}"}
+    - {name: account, action: view, identifier: "*"}
+    - {name: payments, action: view, identifier: "*"}
+    - {name: carparks, action: report, identifier: "*"}
+`
+
+// RoleTemplates the permissions a new account gets, picked by the channel it
+// signed up through or the invite it was given
+type RoleTemplates struct {
+	// Default the role when there is no channel or invite
+	Default string `yaml:"default" json:"default"`
+	// Channels signup channel to role
+	Channels map[string]string `yaml:"channels" json:"channels"`
+	// Invites invite code to role, the document is a secret when it has any
+	Invites map[string]string `yaml:"invites" json:"invites"`
+	// Roles role to permissions, RoleIdentifier is replaced in each identifier
+	Roles map[string][]RolePermission `yaml:"roles" json:"roles"`
+}
+
+// RolePermission a permission in a template
+type RolePermission struct {
+	Name       string `yaml:"name" json:"name"`
+	Action     string `yaml:"action" json:"action"`
+	Identifier string `yaml:"identifier" json:"identifier"`
+}
+
+// ParseRoleTemplates read and validate a YAML or JSON document
+func ParseRoleTemplates(doc []byte) (RoleTemplates, error) {
+	rt := RoleTemplates{}
+	err := yaml.UnmarshalStrict(doc, &rt)
+	if err != nil {
+		return RoleTemplates{}, fmt.Errorf("can't parse role templates: %w", err)
+	}
+
+	err = rt.Validate()
+	if err != nil {
+		return RoleTemplates{}, err
+	}
+
+	return rt, nil
+}
+
+// NewRoleTemplates the templates in ROLE_TEMPLATES, or the file in
+// ROLE_TEMPLATES_FILE, otherwise the built in ones
+func NewRoleTemplates() (RoleTemplates, error) {
+	doc := []byte(os.Getenv("ROLE_TEMPLATES"))
+	if file := os.Getenv("ROLE_TEMPLATES_FILE"); len(doc) == 0 && file != "" {
+		var err error
+		doc, err = ioutil.ReadFile(file)
+		if err != nil {
+			return RoleTemplates{}, fmt.Errorf("can't read role templates: %w", err)
+		}
+	}
+	if len(doc) == 0 {
+		doc = []byte(defaultRoleTemplates)
+	}
+
+	return ParseRoleTemplates(doc)
+}
+
+// roleTemplates loaded once, main checks NewRoleTemplates before starting so
+// a broken document stops the deploy rather than falling back here
+var roleTemplates = func() RoleTemplates {
+	rt, err := NewRoleTemplates()
+	if err != nil {
+		DefaultLogger.Error("can't load role templates, using defaults", Fields{"err": err})
+		rt, _ = ParseRoleTemplates([]byte(defaultRoleTemplates))
+	}
+
+	return rt
+}()
+
+// Validate every role is usable and everything points at a role that exists
+func (rt RoleTemplates) Validate() error {
+	errs := []string{}
+
+	if len(rt.Roles) == 0 {
+		errs = append(errs, "no roles")
+	}
+	if _, ok := rt.Roles[rt.Default]; !ok {
+		errs = append(errs, fmt.Sprintf("default role %q doesn't exist", rt.Default))
+	}
+	for _, by := range []struct {
+		kind  string
+		roles map[string]string
+	}{{"channel", rt.Channels}, {"invite", rt.Invites}} {
+		for from, role := range by.roles {
+			if _, ok := rt.Roles[role]; !ok {
+				errs = append(errs, fmt.Sprintf("%s %q role %q doesn't exist", by.kind, from, role))
+			}
+		}
+	}
+
+	for name, perms := range rt.Roles {
+		if len(perms) == 0 {
+			errs = append(errs, fmt.Sprintf("role %q has no permissions", name))
+		}
+		for i, p := range perms {
+			if p.Name == "" || p.Action == "" || p.Identifier == "" {
+				errs = append(errs, fmt.Sprintf("role %q permission %d needs a name, action and identifier", name, i))
+			}
+			if strings.ContainsAny(strings.Replace(p.Identifier, RoleIdentifier, "", -1), "{}") {
+				errs = append(errs, fmt.Sprintf("role %q permission %d has an unknown placeholder: %s", name, i, p.Identifier))
+			}
+		}
+	}
+
+	if len(errs) >= 1 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid role templates: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// Select the role for a signup, an invite wins over the channel
+func (rt RoleTemplates) Select(channel, invite string) (string, error) {
+	if invite != "" {
+		role, ok := rt.Invites[invite]
+		if !ok {
+			return "", ValidationError{
+				Fields: []FieldError{
+					{
+						Field:   "invite",
+						Code:    "invalid",
+						Message: "invalid invite",
+					},
+				},
+			}
+		}
+		return role, nil
+	}
+
+	if channel != "" {
+		role, ok := rt.Channels[channel]
+		if !ok {
+			return "", ValidationError{
+				Fields: []FieldError{
+					{
+						Field:   "channel",
+						Code:    "invalid",
+						Message: fmt.Sprintf("unknown channel: %s", channel),
+					},
+				},
+			}
+		}
+		return role, nil
+	}
+
+	return rt.Default, nil
+}
+
+// Render the permissions role grants ident, it doesn't create anything so it
+// can be used to see what a template would do
+func (rt RoleTemplates) Render(role, ident string) ([]permissions.Permission, error) {
+	perms, ok := rt.Roles[role]
+	if !ok {
+		return nil, WithKind(ErrNotFound, fmt.Errorf("unknown role: %s", role))
+	}
+
+	out := []permissions.Permission{}
+	for _, p := range perms {
+		out = append(out, permissions.Permission{
+			Name:       p.Name,
+			Action:     p.Action,
+			Identifier: strings.Replace(p.Identifier, RoleIdentifier, ident, -1),
+		})
+	}
+
+	return out, nil
+}
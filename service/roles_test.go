@@ -0,0 +1,187 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"testing"
+)
+
+const testRoleTemplates = `{
+	"default": "driver",
+	"channels": {"web": "driver", "operators": "carpark-operator"},
+	"invites": {"OPS-2019": "carpark-operator"},
+	"roles": {
+		"driver": [
+			{"name": "account", "action": "login", "identifier": "{identifier}"}
+		],
+		"carpark-operator": [
+			{"name": "account", "action": "login", "identifier": "{identifier}"},
+			{"name": "carparks", "action": "manage", "identifier": "{identifier}"}
+		]
+	}
+}`
+
+func TestRoleTemplatesDefault(t *testing.T) {
+	rt, err := service.NewRoleTemplates()
+	assert.Nil(t, err)
+
+	// the built in driver role is what every account used to get
+	perms, err := rt.Render(rt.Default, testsRegister[0].expect.Identifier)
+	assert.Nil(t, err)
+	assert.Equal(t, testsRegister[0].expect.Permissions, perms)
+
+	for _, role := range []string{"driver", "carpark-operator", "fleet-manager", "support"} {
+		_, err = rt.Render(role, "ident")
+		assert.Nil(t, err, role)
+	}
+
+	_, err = rt.Render("unknown", "ident")
+	assert.True(t, errors.Is(err, service.ErrNotFound))
+}
+
+func TestRoleTemplatesValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		err  string
+	}{
+		{
+			name: "json",
+			doc:  testRoleTemplates,
+		},
+		{
+			name: "yaml",
+			doc: `
+default: driver
+roles:
+  driver:
+    - {name: account, action: login, identifier: "{identifier}"}
+`,
+		},
+		{
+			name: "not a document",
+			doc:  `roles: [`,
+			err:  "can't parse role templates: yaml: line 1: did not find expected node content",
+		},
+		{
+			name: "unknown field",
+			doc:  `{"default": "driver", "role": {}}`,
+			err:  "can't parse role templates: yaml: unmarshal errors:\n  line 1: field role not found in type service.RoleTemplates",
+		},
+		{
+			name: "missing roles",
+			doc: `
+default: driver
+channels: {web: nobody}
+roles:
+  driver: []
+`,
+			err: `invalid role templates: channel "web" role "nobody" doesn't exist, role "driver" has no permissions`,
+		},
+		{
+			name: "bad permissions",
+			doc: `
+default: admin
+roles:
+  driver:
+    - {name: account, identifier: "{identifier}"}
+    - {name: account, action: view, identifier: "{ident}"}
+`,
+			err: `invalid role templates: default role "admin" doesn't exist, role "driver" permission 0 needs a name, action and identifier, role "driver" permission 1 has an unknown placeholder: {ident}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := service.ParseRoleTemplates([]byte(test.doc))
+			if test.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+}
+
+func TestRoleTemplatesEnv(t *testing.T) {
+	_ = os.Setenv("ROLE_TEMPLATES", testRoleTemplates)
+	defer os.Unsetenv("ROLE_TEMPLATES")
+
+	rt, err := service.NewRoleTemplates()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"OPS-2019": "carpark-operator"}, rt.Invites)
+
+	_ = os.Setenv("ROLE_TEMPLATES", `{"default": "nobody"}`)
+	_, err = service.NewRoleTemplates()
+	assert.NotNil(t, err)
+}
+
+func TestRoleTemplatesSelect(t *testing.T) {
+	rt, err := service.ParseRoleTemplates([]byte(testRoleTemplates))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		channel string
+		invite  string
+		role    string
+		err     bool
+	}{
+		{role: "driver"},
+		{channel: "web", role: "driver"},
+		{channel: "operators", role: "carpark-operator"},
+		{channel: "web", invite: "OPS-2019", role: "carpark-operator"},
+		{channel: "unknown", err: true},
+		{invite: "guessed", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.channel+"/"+test.invite, func(t *testing.T) {
+			role, err := rt.Select(test.channel, test.invite)
+			assert.Equal(t, test.err, err != nil)
+			assert.Equal(t, test.role, role)
+		})
+	}
+}
+
+func TestRegisterRole(t *testing.T) {
+	requireFakes(t)
+
+	s := service.NewService()
+	rt, err := service.ParseRoleTemplates([]byte(testRoleTemplates))
+	assert.Nil(t, err)
+	s.Roles = rt
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/register",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","verify":"Carpark-Ninja-2019","invite":"guessed"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, 0, loginService.Calls("/register"))
+
+	response, err = s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/register",
+		Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","verify":"Carpark-Ninja-2019","invite":"OPS-2019"}`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	ident := testsRegister[0].expect.Identifier
+	perms, err := s.LoginPermissions(context.Background(), login.Login{
+		Identifier: ident,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []permissions.Permission{
+		{Name: "account", Action: "login", Identifier: ident},
+		{Name: "carparks", Action: "manage", Identifier: ident},
+	}, perms)
+
+	deleteAccount(ident)
+}
@@ -1,40 +1,266 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
-func retn() (string, error) {
-	return "", nil
+// Service the account service and the upstreams it talks to
+type Service struct {
+	LoginClient       LoginClient
+	PermissionsClient PermissionsClient
+
+	LoginUpstream       Upstream
+	PermissionsUpstream Upstream
+
+	Resets   ResetStore
+	Notifier Notifier
+
+	Verification  VerifyConfig
+	Verifications VerificationStore
+
+	Tokens   TokenConfig
+	Sessions SessionStore
+	MFAs     MFAStore
+
+	Lockout   Lockout
+	Attempts  AttemptStore
+	Passwords PasswordPolicy
+	Emails    EmailPolicy
+	Roles     RoleTemplates
+	// Identities the login each account is under once its email has changed,
+	// nil refuses email changes
+	Identities   IdentityStore
+	EmailChanges EmailChangeStore
+
+	Deletion  DeleteConfig
+	Deletions DeletionStore
+	Exports   ExportStore
+	// ExportSources data held elsewhere that goes in an export
+	ExportSources []ExportSource
+
+	Batch AllowedBatchConfig
+	// Cache answer Allowed locally, nil asks the permissions service every time
+	Cache *PermissionsCache
+
+	Logger *Logger
+	Budget Budget
+
+	// Clock defaults to time.Now
+	Clock func() time.Time
+}
+
+// stores kept across invocations of a warm lambda
+var (
+	resets        = newResetStore()
+	verifications = newVerificationStore()
+	sessions      = newSessionStore()
+	mfas          = newMFAStore()
+	attempts      = newAttemptStore()
+	permsCache    = newPermissionsCache()
+	deletions     = newDeletionStore()
+	exports       = newExportStore()
+	identities    = newIdentityStore()
+	emailChanges  = newEmailChangeStore()
+)
+
+// NewService service talking to the upstreams set in the environment
+func NewService() Service {
+	return Service{
+		LoginClient: HTTPLoginClient{
+			Address: os.Getenv("SERVICE_LOGIN"),
+			Auth:    os.Getenv("AUTH_LOGIN"),
+			Client:  NewHTTPClient(time.Second * 10),
+		},
+		PermissionsClient: HTTPPermissionsClient{
+			Address: os.Getenv("SERVICE_PERMISSIONS"),
+			Auth:    os.Getenv("AUTH_PERMISSIONS"),
+			Client:  NewHTTPClient(time.Second * 30),
+		},
+		LoginUpstream: Upstream{
+			Name:    "login",
+			Retry:   NewRetry(),
+			Breaker: loginBreaker,
+		},
+		PermissionsUpstream: Upstream{
+			Name:    "permissions",
+			Retry:   NewRetry(),
+			Breaker: permissionsBreaker,
+		},
+		Resets:        resets,
+		Notifier:      notify,
+		Logger:        DefaultLogger,
+		Budget:        NewBudget(),
+		Verification:  verifyConfig,
+		Verifications: verifications,
+		Tokens:        tokenConfig(),
+		Sessions:      sessions,
+		MFAs:          mfas,
+		Lockout:       NewLockout(),
+		Attempts:      attempts,
+		Passwords:     NewPasswordPolicy(),
+		Emails:        NewEmailPolicy(),
+		Roles:         roleTemplates,
+		Batch:         NewAllowedBatchConfig(),
+		Cache:         permsCache,
+		Deletion:      NewDeleteConfig(),
+		Deletions:     deletions,
+		Exports:       exports,
+		ExportSources: exportSources(),
+		Identities:    identities,
+		EmailChanges:  emailChanges,
+	}
+}
+
+// CheckConfig what NewService needs from the environment, the entrypoints run
+// it before starting so a bad deploy fails there rather than on each request
+func CheckConfig() error {
+	// a broken template document should fail the deploy, not every register
+	_, err := NewRoleTemplates()
+	if err != nil {
+		return fmt.Errorf("role templates: %w", err)
+	}
+	// nor should a missing key or table, tokens signed by one instance have to
+	// be accepted by the others
+	_, err = NewTokenConfig()
+	if err != nil {
+		return fmt.Errorf("token config: %w", err)
+	}
+	_, err = NewVerifyConfig()
+	if err != nil {
+		return fmt.Errorf("verify config: %w", err)
+	}
+	// tokens only reach account holders through the notify service
+	_, err = NewNotifier()
+	if err != nil {
+		return fmt.Errorf("notifier: %w", err)
+	}
+	_, err = NewExportSources()
+	if err != nil {
+		return fmt.Errorf("export sources: %w", err)
+	}
+	err = CheckStores()
+	if err != nil {
+		return fmt.Errorf("stores: %w", err)
+	}
+
+	return nil
+}
+
+func (s Service) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+
+	return s.Clock()
+}
+
+// Handler ...
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return NewService().Handler(ctx, request)
 }
 
 // Handler ...
-func Handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	resp, err := retn()
+func (s Service) Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, cancel := s.Budget.request(ctx)
+	defer cancel()
+	ctx = WithIdempotencyKey(ctx, idempotencyHeader(request.Headers))
+	ctx = WithSourceIP(ctx, request.RequestContext.Identity.SourceIP)
+	ctx = WithAccessToken(ctx, bearerToken(request.Headers))
+
+	var resp string
+	var err error
 
 	switch request.Resource {
 	case "/login":
-		resp, err = LoginHandler(request.Body)
+		resp, err = s.LoginHandler(ctx, request.Body)
 	case "/register":
-		resp, err = RegisterHandler(request.Body)
+		resp, err = s.RegisterHandler(ctx, request.Body)
 	case "/reset":
-		resp, err = ResetHandler(request.Body)
+		resp, err = s.ResetHandler(ctx, request.Body)
+	case "/reset/confirm":
+		resp, err = s.ResetConfirmHandler(ctx, request.Body)
 	case "/verify":
-		resp, err = VerifyHandler(request.Body)
+		resp, err = s.VerifyHandler(ctx, request.Body)
+	case "/verify/resend":
+		resp, err = s.VerifyResendHandler(ctx, request.Body)
 	case "/allowed":
-		resp, err = AllowedHandler(request.Body)
+		resp, err = s.AllowedHandler(ctx, request.Body)
+	case "/allowed/explain":
+		resp, err = s.AllowedExplainHandler(ctx, request.Body)
+	case "/allowed/batch":
+		resp, err = s.AllowedBatchHandler(ctx, request.Body)
+	case "/delete":
+		resp, err = s.DeleteHandler(ctx, request.Body)
+	case "/delete/cancel":
+		resp, err = s.DeleteCancelHandler(ctx, request.Body)
+	case "/export":
+		resp, err = s.ExportHandler(ctx, request.Body)
+	case "/export/download":
+		return s.ExportDownloadResponse(ctx, request), nil
+	case "/password":
+		resp, err = s.PasswordHandler(ctx, request.Body)
+	case "/email/change":
+		resp, err = s.EmailChangeHandler(ctx, request.Body)
+	case "/email/confirm":
+		resp, err = s.EmailConfirmHandler(ctx, request.Body)
+	case "/login/mfa":
+		resp, err = s.MFALoginHandler(ctx, request.Body)
+	case "/mfa/enrol":
+		resp, err = s.MFAEnrolHandler(ctx, request.Body)
+	case "/mfa/confirm":
+		resp, err = s.MFAConfirmHandler(ctx, request.Body)
+	case "/mfa/disable":
+		resp, err = s.MFADisableHandler(ctx, request.Body)
+	case "/token/refresh":
+		resp, err = s.RefreshHandler(ctx, request.Body)
+	case "/logout":
+		resp, err = s.LogoutHandler(ctx, request.Body)
+	case "/logout/all":
+		resp, err = s.LogoutAllHandler(ctx, request.Body)
+	case "/.well-known/jwks.json":
+		resp, err = s.JWKSHandler(ctx)
+	default:
+		err = WithKind(ErrNotFound, fmt.Errorf("unknown resource: %s", request.Resource))
 	}
 
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       err.Error(),
-		}, nil
+		return s.errorResponse(request, err), nil
 	}
 
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
+		Headers:    jsonHeaders(),
 		Body:       resp,
 	}, nil
 }
+
+// idempotencyHeader api gateway passes headers through as they were sent
+func idempotencyHeader(headers map[string]string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, "Idempotency-Key") {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// bearerToken the access token from Authorization, X-Authorization is taken
+// by the api gateway authorizer
+func bearerToken(headers map[string]string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, "Authorization") {
+			if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+				return strings.TrimSpace(v[7:])
+			}
+		}
+	}
+
+	return ""
+}
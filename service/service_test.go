@@ -2,7 +2,9 @@ package service_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/carprks/account/service"
@@ -14,6 +16,52 @@ import (
 	"time"
 )
 
+var (
+	loginService       *fakeLogin
+	permissionsService *fakePermissions
+)
+
+// TestMain runs against local fakes of the upstreams, pass localDev to use
+// the services in .env instead
+func TestMain(m *testing.M) {
+	for _, env := range os.Args {
+		if env == "localDev" {
+			err := godotenv.Load()
+			if err != nil {
+				fmt.Println(fmt.Sprintf("godotenv err: %v", err))
+				os.Exit(1)
+			}
+			os.Exit(m.Run())
+		}
+	}
+
+	loginService = newFakeLogin("login-auth")
+	permissionsService = newFakePermissions("permissions-auth")
+	_ = os.Setenv("SERVICE_LOGIN", loginService.URL)
+	_ = os.Setenv("AUTH_LOGIN", "login-auth")
+	_ = os.Setenv("SERVICE_PERMISSIONS", permissionsService.URL)
+	_ = os.Setenv("AUTH_PERMISSIONS", "permissions-auth")
+	_ = os.Setenv("TOKEN_KEY", "token-key")
+
+	code := m.Run()
+	loginService.Close()
+	permissionsService.Close()
+	os.Exit(code)
+}
+
+// requireFakes skip tests that script the upstreams when running against real ones
+func requireFakes(t *testing.T) {
+	if loginService == nil {
+		t.Skip("needs the fake upstreams")
+	}
+	loginService.Reset()
+	permissionsService.Reset()
+
+	s := service.NewService()
+	s.LoginUpstream.Breaker.Reset()
+	s.PermissionsUpstream.Breaker.Reset()
+}
+
 type resp struct {
 	Identifier string `json:"identifier"`
 	Status     string `json:"status"`
@@ -30,12 +78,12 @@ func deleteAccount(ident string) error {
 
 	err := r.deleteLogin()
 	if err != nil {
-		return fmt.Errorf("delete account login: %w", err)
+		return fmt.Errorf("delete account login: %v", err)
 	}
 
 	err = r.deletePermission()
 	if err != nil {
-		return fmt.Errorf("delete account permssions: %w", err)
+		return fmt.Errorf("delete account permssions: %v", err)
 	}
 
 	return nil
@@ -44,12 +92,12 @@ func deleteAccount(ident string) error {
 func (r Remove) deleteLogin() error {
 	j, err := json.Marshal(&r)
 	if err != nil {
-		return fmt.Errorf("delete login marshall: %w", err)
+		return fmt.Errorf("delete login marshall: %v", err)
 	}
 
 	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/delete", os.Getenv("SERVICE_LOGIN")), bytes.NewBuffer(j))
 	if err != nil {
-		return fmt.Errorf("login remove req err: %w", err)
+		return fmt.Errorf("login remove req err: %v", err)
 	}
 
 	req.Header.Set("X-Authorization", os.Getenv("AUTH_LOGIN"))
@@ -64,7 +112,7 @@ func (r Remove) deleteLogin() error {
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("login remove client err: %w", err)
+		return fmt.Errorf("login remove client err: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -74,12 +122,12 @@ func (r Remove) deleteLogin() error {
 func (r Remove) deletePermission() error {
 	j, err := json.Marshal(&r)
 	if err != nil {
-		return fmt.Errorf("delete permissions marshall: %w", err)
+		return fmt.Errorf("delete permissions marshall: %v", err)
 	}
 
 	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/delete", os.Getenv("SERVICE_PERMISSIONS")), bytes.NewBuffer(j))
 	if err != nil {
-		return fmt.Errorf("permissions remove req err: %w", err)
+		return fmt.Errorf("permissions remove req err: %v", err)
 	}
 
 	req.Header.Set("X-Authorization", os.Getenv("AUTH_PERMISSIONS"))
@@ -94,7 +142,7 @@ func (r Remove) deletePermission() error {
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("permissions remove client err: %w", err)
+		return fmt.Errorf("permissions remove client err: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -112,10 +160,11 @@ var testsService = []struct {
 		name: "register success",
 		request: events.APIGatewayProxyRequest{
 			Resource: "/register",
-			Body:     `{"email":"tester@carpark.ninja","password":"tester","verify":"tester"}`,
+			Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","verify":"Carpark-Ninja-2019"}`,
 		},
 		expect: events.APIGatewayProxyResponse{
 			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "application/json"},
 			Body:       `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","email":"tester@carpark.ninja","permissions":[{"name":"account","action":"login","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"account","action":"edit","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"account","action":"view","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"payments","action":"create","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"payments","action":"view","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"payments","action":"report","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"carparks","action":"book","identifier":"*"},{"name":"carparks","action":"report","identifier":"*"}]}`,
 		},
 		err: nil,
@@ -124,11 +173,12 @@ var testsService = []struct {
 		name: "register failed",
 		request: events.APIGatewayProxyRequest{
 			Resource: "/register",
-			Body:     `{"email":"tester@carpark.ninja","password":"tester","verify":"tester"}`,
+			Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019","verify":"Carpark-Ninja-2019"}`,
 		},
 		expect: events.APIGatewayProxyResponse{
-			StatusCode: 400,
-			Body:       `can't register: can't get create login: login already exists`,
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":{"code":"conflict","message":"can't register: can't get create login: login already exists","request_id":""}}`,
 		},
 	},
 
@@ -137,10 +187,11 @@ var testsService = []struct {
 		name: "login success",
 		request: events.APIGatewayProxyRequest{
 			Resource: "/login",
-			Body:     `{"email":"tester@carpark.ninja","password":"tester"}`,
+			Body:     `{"email":"tester@carpark.ninja","password":"Carpark-Ninja-2019"}`,
 		},
 		expect: events.APIGatewayProxyResponse{
 			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "application/json"},
 			Body:       `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","permissions":[{"name":"account","action":"login","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"account","action":"edit","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"account","action":"view","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"payments","action":"create","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"payments","action":"view","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"payments","action":"report","identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250"},{"name":"carparks","action":"book","identifier":"*"},{"name":"carparks","action":"report","identifier":"*"}]}`,
 		},
 	},
@@ -151,19 +202,21 @@ var testsService = []struct {
 			Body:     `{"email":"tester@carpark.ninja","password":"failure"}`,
 		},
 		expect: events.APIGatewayProxyResponse{
-			StatusCode: 400,
-			Body:       `can't get login: can't get login for user: login response err: invalid password`,
+			StatusCode: 401,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":{"code":"unauthorized","message":"can't get login: invalid email or password","request_id":""}}`,
 		},
 	},
 	{
 		name: "login failed identity",
 		request: events.APIGatewayProxyRequest{
 			Resource: "/login",
-			Body:     `{"email":"failure@carpark.ninja","password":"tester"}`,
+			Body:     `{"email":"failure@carpark.ninja","password":"Carpark-Ninja-2019"}`,
 		},
 		expect: events.APIGatewayProxyResponse{
-			StatusCode: 400,
-			Body:       `can't get login: can't get login for user: login response err: no identity`,
+			StatusCode: 401,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":{"code":"unauthorized","message":"can't get login: invalid email or password","request_id":""}}`,
 		},
 	},
 
@@ -176,6 +229,7 @@ var testsService = []struct {
 		},
 		expect: events.APIGatewayProxyResponse{
 			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "application/json"},
 			Body:       `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","status":"allowed"}`,
 		},
 	},
@@ -187,29 +241,60 @@ var testsService = []struct {
 		},
 		expect: events.APIGatewayProxyResponse{
 			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "application/json"},
 			Body:       `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","status":"denied"}`,
 		},
 	},
 }
 
-func TestHandler(t *testing.T) {
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					t.Errorf("godotenv err: %w", err)
-				}
+// withoutTokens the tokens a login hands back are different every time
+func withoutTokens(body string) string {
+	lo := service.LoginObject{}
+	if json.Unmarshal([]byte(body), &lo) != nil || lo.AccessToken == "" {
+		return body
+	}
+
+	lo.Tokens = service.Tokens{}
+	j, _ := json.Marshal(lo)
+	return string(j)
+}
+
+func TestCheckConfig(t *testing.T) {
+	env := map[string]string{}
+	for _, k := range []string{"VERIFY_KEY", "SERVICE_NOTIFY", "ACCOUNT_TABLE"} {
+		env[k] = os.Getenv(k)
+		_ = os.Unsetenv(k)
+	}
+	defer func() {
+		for k, v := range env {
+			if v == "" {
+				_ = os.Unsetenv(k)
+				continue
 			}
+			_ = os.Setenv(k, v)
 		}
-	}
+	}()
+
+	err := service.CheckConfig()
+	assert.True(t, errors.Is(err, service.ErrVerifyKey), err)
+
+	_ = os.Setenv("VERIFY_KEY", "verify-key")
+	err = service.CheckConfig()
+	assert.True(t, errors.Is(err, service.ErrNotifier), err)
 
+	_ = os.Setenv("SERVICE_NOTIFY", "http://notify")
+	err = service.CheckConfig()
+	assert.EqualError(t, err, "stores: ACCOUNT_TABLE isn't set")
+}
+
+func TestHandler(t *testing.T) {
 	for _, test := range testsService {
 		t.Run(test.name, func(t *testing.T) {
-			response, err := service.Handler(test.request)
+			response, err := service.Handler(context.Background(), test.request)
+			response.Body = withoutTokens(response.Body)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("service test type err: %w, request: %v", err, test.request)
+				t.Errorf("service test type err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
@@ -224,26 +309,16 @@ func TestHandler(t *testing.T) {
 func BenchmarkHandler(b *testing.B) {
 	b.ReportAllocs()
 
-	if len(os.Args) >= 1 {
-		for _, env := range os.Args {
-			if env == "localDev" {
-				err := godotenv.Load()
-				if err != nil {
-					b.Errorf("godotenv err: %w", err)
-				}
-			}
-		}
-	}
-
 	b.ResetTimer()
 	for _, test := range testsService {
 		b.Run(test.name, func(t *testing.B) {
 			b.StopTimer()
 
-			response, err := service.Handler(test.request)
+			response, err := service.Handler(context.Background(), test.request)
+			response.Body = withoutTokens(response.Body)
 			passed := assert.IsType(t, test.err, err)
 			if !passed {
-				t.Errorf("service test type err: %w, request: %v", err, test.request)
+				t.Errorf("service test type err: %v, request: %v", err, test.request)
 			}
 			passed = assert.Equal(t, test.expect, response)
 			if !passed {
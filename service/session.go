@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	permissions "github.com/carprks/permissions/service"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrRefreshToken the refresh token is unknown, revoked or has expired
+var ErrRefreshToken = WithKind(ErrUnauthorized, fmt.Errorf("invalid or expired refresh token"))
+
+// ErrRefreshRotated the refresh token was rotated before it could be used
+var ErrRefreshRotated = WithKind(ErrUnauthorized, errors.New("refresh token already rotated"))
+
+// Tokens what a successful login hands back
+type Tokens struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Session a login and every refresh token rotated from it, the refresh tokens
+// are only kept as hashes
+type Session struct {
+	ID          string
+	Identifier  string
+	RefreshHash string
+	Created     time.Time
+	Expires     time.Time
+	Revoked     bool
+}
+
+// SessionStore where sessions are kept
+type SessionStore interface {
+	Create(ctx context.Context, s Session) error
+	// Find the session a refresh token belongs to, whether it's the current one or was rotated out
+	Find(ctx context.Context, hash string) (Session, bool, error)
+	// Rotate swap the session's refresh token, ErrRefreshRotated when old isn't current anymore
+	Rotate(ctx context.Context, id, old, new string) error
+	Revoke(ctx context.Context, id string) error
+	RevokeAll(ctx context.Context, ident string) error
+}
+
+// newSessionStore dynamo when SESSION_TABLE is set, otherwise sessions only
+// last as long as the lambda is warm
+func newSessionStore() SessionStore {
+	table := os.Getenv("SESSION_TABLE")
+	if table == "" {
+		return NewMemorySessionStore()
+	}
+
+	return NewDynamoSessionStore(table)
+}
+
+// MemorySessionStore session store that lives as long as the lambda is warm
+type MemorySessionStore struct {
+	sync.Mutex
+	sessions map[string]Session
+	// hashes every refresh token hash and the session it belongs to
+	hashes map[string]string
+	pruned time.Time
+}
+
+// SessionPruneInterval how often the memory store drops expired sessions
+const SessionPruneInterval = time.Minute
+
+// NewMemorySessionStore ...
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]Session{},
+		hashes:   map[string]string{},
+	}
+}
+
+// Create ...
+func (m *MemorySessionStore) Create(ctx context.Context, s Session) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.prune(s.Created)
+	m.sessions[s.ID] = s
+	m.hashes[s.RefreshHash] = s.ID
+	return nil
+}
+
+// prune drop the sessions that expired before now and the hashes pointing at
+// them, a session can't be refreshed once it has expired so nothing is lost
+func (m *MemorySessionStore) prune(now time.Time) {
+	if now.Sub(m.pruned) < SessionPruneInterval {
+		return
+	}
+	m.pruned = now
+
+	for id, s := range m.sessions {
+		if now.After(s.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+	for hash, id := range m.hashes {
+		if _, ok := m.sessions[id]; !ok {
+			delete(m.hashes, hash)
+		}
+	}
+}
+
+// Find ...
+func (m *MemorySessionStore) Find(ctx context.Context, hash string) (Session, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	id, ok := m.hashes[hash]
+	if !ok {
+		return Session{}, false, nil
+	}
+	s, ok := m.sessions[id]
+	return s, ok, nil
+}
+
+// Rotate ...
+func (m *MemorySessionStore) Rotate(ctx context.Context, id, old, new string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || s.Revoked || s.RefreshHash != old {
+		return ErrRefreshRotated
+	}
+
+	s.RefreshHash = new
+	m.sessions[id] = s
+	m.hashes[new] = id
+	return nil
+}
+
+// Revoke ...
+func (m *MemorySessionStore) Revoke(ctx context.Context, id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	s.Revoked = true
+	m.sessions[id] = s
+	return nil
+}
+
+// RevokeAll ...
+func (m *MemorySessionStore) RevokeAll(ctx context.Context, ident string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, s := range m.sessions {
+		if s.Identifier == ident {
+			s.Revoked = true
+			m.sessions[id] = s
+		}
+	}
+	return nil
+}
+
+// issueTokens start a session for the account and sign an access token for it
+func (s Service) issueTokens(ctx context.Context, ident string, perms []permissions.Permission, unverified bool) (Tokens, error) {
+	now := s.now()
+
+	refresh, err := generateToken()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't generate refresh token: %w", err)
+	}
+	id, err := generateToken()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't generate session id: %w", err)
+	}
+
+	sess := Session{
+		ID:          id,
+		Identifier:  ident,
+		RefreshHash: hashToken(refresh),
+		Created:     now,
+		Expires:     now.Add(s.Tokens.RefreshTTL),
+	}
+	err = s.Sessions.Create(ctx, sess)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't save session: %w", err)
+	}
+
+	return s.sessionTokens(sess, refresh, perms, unverified)
+}
+
+// sessionTokens sign an access token for the session
+func (s Service) sessionTokens(sess Session, refresh string, perms []permissions.Permission, unverified bool) (Tokens, error) {
+	now := s.now()
+
+	jti, err := generateToken()
+	if err != nil {
+		return Tokens{}, fmt.Errorf("can't generate token id: %w", err)
+	}
+
+	access, err := s.Tokens.Sign(Claims{
+		Issuer:      s.Tokens.Issuer,
+		Subject:     sess.Identifier,
+		IssuedAt:    now.Unix(),
+		Expires:     now.Add(s.Tokens.TTL).Unix(),
+		ID:          jti,
+		Session:     sess.ID,
+		Permissions: perms,
+		Unverified:  unverified,
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(s.Tokens.TTL / time.Second),
+		RefreshToken: refresh,
+	}, nil
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// SessionIdentifierIndex the global secondary index on identifier, only session items have one
+	SessionIdentifierIndex = "identifier-index"
+
+	sessionPrefix = "session#"
+	refreshPrefix = "refresh#"
+)
+
+// SessionDynamo the parts of dynamodbiface.DynamoDBAPI the session store uses
+type SessionDynamo interface {
+	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error)
+	UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error)
+}
+
+// DynamoSessionStore sessions in a dynamo table keyed on id, each session is
+// an item and so is every refresh token hash pointing back at its session
+type DynamoSessionStore struct {
+	Table  string
+	Client SessionDynamo
+}
+
+// NewDynamoSessionStore store using table, DYNAMO_ENDPOINT points it at a local dynamo
+func NewDynamoSessionStore(table string) DynamoSessionStore {
+	cfg := aws.NewConfig()
+	if endpoint := os.Getenv("DYNAMO_ENDPOINT"); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	return DynamoSessionStore{
+		Table:  table,
+		Client: dynamodb.New(session.Must(session.NewSession()), cfg),
+	}
+}
+
+type dynamoSession struct {
+	ID         string `dynamodbav:"id"`
+	Identifier string `dynamodbav:"identifier"`
+	Refresh    string `dynamodbav:"refresh"`
+	Created    int64  `dynamodbav:"created"`
+	Expires    int64  `dynamodbav:"expires"`
+	Revoked    bool   `dynamodbav:"revoked"`
+	TTL        int64  `dynamodbav:"ttl"`
+}
+
+type dynamoRefresh struct {
+	ID      string `dynamodbav:"id"`
+	Session string `dynamodbav:"session"`
+	TTL     int64  `dynamodbav:"ttl"`
+}
+
+func sessionKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(id)},
+	}
+}
+
+func dynamoErr(err error) error {
+	return WithKind(ErrUpstream, fmt.Errorf("dynamo err: %w", err))
+}
+
+func conditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func (d DynamoSessionStore) putRefresh(ctx context.Context, hash, id string, expires time.Time) error {
+	item, err := dynamodbattribute.MarshalMap(dynamoRefresh{
+		ID:      refreshPrefix + hash,
+		Session: id,
+		TTL:     expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      item,
+	})
+	if err != nil {
+		return dynamoErr(err)
+	}
+
+	return nil
+}
+
+func (d DynamoSessionStore) get(ctx context.Context, id string, out interface{}) (bool, error) {
+	resp, err := d.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.Table),
+		Key:            sessionKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, dynamoErr(err)
+	}
+	if len(resp.Item) == 0 {
+		return false, nil
+	}
+
+	return true, dynamodbattribute.UnmarshalMap(resp.Item, out)
+}
+
+// Create ...
+func (d DynamoSessionStore) Create(ctx context.Context, s Session) error {
+	item, err := dynamodbattribute.MarshalMap(dynamoSession{
+		ID:         sessionPrefix + s.ID,
+		Identifier: s.Identifier,
+		Refresh:    s.RefreshHash,
+		Created:    s.Created.Unix(),
+		Expires:    s.Expires.Unix(),
+		Revoked:    s.Revoked,
+		TTL:        s.Expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return dynamoErr(err)
+	}
+
+	return d.putRefresh(ctx, s.RefreshHash, s.ID, s.Expires)
+}
+
+// Find ...
+func (d DynamoSessionStore) Find(ctx context.Context, hash string) (Session, bool, error) {
+	r := dynamoRefresh{}
+	ok, err := d.get(ctx, refreshPrefix+hash, &r)
+	if err != nil || !ok {
+		return Session{}, false, err
+	}
+
+	ds := dynamoSession{}
+	ok, err = d.get(ctx, sessionPrefix+r.Session, &ds)
+	if err != nil || !ok {
+		return Session{}, false, err
+	}
+
+	return Session{
+		ID:          strings.TrimPrefix(ds.ID, sessionPrefix),
+		Identifier:  ds.Identifier,
+		RefreshHash: ds.Refresh,
+		Created:     time.Unix(ds.Created, 0),
+		Expires:     time.Unix(ds.Expires, 0),
+		Revoked:     ds.Revoked,
+	}, true, nil
+}
+
+// Rotate the new hash is written first, until the session points at it nobody holds it
+func (d DynamoSessionStore) Rotate(ctx context.Context, id, old, new string) error {
+	ds := dynamoSession{}
+	ok, err := d.get(ctx, sessionPrefix+id, &ds)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRefreshRotated
+	}
+
+	err = d.putRefresh(ctx, new, id, time.Unix(ds.Expires, 0))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.Table),
+		Key:                 sessionKey(sessionPrefix + id),
+		UpdateExpression:    aws.String("SET #refresh = :new"),
+		ConditionExpression: aws.String("#refresh = :old AND #revoked = :false"),
+		ExpressionAttributeNames: map[string]*string{
+			"#refresh": aws.String("refresh"),
+			"#revoked": aws.String("revoked"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":new":   {S: aws.String(new)},
+			":old":   {S: aws.String(old)},
+			":false": {BOOL: aws.Bool(false)},
+		},
+	})
+	if conditionFailed(err) {
+		return ErrRefreshRotated
+	}
+	if err != nil {
+		return dynamoErr(err)
+	}
+
+	return nil
+}
+
+// Revoke ...
+func (d DynamoSessionStore) Revoke(ctx context.Context, id string) error {
+	return d.revoke(ctx, sessionPrefix+id)
+}
+
+func (d DynamoSessionStore) revoke(ctx context.Context, key string) error {
+	_, err := d.Client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.Table),
+		Key:                 sessionKey(key),
+		UpdateExpression:    aws.String("SET #revoked = :true"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#revoked": aws.String("revoked"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":true": {BOOL: aws.Bool(true)},
+		},
+	})
+	if err != nil && !conditionFailed(err) {
+		return dynamoErr(err)
+	}
+
+	return nil
+}
+
+// RevokeAll ...
+func (d DynamoSessionStore) RevokeAll(ctx context.Context, ident string) error {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		IndexName:              aws.String(SessionIdentifierIndex),
+		KeyConditionExpression: aws.String("#identifier = :identifier"),
+		ExpressionAttributeNames: map[string]*string{
+			"#identifier": aws.String("identifier"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":identifier": {S: aws.String(ident)},
+		},
+	}
+
+	for {
+		resp, err := d.Client.QueryWithContext(ctx, input)
+		if err != nil {
+			return dynamoErr(err)
+		}
+
+		for _, item := range resp.Items {
+			if item["id"] == nil {
+				continue
+			}
+			err = d.revoke(ctx, aws.StringValue(item["id"].S))
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
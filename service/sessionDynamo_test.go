@@ -0,0 +1,268 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDynamo a stand-in for a dynamo table keyed on id, it understands the
+// simple expressions the session store uses
+type fakeDynamo struct {
+	sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{
+		items: map[string]map[string]*dynamodb.AttributeValue{},
+	}
+}
+
+var errConditionFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+
+func attrName(name string, names map[string]*string) string {
+	if n, ok := names[name]; ok {
+		return aws.StringValue(n)
+	}
+	return name
+}
+
+// matches conditions like "a = :a AND attribute_exists(id)"
+func (f *fakeDynamo) matches(item map[string]*dynamodb.AttributeValue, expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	if expr == nil {
+		return true
+	}
+
+	for _, cond := range strings.Split(aws.StringValue(expr), " AND ") {
+		cond = strings.TrimSpace(cond)
+		switch {
+		case strings.HasPrefix(cond, "attribute_not_exists("):
+			if item != nil {
+				return false
+			}
+		case strings.HasPrefix(cond, "attribute_exists("):
+			if item == nil {
+				return false
+			}
+		default:
+			parts := strings.SplitN(cond, " = ", 2)
+			if item == nil || len(parts) != 2 {
+				return false
+			}
+			v := item[attrName(parts[0], names)]
+			if v == nil || v.String() != values[parts[1]].String() {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := aws.StringValue(input.Item["id"].S)
+	if input.ConditionExpression != nil && !f.matches(f.items[id], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, errConditionFailed
+	}
+	f.items[id] = input.Item
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return &dynamodb.GetItemOutput{
+		Item: f.items[aws.StringValue(input.Key["id"].S)],
+	}, nil
+}
+
+func (f *fakeDynamo) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := aws.StringValue(input.Key["id"].S)
+	item := f.items[id]
+	if !f.matches(item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, errConditionFailed
+	}
+
+	updated := map[string]*dynamodb.AttributeValue{}
+	for k, v := range item {
+		updated[k] = v
+	}
+	updated["id"] = input.Key["id"]
+	for _, set := range strings.Split(strings.TrimPrefix(aws.StringValue(input.UpdateExpression), "SET "), ",") {
+		parts := strings.SplitN(strings.TrimSpace(set), " = ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unsupported update: %s", set)
+		}
+		updated[attrName(parts[0], input.ExpressionAttributeNames)] = input.ExpressionAttributeValues[parts[1]]
+	}
+	f.items[id] = updated
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamo) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := aws.StringValue(input.Key["id"].S)
+	item := f.items[id]
+	if input.ConditionExpression != nil && !f.matches(item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, errConditionFailed
+	}
+	delete(f.items, id)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = item
+	}
+
+	return out, nil
+}
+
+// QueryWithContext one page at a time so paging is exercised
+func (f *fakeDynamo) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	start := ""
+	if input.ExclusiveStartKey != nil {
+		start = aws.StringValue(input.ExclusiveStartKey["id"].S)
+	}
+
+	out := &dynamodb.QueryOutput{}
+	for id, item := range f.items {
+		if id <= start || !f.matches(item, input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+			continue
+		}
+		if len(out.Items) == 0 || id < aws.StringValue(out.Items[0]["id"].S) {
+			out.Items = []map[string]*dynamodb.AttributeValue{item}
+		}
+	}
+	if len(out.Items) == 1 {
+		out.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+			"id": out.Items[0]["id"],
+		}
+	}
+
+	return out, nil
+}
+
+func TestSessionStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store func() service.SessionStore
+	}{
+		{
+			name: "memory",
+			store: func() service.SessionStore {
+				return service.NewMemorySessionStore()
+			},
+		},
+		{
+			name: "dynamo",
+			store: func() service.SessionStore {
+				return service.DynamoSessionStore{
+					Table:  "sessions",
+					Client: newFakeDynamo(),
+				}
+			},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := test.store()
+			now := time.Unix(time.Now().Unix(), 0)
+
+			for _, sess := range []service.Session{
+				{ID: "session-1", Identifier: "ident-1", RefreshHash: "hash-1"},
+				{ID: "session-2", Identifier: "ident-1", RefreshHash: "hash-2"},
+				{ID: "session-3", Identifier: "ident-2", RefreshHash: "hash-3"},
+			} {
+				sess.Created = now
+				sess.Expires = now.Add(time.Hour)
+				assert.Nil(t, store.Create(ctx, sess))
+			}
+
+			sess, ok, err := store.Find(ctx, "hash-1")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, service.Session{
+				ID:          "session-1",
+				Identifier:  "ident-1",
+				RefreshHash: "hash-1",
+				Created:     now,
+				Expires:     now.Add(time.Hour),
+			}, sess)
+
+			_, ok, err = store.Find(ctx, "hash-unknown")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			// the rotated hash still finds the session so reuse can be spotted
+			assert.Nil(t, store.Rotate(ctx, "session-1", "hash-1", "hash-1b"))
+			sess, ok, _ = store.Find(ctx, "hash-1")
+			assert.True(t, ok)
+			assert.Equal(t, "hash-1b", sess.RefreshHash)
+			sess, ok, _ = store.Find(ctx, "hash-1b")
+			assert.True(t, ok)
+			assert.Equal(t, "session-1", sess.ID)
+
+			err = store.Rotate(ctx, "session-1", "hash-1", "hash-1c")
+			assert.True(t, errors.Is(err, service.ErrRefreshRotated))
+
+			assert.Nil(t, store.Revoke(ctx, "session-1"))
+			sess, _, _ = store.Find(ctx, "hash-1b")
+			assert.True(t, sess.Revoked)
+			err = store.Rotate(ctx, "session-1", "hash-1b", "hash-1d")
+			assert.True(t, errors.Is(err, service.ErrRefreshRotated))
+			assert.Nil(t, store.Revoke(ctx, "session-unknown"))
+
+			assert.Nil(t, store.RevokeAll(ctx, "ident-1"))
+			sess, _, _ = store.Find(ctx, "hash-2")
+			assert.True(t, sess.Revoked)
+			sess, _, _ = store.Find(ctx, "hash-3")
+			assert.False(t, sess.Revoked)
+		})
+	}
+}
+
+func TestMemorySessionStorePrune(t *testing.T) {
+	ctx := context.Background()
+	store := service.NewMemorySessionStore()
+	now := time.Now()
+
+	assert.Nil(t, store.Create(ctx, service.Session{ID: "session-1", Identifier: "ident-1", RefreshHash: "hash-1", Created: now, Expires: now.Add(time.Hour)}))
+	assert.Nil(t, store.Rotate(ctx, "session-1", "hash-1", "hash-1b"))
+
+	// the next login after they have expired drops them, rotated hashes and all
+	later := now.Add(time.Hour + service.SessionPruneInterval)
+	assert.Nil(t, store.Create(ctx, service.Session{ID: "session-2", Identifier: "ident-1", RefreshHash: "hash-2", Created: later, Expires: later.Add(time.Hour)}))
+	for _, hash := range []string{"hash-1", "hash-1b"} {
+		_, ok, err := store.Find(ctx, hash)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+	_, ok, _ := store.Find(ctx, "hash-2")
+	assert.True(t, ok)
+}
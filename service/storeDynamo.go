@@ -0,0 +1,869 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// StoreTimeout how long a call to the store table can take, the store
+	// interfaces don't take a ctx
+	StoreTimeout = time.Second * 5
+
+	resetPrefix            = "reset#"
+	resetTokenPrefix       = "reset-token#"
+	verificationPrefix     = "verification#"
+	mfaPrefix              = "mfa#"
+	mfaPendingPrefix       = "mfa-pending#"
+	attemptPrefix          = "attempt#"
+	deletionPrefix         = "deletion#"
+	exportPrefix           = "export#"
+	exportTokenPrefix      = "export-token#"
+	identityAccountPrefix  = "identity-account#"
+	identityLoginPrefix    = "identity-login#"
+	emailChangePrefix      = "email-change#"
+	emailChangeTokenPrefix = "email-change-token#"
+
+	// AccountKindIndex the index on the account table of records that have to
+	// be listed, keyed on their kind
+	AccountKindIndex = "kind-index"
+	deletionKind     = "deletion"
+	exportKind       = "export"
+
+	// storeRetries how many times a versioned put is tried when another
+	// instance wrote the record in between
+	storeRetries = 5
+)
+
+// StoreDynamo the parts of dynamodbiface.DynamoDBAPI the account stores use
+type StoreDynamo interface {
+	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error)
+	DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error)
+}
+
+// DynamoStore the state the account keeps between requests in a dynamo table
+// keyed on id, each store prefixes its ids and keeps its records as json
+type DynamoStore struct {
+	Table  string
+	Client StoreDynamo
+}
+
+// NewDynamoStore store using table, DYNAMO_ENDPOINT points it at a local dynamo
+func NewDynamoStore(table string) DynamoStore {
+	cfg := aws.NewConfig()
+	if endpoint := os.Getenv("DYNAMO_ENDPOINT"); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	return DynamoStore{
+		Table:  table,
+		Client: dynamodb.New(session.Must(session.NewSession()), cfg),
+	}
+}
+
+// accountTable the table in ACCOUNT_TABLE, without it state only lasts as
+// long as the lambda is warm
+func accountTable() (DynamoStore, bool) {
+	table := os.Getenv("ACCOUNT_TABLE")
+	if table == "" {
+		return DynamoStore{}, false
+	}
+
+	return NewDynamoStore(table), true
+}
+
+// durableStore a store kept in the account table
+type durableStore interface {
+	durable()
+}
+
+func (d DynamoStore) durable() {}
+
+// CheckStores the lambda has more than one instance and goes cold, so state
+// that has to outlive a request has to be in a table
+func CheckStores() error {
+	if os.Getenv("ACCOUNT_TABLE") == "" {
+		return fmt.Errorf("ACCOUNT_TABLE isn't set")
+	}
+
+	stores := []struct {
+		name  string
+		store interface{}
+	}{
+		{"resets", resets},
+		{"verifications", verifications},
+		{"mfas", mfas},
+		{"attempts", attempts},
+		{"deletions", deletions},
+		{"exports", exports},
+		{"identities", identities},
+		{"email changes", emailChanges},
+	}
+	for _, s := range stores {
+		if _, ok := s.store.(durableStore); !ok {
+			return fmt.Errorf("%s aren't kept in ACCOUNT_TABLE", s.name)
+		}
+	}
+
+	return nil
+}
+
+type dynamoRecord struct {
+	ID      string `dynamodbav:"id"`
+	Data    []byte `dynamodbav:"data"`
+	TTL     int64  `dynamodbav:"ttl,omitempty"`
+	Version int64  `dynamodbav:"version,omitempty"`
+	Kind    string `dynamodbav:"kind,omitempty"`
+}
+
+func storeKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(id)},
+	}
+}
+
+// put v as the record r
+func (d DynamoStore) put(r dynamoRecord, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	var err error
+	r.Data, err = json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	item, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      item,
+	})
+	if err != nil {
+		return dynamoErr(err)
+	}
+
+	return nil
+}
+
+// get the record id into v
+func (d DynamoStore) get(id string, v interface{}) (bool, error) {
+	_, ok, err := d.record(id, v)
+	return ok, err
+}
+
+// record the record id into v, the version is set even when the record has
+// expired so it can be written over
+func (d DynamoStore) record(id string, v interface{}) (dynamoRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	resp, err := d.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.Table),
+		Key:            storeKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return dynamoRecord{}, false, dynamoErr(err)
+	}
+
+	r := dynamoRecord{}
+	if len(resp.Item) == 0 {
+		return r, false, nil
+	}
+	err = dynamodbattribute.UnmarshalMap(resp.Item, &r)
+	if err != nil {
+		return r, false, err
+	}
+	ok, err := d.unmarshal(resp.Item, v)
+	return r, ok, err
+}
+
+// putVersion put v as the record r, only if nothing has written it since
+// r.Version was read, false when something has
+func (d DynamoStore) putVersion(r dynamoRecord, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(d.Table),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	if r.Version != 0 {
+		input.ConditionExpression = aws.String("#version = :version")
+		input.ExpressionAttributeNames = map[string]*string{
+			"#version": aws.String("version"),
+		}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(fmt.Sprint(r.Version))},
+		}
+	}
+
+	var err error
+	r.Version++
+	r.Data, err = json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	input.Item, err = dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = d.Client.PutItemWithContext(ctx, input)
+	if conditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, dynamoErr(err)
+	}
+
+	return true, nil
+}
+
+// take the record id into v and delete it in the same call, so only one
+// caller gets it
+func (d DynamoStore) take(id string, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	resp, err := d.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(d.Table),
+		Key:          storeKey(id),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return false, dynamoErr(err)
+	}
+
+	return d.unmarshal(resp.Attributes, v)
+}
+
+// delete the record id, a missing record isn't an error
+func (d DynamoStore) delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	_, err := d.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.Table),
+		Key:       storeKey(id),
+	})
+	if err != nil {
+		return dynamoErr(err)
+	}
+
+	return nil
+}
+
+// kind each record of kind, through the kind index
+func (d DynamoStore) kind(kind string, each func(item map[string]*dynamodb.AttributeValue) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		IndexName:              aws.String(AccountKindIndex),
+		KeyConditionExpression: aws.String("#kind = :kind"),
+		ExpressionAttributeNames: map[string]*string{
+			"#kind": aws.String("kind"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":kind": {S: aws.String(kind)},
+		},
+	}
+
+	for {
+		resp, err := d.Client.QueryWithContext(ctx, input)
+		if err != nil {
+			return dynamoErr(err)
+		}
+
+		for _, item := range resp.Items {
+			err = each(item)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+func (d DynamoStore) unmarshal(item map[string]*dynamodb.AttributeValue, v interface{}) (bool, error) {
+	if len(item) == 0 {
+		return false, nil
+	}
+
+	r := dynamoRecord{}
+	err := dynamodbattribute.UnmarshalMap(item, &r)
+	if err != nil {
+		return false, err
+	}
+	// dynamo only removes expired items eventually
+	if r.TTL != 0 && time.Now().Unix() >= r.TTL {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(r.Data, v)
+}
+
+// DynamoResetStore reset tokens in the store table, each expires with its
+// token, the email's record counts its requests and says which token is current
+type DynamoResetStore struct {
+	DynamoStore
+}
+
+// dynamoResets the requests for an email within ResetWindow
+type dynamoResets struct {
+	Current   string      `json:"current"`
+	Requested []time.Time `json:"requested"`
+}
+
+// Save ...
+func (d DynamoResetStore) Save(t ResetToken) error {
+	// the email's record goes first, a token saved before it would be usable
+	// without being counted
+	saved := false
+	for i := 0; i < storeRetries && !saved; i++ {
+		rs := dynamoResets{}
+		r, _, err := d.record(resetPrefix+t.Email, &rs)
+		if err != nil {
+			return err
+		}
+
+		requested := []time.Time{t.Created}
+		for _, at := range rs.Requested {
+			if t.Created.Sub(at) < ResetWindow {
+				requested = append(requested, at)
+			}
+		}
+		rs = dynamoResets{
+			Current:   t.Hash,
+			Requested: requested,
+		}
+
+		r.ID = resetPrefix + t.Email
+		r.TTL = t.Expires.Unix()
+		if window := t.Created.Add(ResetWindow).Unix(); window > r.TTL {
+			r.TTL = window
+		}
+		saved, err = d.putVersion(r, rs)
+		if err != nil {
+			return err
+		}
+	}
+	if !saved {
+		return fmt.Errorf("resets for %s kept changing", t.Email)
+	}
+
+	return d.put(dynamoRecord{
+		ID:  resetTokenPrefix + t.Hash,
+		TTL: t.Expires.Unix(),
+	}, t)
+}
+
+// current whether t is the email's latest token
+func (d DynamoResetStore) current(t ResetToken) (bool, error) {
+	rs := dynamoResets{}
+	ok, err := d.get(resetPrefix+t.Email, &rs)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return rs.Current == t.Hash, nil
+}
+
+// Peek ...
+func (d DynamoResetStore) Peek(hash string) (ResetToken, error) {
+	t := ResetToken{}
+	ok, err := d.get(resetTokenPrefix+hash, &t)
+	if err != nil {
+		return ResetToken{}, err
+	}
+	if !ok {
+		return ResetToken{}, ErrResetToken
+	}
+	ok, err = d.current(t)
+	if err != nil {
+		return ResetToken{}, err
+	}
+	if !ok {
+		return ResetToken{}, ErrResetToken
+	}
+
+	return t, nil
+}
+
+// Take the token is deleted as it's read, so only one confirm gets it
+func (d DynamoResetStore) Take(hash string) (ResetToken, error) {
+	t := ResetToken{}
+	ok, err := d.take(resetTokenPrefix+hash, &t)
+	if err != nil {
+		return ResetToken{}, err
+	}
+	if !ok {
+		return ResetToken{}, ErrResetToken
+	}
+	ok, err = d.current(t)
+	if err != nil {
+		return ResetToken{}, err
+	}
+	if !ok {
+		return ResetToken{}, ErrResetToken
+	}
+
+	return t, nil
+}
+
+// Requested ...
+func (d DynamoResetStore) Requested(email string, since time.Time) (int, error) {
+	rs := dynamoResets{}
+	_, err := d.get(resetPrefix+email, &rs)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, at := range rs.Requested {
+		if at.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// DynamoVerificationStore verifications in the store table
+type DynamoVerificationStore struct {
+	DynamoStore
+}
+
+// Get ...
+func (d DynamoVerificationStore) Get(ident string) (Verification, bool, error) {
+	v := Verification{}
+	ok, err := d.get(verificationPrefix+ident, &v)
+	return v, ok, err
+}
+
+// Save ...
+func (d DynamoVerificationStore) Save(v Verification) error {
+	return d.put(dynamoRecord{
+		ID: verificationPrefix + v.Identifier,
+	}, v)
+}
+
+// DynamoMFAStore enrolments and pending logins in the store table, pending
+// logins expire with their challenge
+type DynamoMFAStore struct {
+	DynamoStore
+}
+
+// Get ...
+func (d DynamoMFAStore) Get(ident string) (MFA, bool, error) {
+	m := MFA{}
+	ok, err := d.get(mfaPrefix+ident, &m)
+	return m, ok, err
+}
+
+// Save ...
+func (d DynamoMFAStore) Save(m MFA) error {
+	return d.put(dynamoRecord{
+		ID: mfaPrefix + m.Identifier,
+	}, m)
+}
+
+// Delete ...
+func (d DynamoMFAStore) Delete(ident string) error {
+	return d.delete(mfaPrefix + ident)
+}
+
+// SavePending ...
+func (d DynamoMFAStore) SavePending(p PendingLogin) error {
+	return d.put(dynamoRecord{
+		ID:  mfaPendingPrefix + p.Hash,
+		TTL: p.Expires.Unix(),
+	}, p)
+}
+
+// TakePending ...
+func (d DynamoMFAStore) TakePending(hash string) (PendingLogin, bool, error) {
+	p := PendingLogin{}
+	ok, err := d.take(mfaPendingPrefix+hash, &p)
+	return p, ok, err
+}
+
+// DynamoAttemptStore failure counters in the store table, so every instance
+// counts against the same ones, counters expire once their window has passed
+type DynamoAttemptStore struct {
+	DynamoStore
+}
+
+// Get ...
+func (d DynamoAttemptStore) Get(key string) (Attempts, error) {
+	a := Attempts{}
+	_, err := d.get(attemptPrefix+key, &a)
+	return a, err
+}
+
+// Fail ...
+func (d DynamoAttemptStore) Fail(key string, now time.Time, window time.Duration) (Attempts, error) {
+	for i := 0; i < storeRetries; i++ {
+		a := Attempts{}
+		r, _, err := d.record(attemptPrefix+key, &a)
+		if err != nil {
+			return Attempts{}, err
+		}
+		if now.Sub(a.Last) >= window {
+			a = Attempts{}
+		}
+		a.Failures++
+		a.Last = now
+
+		r.ID = attemptPrefix + key
+		r.TTL = now.Add(window).Unix()
+		ok, err := d.putVersion(r, a)
+		if err != nil {
+			return Attempts{}, err
+		}
+		if ok {
+			return a, nil
+		}
+	}
+
+	return Attempts{}, fmt.Errorf("attempts for %s kept changing", key)
+}
+
+// Clear ...
+func (d DynamoAttemptStore) Clear(key string) error {
+	return d.delete(attemptPrefix + key)
+}
+
+// DynamoDeletionStore deletions in the store table, listed through the kind
+// index so the schedule can find the ones that are due
+type DynamoDeletionStore struct {
+	DynamoStore
+}
+
+// Get ...
+func (d DynamoDeletionStore) Get(ident string) (Deletion, bool, error) {
+	del := Deletion{}
+	ok, err := d.get(deletionPrefix+ident, &del)
+	return del, ok, err
+}
+
+// Save ...
+func (d DynamoDeletionStore) Save(del Deletion) error {
+	return d.put(dynamoRecord{
+		ID:   deletionPrefix + del.Identifier,
+		Kind: deletionKind,
+	}, del)
+}
+
+// Delete ...
+func (d DynamoDeletionStore) Delete(ident string) error {
+	return d.delete(deletionPrefix + ident)
+}
+
+// Due ...
+func (d DynamoDeletionStore) Due(now time.Time) ([]Deletion, error) {
+	due := []Deletion{}
+	err := d.kind(deletionKind, func(item map[string]*dynamodb.AttributeValue) error {
+		del := Deletion{}
+		ok, err := d.unmarshal(item, &del)
+		if err != nil || !ok {
+			return err
+		}
+		if !now.Before(del.Due) {
+			due = append(due, del)
+		}
+		return nil
+	})
+
+	return due, err
+}
+
+// DynamoExportStore exports in the store table, each token hash points at its
+// export, an export has to fit in a dynamo item, one that doesn't can't be
+// saved and is tried again until it fails
+type DynamoExportStore struct {
+	DynamoStore
+}
+
+type dynamoExportToken struct {
+	ID string
+}
+
+// Save ...
+func (d DynamoExportStore) Save(e ExportJob) error {
+	r := dynamoRecord{
+		ID:   exportPrefix + e.ID,
+		Kind: exportKind,
+	}
+	if e.Status != ExportPending {
+		r.TTL = e.Expires.Unix()
+	}
+	err := d.put(r, e)
+	if err != nil {
+		return err
+	}
+
+	if e.TokenHash == "" {
+		return nil
+	}
+	return d.put(dynamoRecord{
+		ID:  exportTokenPrefix + e.TokenHash,
+		TTL: e.Expires.Unix(),
+	}, dynamoExportToken{
+		ID: e.ID,
+	})
+}
+
+// Token ...
+func (d DynamoExportStore) Token(hash string) (ExportJob, bool, error) {
+	t := dynamoExportToken{}
+	ok, err := d.get(exportTokenPrefix+hash, &t)
+	if err != nil || !ok {
+		return ExportJob{}, false, err
+	}
+
+	e := ExportJob{}
+	ok, err = d.get(exportPrefix+t.ID, &e)
+	return e, ok, err
+}
+
+// exports every export that hasn't expired
+func (d DynamoExportStore) exports() ([]ExportJob, error) {
+	all := []ExportJob{}
+	err := d.kind(exportKind, func(item map[string]*dynamodb.AttributeValue) error {
+		e := ExportJob{}
+		ok, err := d.unmarshal(item, &e)
+		if err != nil || !ok {
+			return err
+		}
+		all = append(all, e)
+		return nil
+	})
+
+	return all, err
+}
+
+// remove the export and its token
+func (d DynamoExportStore) remove(e ExportJob) error {
+	if e.TokenHash != "" {
+		err := d.delete(exportTokenPrefix + e.TokenHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.delete(exportPrefix + e.ID)
+}
+
+// Pending ...
+func (d DynamoExportStore) Pending() ([]ExportJob, error) {
+	all, err := d.exports()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []ExportJob{}
+	for _, e := range all {
+		if e.Status == ExportPending {
+			pending = append(pending, e)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Requested.Before(pending[j].Requested)
+	})
+
+	return pending, nil
+}
+
+// Expire ...
+func (d DynamoExportStore) Expire(now time.Time) error {
+	all, err := d.exports()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range all {
+		if e.Status != ExportPending && !now.Before(e.Expires) {
+			err = d.remove(e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteIdentifier ...
+func (d DynamoExportStore) DeleteIdentifier(ident string) error {
+	all, err := d.exports()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range all {
+		if e.Identifier == ident {
+			err = d.remove(e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DynamoIdentityStore moved accounts in the store table, each is kept both ways
+type DynamoIdentityStore struct {
+	DynamoStore
+}
+
+type dynamoIdentity struct {
+	ID string
+}
+
+// Account ...
+func (d DynamoIdentityStore) Account(ident string) (string, bool, error) {
+	i := dynamoIdentity{}
+	ok, err := d.get(identityAccountPrefix+ident, &i)
+	return i.ID, ok, err
+}
+
+// Login ...
+func (d DynamoIdentityStore) Login(account string) (string, bool, error) {
+	i := dynamoIdentity{}
+	ok, err := d.get(identityLoginPrefix+account, &i)
+	return i.ID, ok, err
+}
+
+// Move back to the key the account was made under needs no entry
+func (d DynamoIdentityStore) Move(account, from, to string) error {
+	err := d.delete(identityAccountPrefix + from)
+	if err != nil {
+		return err
+	}
+	if to == account {
+		return d.delete(identityLoginPrefix + account)
+	}
+
+	err = d.put(dynamoRecord{
+		ID: identityAccountPrefix + to,
+	}, dynamoIdentity{
+		ID: account,
+	})
+	if err != nil {
+		return err
+	}
+	return d.put(dynamoRecord{
+		ID: identityLoginPrefix + account,
+	}, dynamoIdentity{
+		ID: to,
+	})
+}
+
+// Forget ...
+func (d DynamoIdentityStore) Forget(account string) error {
+	to, ok, err := d.Login(account)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = d.delete(identityAccountPrefix + to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.delete(identityLoginPrefix + account)
+}
+
+// DynamoEmailChangeStore changes in the store table, each token hash points at
+// its change and they all expire with it
+type DynamoEmailChangeStore struct {
+	DynamoStore
+}
+
+// Save a new change replaces the one before
+func (d DynamoEmailChangeStore) Save(c EmailChange) error {
+	err := d.put(dynamoRecord{
+		ID:  emailChangePrefix + c.Identifier,
+		TTL: c.Expires.Unix(),
+	}, c)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range []string{c.OldHash, c.NewHash} {
+		err = d.put(dynamoRecord{
+			ID:  emailChangeTokenPrefix + hash,
+			TTL: c.Expires.Unix(),
+		}, dynamoIdentity{
+			ID: c.Identifier,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Token ...
+func (d DynamoEmailChangeStore) Token(hash string) (EmailChange, bool, error) {
+	i := dynamoIdentity{}
+	ok, err := d.get(emailChangeTokenPrefix+hash, &i)
+	if err != nil || !ok {
+		return EmailChange{}, false, err
+	}
+
+	c := EmailChange{}
+	ok, err = d.get(emailChangePrefix+i.ID, &c)
+	if err != nil || !ok {
+		return EmailChange{}, false, err
+	}
+	// a token of a change that has been replaced
+	if c.OldHash != hash && c.NewHash != hash {
+		return EmailChange{}, false, nil
+	}
+
+	return c, true, nil
+}
+
+// Delete ...
+func (d DynamoEmailChangeStore) Delete(ident string) error {
+	c := EmailChange{}
+	ok, err := d.get(emailChangePrefix+ident, &c)
+	if err != nil {
+		return err
+	}
+	if ok {
+		for _, hash := range []string{c.OldHash, c.NewHash} {
+			err = d.delete(emailChangeTokenPrefix + hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.delete(emailChangePrefix + ident)
+}
@@ -0,0 +1,446 @@
+package service_test
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/carprks/account/service"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func dynamoStore() service.DynamoStore {
+	return service.DynamoStore{
+		Table:  "account",
+		Client: newFakeDynamo(),
+	}
+}
+
+func TestResetStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.ResetStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryResetStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoResetStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(time.Now().Unix(), 0).UTC()
+			first := service.ResetToken{Hash: "first", Email: "tester@carpark.ninja", Created: now.Add(-time.Minute), Expires: now.Add(service.ResetTTL)}
+			assert.Nil(t, test.store.Save(first))
+			got, err := test.store.Peek("first")
+			assert.Nil(t, err)
+			assert.Equal(t, first, got)
+
+			// a new token replaces the one before
+			second := service.ResetToken{Hash: "second", Email: "tester@carpark.ninja", Created: now, Expires: now.Add(service.ResetTTL)}
+			assert.Nil(t, test.store.Save(second))
+			_, err = test.store.Peek("first")
+			assert.True(t, errors.Is(err, service.ErrResetToken))
+			_, err = test.store.Take("first")
+			assert.True(t, errors.Is(err, service.ErrResetToken))
+
+			count, err := test.store.Requested("tester@carpark.ninja", now.Add(-service.ResetWindow))
+			assert.Nil(t, err)
+			assert.Equal(t, 2, count)
+			count, err = test.store.Requested("tester@carpark.ninja", now.Add(-time.Second))
+			assert.Nil(t, err)
+			assert.Equal(t, 1, count)
+			count, err = test.store.Requested("other@carpark.ninja", now.Add(-service.ResetWindow))
+			assert.Nil(t, err)
+			assert.Equal(t, 0, count)
+
+			// only taken once
+			got, err = test.store.Take("second")
+			assert.Nil(t, err)
+			assert.Equal(t, "tester@carpark.ninja", got.Email)
+			_, err = test.store.Take("second")
+			assert.True(t, errors.Is(err, service.ErrResetToken))
+			_, err = test.store.Peek("second")
+			assert.True(t, errors.Is(err, service.ErrResetToken))
+		})
+	}
+}
+
+func TestCheckStores(t *testing.T) {
+	table := os.Getenv("ACCOUNT_TABLE")
+	if table != "" {
+		t.Skip("the stores are in ACCOUNT_TABLE")
+	}
+	defer os.Unsetenv("ACCOUNT_TABLE")
+
+	assert.Nil(t, os.Unsetenv("ACCOUNT_TABLE"))
+	assert.EqualError(t, service.CheckStores(), "ACCOUNT_TABLE isn't set")
+
+	// the stores were picked before the table was, so they're only in memory
+	assert.Nil(t, os.Setenv("ACCOUNT_TABLE", "account"))
+	assert.EqualError(t, service.CheckStores(), "resets aren't kept in ACCOUNT_TABLE")
+}
+
+func TestVerificationStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.VerificationStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryVerificationStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoVerificationStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			_, ok, err := test.store.Get("ident")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			v := service.Verification{
+				Identifier: "ident",
+				Email:      "tester@carpark.ninja",
+				Sent:       time.Unix(time.Now().Unix(), 0).UTC(),
+			}
+			assert.Nil(t, test.store.Save(v))
+			got, ok, err := test.store.Get("ident")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, v, got)
+		})
+	}
+}
+
+func TestMFAStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.MFAStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryMFAStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoMFAStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			m := service.MFA{
+				Identifier: "ident",
+				Secret:     "secret",
+				Enabled:    true,
+				Recovery:   []string{"hash-1"},
+				LastStep:   1,
+			}
+			assert.Nil(t, test.store.Save(m))
+			got, ok, err := test.store.Get("ident")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, m, got)
+			assert.Nil(t, test.store.Delete("ident"))
+			_, ok, err = test.store.Get("ident")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			p := service.PendingLogin{
+				Hash:       "challenge",
+				Identifier: "ident",
+				Email:      "tester@carpark.ninja",
+				Expires:    time.Unix(time.Now().Add(time.Minute).Unix(), 0).UTC(),
+			}
+			assert.Nil(t, test.store.SavePending(p))
+			pending, ok, err := test.store.TakePending("challenge")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, p, pending)
+
+			// it can only be taken once
+			_, ok, err = test.store.TakePending("challenge")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestAttemptStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.AttemptStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryAttemptStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoAttemptStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(time.Now().Unix(), 0).UTC()
+			window := time.Minute
+
+			for i := 1; i <= 3; i++ {
+				a, err := test.store.Fail("email#tester", now, window)
+				assert.Nil(t, err)
+				assert.Equal(t, i, a.Failures)
+			}
+			a, err := test.store.Get("email#tester")
+			assert.Nil(t, err)
+			assert.Equal(t, service.Attempts{Failures: 3, Last: now}, a)
+
+			// failures outside the window are forgotten
+			a, err = test.store.Fail("email#tester", now.Add(window), window)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, a.Failures)
+
+			assert.Nil(t, test.store.Clear("email#tester"))
+			a, err = test.store.Get("email#tester")
+			assert.Nil(t, err)
+			assert.Equal(t, 0, a.Failures)
+			a, err = test.store.Fail("email#tester", now, window)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, a.Failures)
+		})
+	}
+}
+
+func TestDeletionStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.DeletionStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryDeletionStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoDeletionStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(time.Now().Unix(), 0).UTC()
+			soon := service.Deletion{Identifier: "ident-1", Requested: now, Due: now.Add(time.Hour)}
+			later := service.Deletion{Identifier: "ident-2", Requested: now, Due: now.Add(time.Hour * 2)}
+			assert.Nil(t, test.store.Save(soon))
+			assert.Nil(t, test.store.Save(later))
+
+			got, ok, err := test.store.Get("ident-1")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, soon, got)
+
+			due, err := test.store.Due(now)
+			assert.Nil(t, err)
+			assert.Len(t, due, 0)
+			due, err = test.store.Due(now.Add(time.Hour))
+			assert.Nil(t, err)
+			assert.Equal(t, []service.Deletion{soon}, due)
+
+			assert.Nil(t, test.store.Delete("ident-1"))
+			_, ok, err = test.store.Get("ident-1")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			due, err = test.store.Due(now.Add(time.Hour * 2))
+			assert.Nil(t, err)
+			assert.Equal(t, []service.Deletion{later}, due)
+		})
+	}
+}
+
+func TestExportStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.ExportStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryExportStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoExportStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(time.Now().Unix(), 0).UTC()
+			pending := service.ExportJob{ID: "export-1", Identifier: "ident-1", Status: service.ExportPending, Requested: now}
+			ready := service.ExportJob{ID: "export-2", Identifier: "ident-1", Status: service.ExportReady, Requested: now.Add(-time.Minute), TokenHash: "hash-2", Expires: now.Add(time.Hour), Archive: []byte("zip")}
+			other := service.ExportJob{ID: "export-3", Identifier: "ident-2", Status: service.ExportPending, Requested: now.Add(time.Minute)}
+			for _, e := range []service.ExportJob{pending, ready, other} {
+				assert.Nil(t, test.store.Save(e))
+			}
+
+			got, ok, err := test.store.Token("hash-2")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, ready, got)
+			_, ok, err = test.store.Token("hash-1")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			all, err := test.store.Pending()
+			assert.Nil(t, err)
+			assert.Equal(t, []service.ExportJob{pending, other}, all)
+
+			// only finished exports expire
+			assert.Nil(t, test.store.Expire(now.Add(time.Hour)))
+			_, ok, err = test.store.Token("hash-2")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			all, err = test.store.Pending()
+			assert.Nil(t, err)
+			assert.Len(t, all, 2)
+
+			assert.Nil(t, test.store.DeleteIdentifier("ident-1"))
+			all, err = test.store.Pending()
+			assert.Nil(t, err)
+			assert.Equal(t, []service.ExportJob{other}, all)
+		})
+	}
+}
+
+func TestIdentityStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.IdentityStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryIdentityStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoIdentityStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Nil(t, test.store.Move("account", "account", "login-1"))
+			assert.Nil(t, test.store.Move("account", "login-1", "login-2"))
+			a, ok, err := test.store.Account("login-2")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "account", a)
+			_, ok, err = test.store.Account("login-1")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			l, ok, err := test.store.Login("account")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "login-2", l)
+
+			// back where it started needs no entry
+			assert.Nil(t, test.store.Move("account", "login-2", "account"))
+			_, ok, err = test.store.Login("account")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			assert.Nil(t, test.store.Move("account", "account", "login-3"))
+			assert.Nil(t, test.store.Forget("account"))
+			_, ok, err = test.store.Account("login-3")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			_, ok, err = test.store.Login("account")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestEmailChangeStores(t *testing.T) {
+	stores := []struct {
+		name  string
+		store service.EmailChangeStore
+	}{
+		{
+			name:  "memory",
+			store: service.NewMemoryEmailChangeStore(),
+		},
+		{
+			name:  "dynamo",
+			store: service.DynamoEmailChangeStore{DynamoStore: dynamoStore()},
+		},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			expires := time.Unix(time.Now().Unix(), 0).UTC().Add(time.Hour)
+			first := service.EmailChange{Identifier: "ident", NewEmail: "first@carpark.ninja", OldHash: "old-1", NewHash: "new-1", Expires: expires}
+			assert.Nil(t, test.store.Save(first))
+			got, ok, err := test.store.Token("new-1")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, first, got)
+
+			// a new change replaces the one before, its tokens stop working
+			second := service.EmailChange{Identifier: "ident", NewEmail: "second@carpark.ninja", OldHash: "old-2", NewHash: "new-2", Expires: expires}
+			assert.Nil(t, test.store.Save(second))
+			_, ok, err = test.store.Token("old-1")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			got, ok, err = test.store.Token("old-2")
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, second, got)
+
+			assert.Nil(t, test.store.Delete("ident"))
+			_, ok, err = test.store.Token("new-2")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+// racingDynamo writes the item behind the store's back before every put, the
+// way another instance would
+type racingDynamo struct {
+	*fakeDynamo
+	races int
+}
+
+func (r *racingDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if r.races > 0 {
+		r.races--
+		other := service.DynamoAttemptStore{DynamoStore: service.DynamoStore{Table: "account", Client: r.fakeDynamo}}
+		_, err := other.Fail("email#tester", time.Now(), time.Minute)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r.fakeDynamo.PutItemWithContext(ctx, input, opts...)
+}
+
+func TestDynamoAttemptStoreRace(t *testing.T) {
+	client := &racingDynamo{fakeDynamo: newFakeDynamo(), races: 2}
+	store := service.DynamoAttemptStore{DynamoStore: service.DynamoStore{Table: "account", Client: client}}
+
+	// neither of the other writes is lost
+	a, err := store.Fail("email#tester", time.Now(), time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, a.Failures)
+}
@@ -0,0 +1,477 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	permissions "github.com/carprks/permissions/service"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// AccessTTL how long an access token can be used for
+	AccessTTL = time.Minute * 15
+	// RefreshTTL how long a refresh token can be used for
+	RefreshTTL = time.Hour * 24 * 30
+
+	// TokenIssuer the iss claim of every access token
+	TokenIssuer = "carprks/account"
+
+	// AlgHS256 HMAC SHA-256, the key is a shared secret so it isn't published
+	AlgHS256 = "HS256"
+	// AlgRS256 RSA PKCS#1 v1.5 SHA-256
+	AlgRS256 = "RS256"
+	// AlgEdDSA Ed25519
+	AlgEdDSA = "EdDSA"
+)
+
+// ErrToken the access token is invalid or has expired
+var ErrToken = WithKind(ErrUnauthorized, fmt.Errorf("invalid or expired token"))
+
+// TokenKey signs and checks access tokens
+type TokenKey interface {
+	Alg() string
+	ID() string
+	Sign(input []byte) ([]byte, error)
+	Verify(input, sig []byte) error
+	// JWK the public half of the key, symmetric keys can't be published
+	JWK() (JWK, bool)
+}
+
+// JWK a public key in a JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS the keys access tokens can be checked with
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// HMACKey HS256
+type HMACKey struct {
+	KeyID  string
+	Secret []byte
+}
+
+// Alg ...
+func (k HMACKey) Alg() string {
+	return AlgHS256
+}
+
+// ID ...
+func (k HMACKey) ID() string {
+	return k.KeyID
+}
+
+// Sign ...
+func (k HMACKey) Sign(input []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k.Secret)
+	_, _ = mac.Write(input)
+	return mac.Sum(nil), nil
+}
+
+// Verify ...
+func (k HMACKey) Verify(input, sig []byte) error {
+	expect, _ := k.Sign(input)
+	if !hmac.Equal(expect, sig) {
+		return ErrToken
+	}
+
+	return nil
+}
+
+// JWK ...
+func (k HMACKey) JWK() (JWK, bool) {
+	return JWK{}, false
+}
+
+// RSAKey RS256
+type RSAKey struct {
+	KeyID string
+	Key   *rsa.PrivateKey
+}
+
+// Alg ...
+func (k RSAKey) Alg() string {
+	return AlgRS256
+}
+
+// ID ...
+func (k RSAKey) ID() string {
+	return k.KeyID
+}
+
+// Sign ...
+func (k RSAKey) Sign(input []byte) ([]byte, error) {
+	h := sha256.Sum256(input)
+	return rsa.SignPKCS1v15(rand.Reader, k.Key, crypto.SHA256, h[:])
+}
+
+// Verify ...
+func (k RSAKey) Verify(input, sig []byte) error {
+	h := sha256.Sum256(input)
+	if rsa.VerifyPKCS1v15(&k.Key.PublicKey, crypto.SHA256, h[:], sig) != nil {
+		return ErrToken
+	}
+
+	return nil
+}
+
+// JWK ...
+func (k RSAKey) JWK() (JWK, bool) {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: AlgRS256,
+		Kid: k.KeyID,
+		N:   base64.RawURLEncoding.EncodeToString(k.Key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.Key.E)).Bytes()),
+	}, true
+}
+
+// EdDSAKey Ed25519
+type EdDSAKey struct {
+	KeyID string
+	Key   ed25519.PrivateKey
+}
+
+// Alg ...
+func (k EdDSAKey) Alg() string {
+	return AlgEdDSA
+}
+
+// ID ...
+func (k EdDSAKey) ID() string {
+	return k.KeyID
+}
+
+// Sign ...
+func (k EdDSAKey) Sign(input []byte) ([]byte, error) {
+	return ed25519.Sign(k.Key, input), nil
+}
+
+// Verify ...
+func (k EdDSAKey) Verify(input, sig []byte) error {
+	if !ed25519.Verify(k.Key.Public().(ed25519.PublicKey), input, sig) {
+		return ErrToken
+	}
+
+	return nil
+}
+
+// JWK ...
+func (k EdDSAKey) JWK() (JWK, bool) {
+	return JWK{
+		Kty: "OKP",
+		Use: "sig",
+		Alg: AlgEdDSA,
+		Kid: k.KeyID,
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(k.Key.Public().(ed25519.PublicKey)),
+	}, true
+}
+
+// ParseTokenKey the key for alg, HS256 takes the secret itself and the others
+// a PEM encoded private key
+func ParseTokenKey(alg, kid string, key []byte) (TokenKey, error) {
+	if alg == AlgHS256 {
+		if len(key) == 0 {
+			return nil, errors.New("empty HS256 secret")
+		}
+		return HMACKey{KeyID: kid, Secret: key}, nil
+	}
+
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, fmt.Errorf("%s key isn't PEM", alg)
+	}
+
+	var priv interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s key: %w", alg, err)
+	}
+
+	switch alg {
+	case AlgRS256:
+		k, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("RS256 needs an RSA key")
+		}
+		return RSAKey{KeyID: kid, Key: k}, nil
+	case AlgEdDSA:
+		k, ok := priv.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("EdDSA needs an Ed25519 key")
+		}
+		return EdDSAKey{KeyID: kid, Key: k}, nil
+	}
+
+	return nil, fmt.Errorf("unknown token alg: %s", alg)
+}
+
+// TokenConfig how access and refresh tokens are issued
+type TokenConfig struct {
+	Key TokenKey
+	// Previous keys tokens are still checked with and published for after a
+	// rotation, until everything they signed has expired
+	Previous   []TokenKey
+	Issuer     string
+	TTL        time.Duration
+	RefreshTTL time.Duration
+}
+
+// ErrTokenKey TOKEN_KEY isn't set, nothing can be signed or checked
+var ErrTokenKey = fmt.Errorf("TOKEN_KEY isn't set")
+
+// previousTokenKey an entry in TOKEN_PREVIOUS_KEYS
+type previousTokenKey struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Key string `json:"key"`
+}
+
+// NewTokenConfig config from TOKEN_ALG, TOKEN_KEY, TOKEN_KID and
+// TOKEN_PREVIOUS_KEYS, a json list of {alg, kid, key}, every instance has to
+// sign with the same key so there is no fallback
+func NewTokenConfig() (TokenConfig, error) {
+	c := TokenConfig{
+		Issuer:     TokenIssuer,
+		TTL:        AccessTTL,
+		RefreshTTL: RefreshTTL,
+	}
+
+	key := os.Getenv("TOKEN_KEY")
+	if key == "" {
+		return c, ErrTokenKey
+	}
+	alg := os.Getenv("TOKEN_ALG")
+	if alg == "" {
+		alg = AlgHS256
+	}
+	kid := os.Getenv("TOKEN_KID")
+	if kid == "" {
+		kid = "default"
+	}
+	k, err := ParseTokenKey(alg, kid, []byte(key))
+	if err != nil {
+		return c, fmt.Errorf("can't load token key %s: %w", kid, err)
+	}
+
+	var previous []previousTokenKey
+	if p := os.Getenv("TOKEN_PREVIOUS_KEYS"); p != "" {
+		err = json.Unmarshal([]byte(p), &previous)
+		if err != nil {
+			return c, fmt.Errorf("can't parse TOKEN_PREVIOUS_KEYS: %w", err)
+		}
+	}
+	kids := map[string]bool{kid: true}
+	for _, p := range previous {
+		if kids[p.Kid] {
+			return c, fmt.Errorf("token kid %q is used more than once", p.Kid)
+		}
+		kids[p.Kid] = true
+
+		pk, err := ParseTokenKey(p.Alg, p.Kid, []byte(p.Key))
+		if err != nil {
+			return c, fmt.Errorf("can't load token key %s: %w", p.Kid, err)
+		}
+		c.Previous = append(c.Previous, pk)
+	}
+	c.Key = k
+
+	return c, nil
+}
+
+// tokenConfig main checks NewTokenConfig before starting so without a key
+// only tokens fail
+func tokenConfig() TokenConfig {
+	c, err := NewTokenConfig()
+	if err != nil {
+		DefaultLogger.Error("can't load token config", Fields{"err": err})
+	}
+
+	return c
+}
+
+// key the key that signed tokens with kid
+func (c TokenConfig) key(kid string) (TokenKey, bool) {
+	for _, k := range append([]TokenKey{c.Key}, c.Previous...) {
+		if k != nil && k.ID() == kid {
+			return k, true
+		}
+	}
+
+	return nil, false
+}
+
+// Claims what an access token says about the account
+type Claims struct {
+	Issuer      string                   `json:"iss"`
+	Subject     string                   `json:"sub"`
+	IssuedAt    int64                    `json:"iat"`
+	Expires     int64                    `json:"exp"`
+	ID          string                   `json:"jti"`
+	Session     string                   `json:"sid,omitempty"`
+	Permissions []permissions.Permission `json:"permissions"`
+	Unverified  bool                     `json:"unverified,omitempty"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Sign the claims as a JWT
+func (c TokenConfig) Sign(claims Claims) (string, error) {
+	if c.Key == nil {
+		return "", ErrTokenKey
+	}
+
+	h, err := json.Marshal(tokenHeader{
+		Alg: c.Key.Alg(),
+		Typ: "JWT",
+		Kid: c.Key.ID(),
+	})
+	if err != nil {
+		return "", err
+	}
+	j, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(j)
+	sig, err := c.Key.Sign([]byte(input))
+	if err != nil {
+		return "", fmt.Errorf("can't sign token: %w", err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Parse check the JWT was signed with the key, or a previous one, and hasn't
+// expired
+func (c TokenConfig) Parse(token string, now time.Time) (Claims, error) {
+	claims := Claims{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrToken
+	}
+
+	hj, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrToken
+	}
+	h := tokenHeader{}
+	err = json.Unmarshal(hj, &h)
+	if err != nil {
+		return claims, ErrToken
+	}
+	// the alg comes from the key, never from the token
+	k, ok := c.key(h.Kid)
+	if !ok || h.Alg != k.Alg() {
+		return claims, ErrToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrToken
+	}
+	err = k.Verify([]byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return claims, ErrToken
+	}
+
+	j, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrToken
+	}
+	err = json.Unmarshal(j, &claims)
+	if err != nil {
+		return claims, ErrToken
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, ErrToken
+	}
+
+	return claims, nil
+}
+
+// JWKS the published keys, the current one first, HS256 keys aren't published
+func (c TokenConfig) JWKS() JWKS {
+	jwks := JWKS{
+		Keys: []JWK{},
+	}
+	for _, k := range append([]TokenKey{c.Key}, c.Previous...) {
+		if k == nil {
+			continue
+		}
+		if j, ok := k.JWK(); ok {
+			jwks.Keys = append(jwks.Keys, j)
+		}
+	}
+
+	return jwks
+}
+
+type accessTokenKey struct{}
+
+// WithAccessToken ctx carrying the access token the request was sent with
+func WithAccessToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, accessTokenKey{}, token)
+}
+
+// AccessToken the access token the request was sent with, if any
+func AccessToken(ctx context.Context) string {
+	token, _ := ctx.Value(accessTokenKey{}).(string)
+	return token
+}
+
+// JWKSHandler ...
+func JWKSHandler() (string, error) {
+	return NewService().JWKSHandler(context.Background())
+}
+
+// JWKSHandler the keys other services use to check access tokens
+func (s Service) JWKSHandler(ctx context.Context) (string, error) {
+	j, err := json.Marshal(s.Tokens.JWKS())
+	if err != nil {
+		s.Logger.Error("can't marshall jwks", Fields{"err": err})
+		return "", fmt.Errorf("can't marshall jwks: %w", err)
+	}
+
+	return string(j), nil
+}
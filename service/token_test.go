@@ -0,0 +1,331 @@
+package service_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rsaPEM(t *testing.T) []byte {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(k),
+	})
+}
+
+func ed25519PEM(t *testing.T) []byte {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(k)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: b,
+	})
+}
+
+// verifyWithJWK check a token the way another service would, with nothing but the jwks
+func verifyWithJWK(t *testing.T, jwk service.JWK, token string) bool {
+	parts := strings.Split(token, ".")
+	if !assert.Len(t, parts, 3) {
+		return false
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.Nil(t, err)
+
+	switch jwk.Kty {
+	case "RSA":
+		n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		h := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+	case "OKP":
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		return ed25519.Verify(ed25519.PublicKey(x), input, sig)
+	}
+
+	return false
+}
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		alg       string
+		key       []byte
+		published bool
+	}{
+		{
+			name: "hs256",
+			alg:  service.AlgHS256,
+			key:  []byte("hunter2hunter2hunter2"),
+		},
+		{
+			name:      "rs256",
+			alg:       service.AlgRS256,
+			key:       rsaPEM(t),
+			published: true,
+		},
+		{
+			name:      "eddsa",
+			alg:       service.AlgEdDSA,
+			key:       ed25519PEM(t),
+			published: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := service.ParseTokenKey(test.alg, "key-1", test.key)
+			if !assert.Nil(t, err) {
+				return
+			}
+			c := service.TokenConfig{Key: key}
+
+			now := time.Now()
+			token, err := c.Sign(service.Claims{
+				Subject: "5f46cf19-5399-55e3-aa62-0e7c19382250",
+				Expires: now.Add(time.Minute).Unix(),
+			})
+			assert.Nil(t, err)
+
+			claims, err := c.Parse(token, now)
+			assert.Nil(t, err)
+			assert.Equal(t, "5f46cf19-5399-55e3-aa62-0e7c19382250", claims.Subject)
+
+			_, err = c.Parse(token, now.Add(time.Minute))
+			assert.Equal(t, service.ErrToken, err)
+			_, err = c.Parse(token[:len(token)-2], now)
+			assert.Equal(t, service.ErrToken, err)
+
+			jwks := c.JWKS()
+			if !test.published {
+				assert.Empty(t, jwks.Keys)
+				return
+			}
+			if assert.Len(t, jwks.Keys, 1) {
+				assert.Equal(t, "key-1", jwks.Keys[0].Kid)
+				assert.Equal(t, test.alg, jwks.Keys[0].Alg)
+				assert.True(t, verifyWithJWK(t, jwks.Keys[0], token))
+			}
+		})
+	}
+}
+
+func TestTokensWrongAlg(t *testing.T) {
+	rs, err := service.ParseTokenKey(service.AlgRS256, "key-1", rsaPEM(t))
+	assert.Nil(t, err)
+	c := service.TokenConfig{Key: rs}
+
+	// a token signed with the public key as an hmac secret
+	jwk, _ := rs.JWK()
+	hs := service.TokenConfig{
+		Key: service.HMACKey{
+			KeyID:  "key-1",
+			Secret: []byte(jwk.N),
+		},
+	}
+	token, err := hs.Sign(service.Claims{
+		Subject: "5f46cf19-5399-55e3-aa62-0e7c19382250",
+		Expires: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.Nil(t, err)
+
+	_, err = c.Parse(token, time.Now())
+	assert.Equal(t, service.ErrToken, err)
+}
+
+func TestLoginTokens(t *testing.T) {
+	key, err := service.ParseTokenKey(service.AlgEdDSA, "key-1", ed25519PEM(t))
+	assert.Nil(t, err)
+
+	s := service.NewService()
+	s.Verifications = service.NewMemoryVerificationStore()
+	s.Sessions = service.NewMemorySessionStore()
+	s.Tokens.Key = key
+
+	_, err = s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	lo, err := s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer", lo.TokenType)
+	assert.Equal(t, int64(service.AccessTTL/time.Second), lo.ExpiresIn)
+	assert.NotEmpty(t, lo.RefreshToken)
+
+	claims, err := s.Tokens.Parse(lo.AccessToken, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, lo.Identifier, claims.Subject)
+	assert.Equal(t, service.TokenIssuer, claims.Issuer)
+	assert.Equal(t, lo.Permissions, claims.Permissions)
+	assert.NotEmpty(t, claims.Session)
+
+	// the refresh token is opaque and isn't the access token
+	assert.Equal(t, 1, strings.Count(lo.RefreshToken+".", "."))
+	assert.NotEqual(t, lo.AccessToken, lo.RefreshToken)
+
+	response, err := s.Handler(context.Background(), events.APIGatewayProxyRequest{
+		Resource: "/.well-known/jwks.json",
+	})
+	assert.Nil(t, err)
+	jwks := service.JWKS{}
+	assert.Nil(t, json.Unmarshal([]byte(response.Body), &jwks))
+	if assert.Len(t, jwks.Keys, 1) {
+		assert.True(t, verifyWithJWK(t, jwks.Keys[0], lo.AccessToken))
+	}
+
+	deleteAccount(lo.Identifier)
+}
+
+func TestNewTokenConfig(t *testing.T) {
+	env := map[string]string{}
+	for _, k := range []string{"TOKEN_ALG", "TOKEN_KEY", "TOKEN_KID", "TOKEN_PREVIOUS_KEYS"} {
+		env[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range env {
+			_ = os.Setenv(k, v)
+		}
+	}()
+
+	previous, err := json.Marshal([]map[string]string{
+		{"alg": service.AlgEdDSA, "kid": "key-1", "key": string(ed25519PEM(t))},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		err      bool
+		previous int
+	}{
+		{
+			name: "missing",
+			env:  map[string]string{},
+			err:  true,
+		},
+		{
+			name: "invalid",
+			env: map[string]string{
+				"TOKEN_ALG": service.AlgRS256,
+				"TOKEN_KEY": "not a pem",
+			},
+			err: true,
+		},
+		{
+			name: "hs256",
+			env: map[string]string{
+				"TOKEN_KEY": "token-key",
+			},
+		},
+		{
+			name: "rotated",
+			env: map[string]string{
+				"TOKEN_ALG":           service.AlgRS256,
+				"TOKEN_KEY":           string(rsaPEM(t)),
+				"TOKEN_KID":           "key-2",
+				"TOKEN_PREVIOUS_KEYS": string(previous),
+			},
+			previous: 1,
+		},
+		{
+			name: "kid reused",
+			env: map[string]string{
+				"TOKEN_KEY":           "token-key",
+				"TOKEN_KID":           "key-1",
+				"TOKEN_PREVIOUS_KEYS": string(previous),
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k := range env {
+				_ = os.Setenv(k, test.env[k])
+			}
+
+			c, err := service.NewTokenConfig()
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.NotNil(t, c.Key)
+			assert.Len(t, c.Previous, test.previous)
+		})
+	}
+}
+
+func TestTokensRotated(t *testing.T) {
+	old, err := service.ParseTokenKey(service.AlgEdDSA, "key-1", ed25519PEM(t))
+	assert.Nil(t, err)
+	current, err := service.ParseTokenKey(service.AlgRS256, "key-2", rsaPEM(t))
+	assert.Nil(t, err)
+
+	now := time.Now()
+	claims := service.Claims{
+		Subject: "5f46cf19-5399-55e3-aa62-0e7c19382250",
+		Expires: now.Add(time.Minute).Unix(),
+	}
+	before, err := service.TokenConfig{Key: old}.Sign(claims)
+	assert.Nil(t, err)
+
+	c := service.TokenConfig{
+		Key:      current,
+		Previous: []service.TokenKey{old},
+	}
+	after, err := c.Sign(claims)
+	assert.Nil(t, err)
+
+	// tokens signed before the rotation carry on until they expire
+	for _, token := range []string{before, after} {
+		_, err = c.Parse(token, now)
+		assert.Nil(t, err)
+	}
+	jwks := c.JWKS()
+	if assert.Len(t, jwks.Keys, 2) {
+		assert.Equal(t, "key-2", jwks.Keys[0].Kid)
+		assert.True(t, verifyWithJWK(t, jwks.Keys[1], before))
+	}
+
+	// once the old key is dropped its tokens stop working
+	c.Previous = nil
+	_, err = c.Parse(before, now)
+	assert.Equal(t, service.ErrToken, err)
+
+	// and without a key nothing is signed
+	_, err = service.TokenConfig{}.Sign(claims)
+	assert.Equal(t, service.ErrTokenKey, err)
+	_, err = service.TokenConfig{}.Parse(after, now)
+	assert.Equal(t, service.ErrToken, err)
+}
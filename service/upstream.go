@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// RetryAttempts how many times an idempotent call is tried
+	RetryAttempts = 3
+	// RetryBase the backoff before the first retry, it doubles each retry
+	RetryBase = time.Millisecond * 100
+	// RetryMax the longest backoff between retries
+	RetryMax = time.Second
+
+	// BreakerThreshold consecutive failures before the breaker opens
+	BreakerThreshold = 5
+	// BreakerCooldown how long the breaker stays open before letting a call through
+	BreakerCooldown = time.Second * 30
+)
+
+// Breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrBreakerOpen the upstream has been failing so the call wasn't made
+var ErrBreakerOpen = WithKind(ErrUpstream, errors.New("circuit open"))
+
+// upstreamMetrics retries and breaker state per upstream, published with expvar
+var upstreamMetrics = expvar.NewMap("upstream")
+
+// breakers kept across invocations of a warm lambda
+var (
+	loginBreaker       = NewBreaker("login")
+	permissionsBreaker = NewBreaker("permissions")
+)
+
+// Retry bounded exponential backoff with full jitter
+type Retry struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+// NewRetry the default retry policy
+func NewRetry() Retry {
+	return Retry{
+		Attempts: RetryAttempts,
+		Base:     RetryBase,
+		Max:      RetryMax,
+	}
+}
+
+// backoff how long to wait before the retry after attempt
+func (r Retry) backoff(attempt int) time.Duration {
+	d := r.Base << uint(attempt)
+	if d <= 0 || (r.Max > 0 && d > r.Max) {
+		d = r.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// Breaker fails calls fast once an upstream keeps failing, after the cooldown
+// a single call is let through to see if it has recovered
+type Breaker struct {
+	sync.Mutex
+
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+
+	// Clock defaults to time.Now
+	Clock func() time.Time
+
+	state    string
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// NewBreaker closed breaker with the default threshold and cooldown
+func NewBreaker(name string) *Breaker {
+	b := &Breaker{
+		Name:      name,
+		Threshold: BreakerThreshold,
+		Cooldown:  BreakerCooldown,
+		state:     BreakerClosed,
+	}
+	upstreamMetrics.Set(name+".state", expvar.Func(func() interface{} {
+		return b.State()
+	}))
+
+	return b
+}
+
+func (b *Breaker) now() time.Time {
+	if b.Clock == nil {
+		return time.Now()
+	}
+
+	return b.Clock()
+}
+
+// State closed, open or half-open
+func (b *Breaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.state == "" {
+		return BreakerClosed
+	}
+
+	return b.state
+}
+
+// Reset close the breaker and forget past failures
+func (b *Breaker) Reset() {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// allow whether a call can be made
+func (b *Breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.opened) < b.Cooldown {
+			return ErrBreakerOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// record the outcome of a call, only upstream errors count against it
+func (b *Breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if !errors.Is(err, ErrUpstream) {
+		b.failures = 0
+		b.state = BreakerClosed
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		if b.state != BreakerOpen {
+			upstreamMetrics.Add(b.Name+".opened", 1)
+		}
+		b.state = BreakerOpen
+		b.opened = b.now()
+	}
+}
+
+// Upstream how calls to one of the services are retried and broken
+type Upstream struct {
+	Name    string
+	Retry   Retry
+	Breaker *Breaker
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey calls made with ctx carry key, so the upstream can spot a
+// retry and it's safe to retry calls that aren't idempotent
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKey the key set with WithIdempotencyKey
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// retryable upstream errors might go away, anything else won't
+func retryable(err error) bool {
+	return errors.Is(err, ErrUpstream) && !errors.Is(err, ErrBreakerOpen)
+}
+
+// call run fn against the upstream, each attempt gets its own call budget and
+// only idempotent calls are retried
+func (s Service) call(ctx context.Context, u Upstream, idempotent bool, fn func(ctx context.Context) error) error {
+	attempts := u.Retry.Attempts
+	if !idempotent || attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := u.Breaker.allow()
+		if err != nil {
+			upstreamMetrics.Add(u.Name+".rejected", 1)
+			return fmt.Errorf("%s: %w", u.Name, err)
+		}
+
+		cctx, cancel := s.Budget.call(ctx)
+		err = fn(cctx)
+		cancel()
+		u.Breaker.record(err)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrUpstream) {
+			upstreamMetrics.Add(u.Name+".failures", 1)
+		}
+
+		if !retryable(err) || attempt+1 >= attempts || ctx.Err() != nil {
+			return err
+		}
+
+		upstreamMetrics.Add(u.Name+".retries", 1)
+		s.Logger.Warn("retrying upstream", Fields{"err": err, "upstream": u.Name, "attempt": attempt + 1})
+		select {
+		case <-time.After(u.Retry.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	permissions "github.com/carprks/permissions/service"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// upstreamService fast retries and its own breakers
+func upstreamService() service.Service {
+	s := service.NewService()
+	s.Verifications = service.NewMemoryVerificationStore()
+	retry := service.Retry{
+		Attempts: service.RetryAttempts,
+		Base:     time.Millisecond,
+		Max:      time.Millisecond * 5,
+	}
+	s.LoginUpstream.Retry = retry
+	s.LoginUpstream.Breaker = service.NewBreaker("login")
+	s.PermissionsUpstream.Retry = retry
+	s.PermissionsUpstream.Breaker = service.NewBreaker("permissions")
+
+	return s
+}
+
+var allowedRequest = permissions.Permissions{
+	Identifier: "5f46cf19-5399-55e3-aa62-0e7c19382250",
+	Permissions: []permissions.Permission{
+		{
+			Name:   "account",
+			Action: "login",
+		},
+	},
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   func()
+		calls  int
+		status string
+		err    error
+	}{
+		{
+			name: "recovers",
+			fail: func() {
+				permissionsService.Fail("/allowed", http.StatusBadGateway)
+				permissionsService.Fail("/allowed", http.StatusServiceUnavailable)
+			},
+			calls:  3,
+			status: "allowed",
+		},
+		{
+			name: "gives up",
+			fail: func() {
+				permissionsService.Down("/allowed", http.StatusBadGateway)
+			},
+			calls: service.RetryAttempts,
+			err:   service.ErrUpstream,
+		},
+		{
+			name: "not an upstream error",
+			fail: func() {
+				permissionsService.FailWith("/allowed", `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","status":"denied"}`)
+			},
+			calls:  1,
+			status: "denied",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requireFakes(t)
+			s := upstreamService()
+			_, err := s.Register(context.Background(), login.RegisterRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "Carpark-Ninja-2019",
+				Verify:   "Carpark-Ninja-2019",
+			})
+			assert.Nil(t, err)
+
+			test.fail()
+			p, err := s.Allowed(context.Background(), allowedRequest)
+			if test.err != nil {
+				assert.True(t, errors.Is(err, test.err))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, test.status, p.Status)
+			assert.Equal(t, test.calls, permissionsService.Calls("/allowed"))
+
+			deleteAccount("5f46cf19-5399-55e3-aa62-0e7c19382250")
+		})
+	}
+}
+
+func TestUpstreamIdempotency(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		calls int
+		err   error
+	}{
+		{
+			name:  "no key",
+			calls: 1,
+			err:   service.ErrUpstream,
+		},
+		{
+			name:  "key",
+			key:   "register-1",
+			calls: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requireFakes(t)
+			loginService.Fail("/register", http.StatusBadGateway)
+
+			s := upstreamService()
+			ctx := service.WithIdempotencyKey(context.Background(), test.key)
+			_, err := s.CreateLogin(ctx, login.RegisterRequest{
+				Email:    "tester@carpark.ninja",
+				Password: "Carpark-Ninja-2019",
+				Verify:   "Carpark-Ninja-2019",
+			})
+			if test.err != nil {
+				assert.True(t, errors.Is(err, test.err))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, test.calls, loginService.Calls("/register"))
+
+			deleteAccount("5f46cf19-5399-55e3-aa62-0e7c19382250")
+		})
+	}
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	requireFakes(t)
+	now := time.Now()
+	s := upstreamService()
+	s.PermissionsUpstream.Retry.Attempts = 1
+	breaker := s.PermissionsUpstream.Breaker
+	breaker.Threshold = 2
+	breaker.Clock = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < 2; i++ {
+		permissionsService.Fail("/allowed", http.StatusBadGateway)
+		_, err := s.Allowed(context.Background(), allowedRequest)
+		assert.True(t, errors.Is(err, service.ErrUpstream))
+	}
+	assert.Equal(t, service.BreakerOpen, breaker.State())
+
+	// fails fast without calling the upstream
+	_, err := s.Allowed(context.Background(), allowedRequest)
+	assert.True(t, errors.Is(err, service.ErrBreakerOpen))
+	assert.Equal(t, 2, permissionsService.Calls("/allowed"))
+
+	// after the cooldown a call is let through and closes it again
+	now = now.Add(breaker.Cooldown)
+	_, err = s.Allowed(context.Background(), allowedRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, permissionsService.Calls("/allowed"))
+	assert.Equal(t, service.BreakerClosed, breaker.State())
+
+	// a failing probe opens it again straight away
+	for i := 0; i < 2; i++ {
+		permissionsService.Fail("/allowed", http.StatusBadGateway)
+		_, _ = s.Allowed(context.Background(), allowedRequest)
+	}
+	now = now.Add(breaker.Cooldown)
+	permissionsService.Fail("/allowed", http.StatusBadGateway)
+	_, _ = s.Allowed(context.Background(), allowedRequest)
+	assert.Equal(t, service.BreakerOpen, breaker.State())
+	breaker.Reset()
+
+	metrics := expvar.Get("upstream").(*expvar.Map)
+	assert.NotNil(t, metrics.Get("permissions.opened"))
+	assert.NotNil(t, metrics.Get("permissions.rejected"))
+	assert.Equal(t, `"closed"`, metrics.Get("permissions.state").String())
+}
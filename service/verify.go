@@ -1,15 +1,398 @@
 package service
 
 import (
-	permissions "github.com/carprks/permissions/service"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// VerifyTTL how long a verification token can be used for
+	VerifyTTL = time.Hour * 24
+	// VerifyCooldown how long before another verification can be sent
+	VerifyCooldown = time.Minute * 5
+
+	// VerifyLoginAllow unverified accounts can login as normal
+	VerifyLoginAllow = ""
+	// VerifyLoginFlag unverified accounts can login but are marked unverified
+	VerifyLoginFlag = "flag"
+	// VerifyLoginRefuse unverified accounts can't login
+	VerifyLoginRefuse = "refuse"
+)
+
+// ErrVerifyToken the token is invalid or has expired
+var ErrVerifyToken = WithKind(ErrValidation, fmt.Errorf("invalid or expired verification token"))
+
+// ErrUnverified the account hasn't been verified yet
+var ErrUnverified = WithKind(ErrUnauthorized, fmt.Errorf("account not verified"))
+
+// VerifyConfig how verification tokens are signed and used
+type VerifyConfig struct {
+	Key      []byte
+	TTL      time.Duration
+	Cooldown time.Duration
+	// Login one of VerifyLoginAllow, VerifyLoginFlag or VerifyLoginRefuse
+	Login string
+}
+
+// ErrVerifyKey VERIFY_KEY isn't set, nothing can be signed or checked
+var ErrVerifyKey = fmt.Errorf("VERIFY_KEY isn't set")
+
+// NewVerifyConfig config from VERIFY_KEY and VERIFY_LOGIN, every instance has
+// to sign with the same key so there is no fallback
+func NewVerifyConfig() (VerifyConfig, error) {
+	c := VerifyConfig{
+		Key:      []byte(os.Getenv("VERIFY_KEY")),
+		TTL:      VerifyTTL,
+		Cooldown: VerifyCooldown,
+		Login:    os.Getenv("VERIFY_LOGIN"),
+	}
+	if len(c.Key) == 0 {
+		return c, ErrVerifyKey
+	}
+
+	return c, nil
+}
+
+// verifyConfig loaded once, main checks NewVerifyConfig before starting so
+// without a key only verification fails
+var verifyConfig = func() VerifyConfig {
+	c, err := NewVerifyConfig()
+	if err != nil {
+		DefaultLogger.Error("can't load verify config", Fields{"err": err})
+	}
+
+	return c
+}()
+
+// Verification the verified state of an account
+type Verification struct {
+	Identifier string
+	Email      string
+	Verified   bool
+	Sent       time.Time
+}
+
+// VerificationStore where verification state is kept, accounts that aren't
+// in the store count as unverified
+type VerificationStore interface {
+	Get(ident string) (Verification, bool, error)
+	Save(v Verification) error
+}
+
+// newVerificationStore the store table when ACCOUNT_TABLE is set, otherwise
+// verifications only last as long as the lambda is warm
+func newVerificationStore() VerificationStore {
+	table, ok := accountTable()
+	if !ok {
+		return NewMemoryVerificationStore()
+	}
+
+	return DynamoVerificationStore{table}
+}
+
+// MemoryVerificationStore verification store that lives as long as the lambda is warm
+type MemoryVerificationStore struct {
+	sync.Mutex
+	verifications map[string]Verification
+}
+
+// NewMemoryVerificationStore ...
+func NewMemoryVerificationStore() *MemoryVerificationStore {
+	return &MemoryVerificationStore{
+		verifications: map[string]Verification{},
+	}
+}
+
+// Get ...
+func (m *MemoryVerificationStore) Get(ident string) (Verification, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	v, ok := m.verifications[ident]
+	return v, ok, nil
+}
+
+// Save ...
+func (m *MemoryVerificationStore) Save(v Verification) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.verifications[v.Identifier] = v
+	return nil
+}
+
+// verifyClaims what is signed into a verification token
+type verifyClaims struct {
+	Identifier string `json:"sub"`
+	Expires    int64  `json:"exp"`
+}
+
+func (c VerifyConfig) sign(claims verifyClaims) (string, error) {
+	if len(c.Key) == 0 {
+		return "", ErrVerifyKey
+	}
+
+	j, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(j)
+	mac := hmac.New(sha256.New, c.Key)
+	_, _ = mac.Write([]byte(payload))
+
+	return fmt.Sprintf("%s.%s", payload, base64.RawURLEncoding.EncodeToString(mac.Sum(nil))), nil
+}
+
+func (c VerifyConfig) parse(token string, now time.Time) (verifyClaims, error) {
+	claims := verifyClaims{}
+
+	if len(c.Key) == 0 {
+		return claims, ErrVerifyToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, ErrVerifyToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrVerifyToken
+	}
+	mac := hmac.New(sha256.New, c.Key)
+	_, _ = mac.Write([]byte(parts[0]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, ErrVerifyToken
+	}
+
+	j, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrVerifyToken
+	}
+	err = json.Unmarshal(j, &claims)
+	if err != nil {
+		return claims, ErrVerifyToken
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, ErrVerifyToken
+	}
+
+	return claims, nil
+}
+
+// VerifyRequest the token that was sent
+type VerifyRequest struct {
+	Token string `json:"token"`
+}
+
+// VerifyResend ask for the verification to be sent again
+type VerifyResend struct {
+	Email string `json:"email"`
+}
+
+// VerifyObject ...
+type VerifyObject struct {
+	Identifier string `json:"identifier,omitempty"`
+	Status     string `json:"status"`
+}
+
 // VerifyHandler ...
 func VerifyHandler(body string) (string, error) {
-	return "", nil
+	return VerifyHandlerContext(context.Background(), body)
+}
+
+// VerifyHandlerContext VerifyHandler bounded by ctx
+func VerifyHandlerContext(ctx context.Context, body string) (string, error) {
+	return NewService().VerifyHandler(ctx, body)
+}
+
+// VerifyHandler ...
+func (s Service) VerifyHandler(ctx context.Context, body string) (string, error) {
+	r := VerifyRequest{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall verify", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall verify: %w", WithKind(ErrValidation, err))
+	}
+
+	rf, err := s.Verify(ctx, r.Token)
+	if err != nil {
+		s.Logger.Error("can't verify", Fields{"err": err})
+		return "", fmt.Errorf("can't verify: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall verify", Fields{"err": err, "response": rf})
+		return "", fmt.Errorf("can't marshall verify: %w", err)
+	}
+
+	return string(rfb), nil
 }
 
 // Verify ...
-func Verify(p permissions.Permissions) (permissions.Permissions, error) {
-	return permissions.Permissions{}, nil
+func Verify(token string) (VerifyObject, error) {
+	return VerifyContext(context.Background(), token)
+}
+
+// VerifyContext Verify bounded by ctx
+func VerifyContext(ctx context.Context, token string) (VerifyObject, error) {
+	return NewService().Verify(ctx, token)
+}
+
+// Verify use the token to mark the account as verified
+func (s Service) Verify(ctx context.Context, token string) (VerifyObject, error) {
+	claims, err := s.Verification.parse(token, s.now())
+	if err != nil {
+		return VerifyObject{}, err
+	}
+
+	v, ok, err := s.Verifications.Get(claims.Identifier)
+	if err != nil {
+		return VerifyObject{}, fmt.Errorf("verification get: %w", err)
+	}
+	if !ok {
+		return VerifyObject{}, ErrVerifyToken
+	}
+
+	if !v.Verified {
+		v.Verified = true
+		err = s.Verifications.Save(v)
+		if err != nil {
+			return VerifyObject{}, fmt.Errorf("verification save: %w", err)
+		}
+	}
+
+	return VerifyObject{
+		Identifier: v.Identifier,
+		Status:     "verified",
+	}, nil
+}
+
+// VerifyResendHandler ...
+func (s Service) VerifyResendHandler(ctx context.Context, body string) (string, error) {
+	r := VerifyResend{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		s.Logger.Error("can't unmarshall verify resend", Fields{"err": err})
+		return "", fmt.Errorf("can't unmarshall verify resend: %w", WithKind(ErrValidation, err))
+	}
+
+	rf, err := s.Resend(ctx, r)
+	if err != nil {
+		s.Logger.Error("can't resend verify", Fields{"err": err})
+		return "", fmt.Errorf("can't resend verify: %w", err)
+	}
+
+	rfb, err := json.Marshal(rf)
+	if err != nil {
+		s.Logger.Error("can't marshall verify resend", Fields{"err": err, "response": rf})
+		return "", fmt.Errorf("can't marshall verify resend: %w", err)
+	}
+
+	return string(rfb), nil
+}
+
+// Resend send the verification again, the response is the same whether or
+// not anything was sent so it can't be used to find accounts
+func (s Service) Resend(ctx context.Context, r VerifyResend) (VerifyObject, error) {
+	vo := VerifyObject{
+		Status: "sent",
+	}
+	if strings.TrimSpace(r.Email) == "" {
+		return VerifyObject{}, WithKind(ErrValidation, fmt.Errorf("missing email address"))
+	}
+
+	ident, email, err := s.accountFor(ctx, r.Email)
+	if errors.Is(err, ErrNotFound) {
+		return vo, nil
+	}
+	if err != nil {
+		return VerifyObject{}, err
+	}
+	v, ok, err := s.Verifications.Get(ident)
+	if err != nil {
+		return VerifyObject{}, fmt.Errorf("verification get: %w", err)
+	}
+	if !ok {
+		// an account made before verification, or whose record was lost
+		v = Verification{
+			Identifier: ident,
+			Email:      email,
+		}
+	}
+	if v.Verified {
+		return vo, nil
+	}
+	if s.now().Sub(v.Sent) < s.Verification.Cooldown {
+		s.Logger.Info("verify resend cooldown", nil)
+		return vo, nil
+	}
+
+	err = s.sendVerification(v)
+	if err != nil {
+		return VerifyObject{}, err
+	}
+
+	return vo, nil
+}
+
+// sendVerification store the account as unverified and send it a token
+func (s Service) sendVerification(v Verification) error {
+	now := s.now()
+	token, err := s.Verification.sign(verifyClaims{
+		Identifier: v.Identifier,
+		Expires:    now.Add(s.Verification.TTL).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("verification sign: %w", err)
+	}
+
+	v.Sent = now
+	err = s.Verifications.Save(v)
+	if err != nil {
+		return fmt.Errorf("verification save: %w", err)
+	}
+
+	err = s.Notifier.Notify(Notification{
+		Type:  NotificationVerify,
+		Email: v.Email,
+		Token: token,
+	})
+	if err != nil {
+		s.Logger.Error("verify notify err", Fields{"err": err})
+	}
+
+	return nil
+}
+
+// verified whether the account can login, and whether it is verified
+func (s Service) verified(ident string) (bool, error) {
+	if s.Verification.Login == VerifyLoginAllow {
+		return true, nil
+	}
+
+	v, ok, err := s.Verifications.Get(ident)
+	if err != nil {
+		return false, fmt.Errorf("verification get: %w", err)
+	}
+	if ok && v.Verified {
+		return true, nil
+	}
+
+	if s.Verification.Login == VerifyLoginRefuse {
+		return false, ErrUnverified
+	}
+
+	return false, nil
 }
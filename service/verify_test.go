@@ -1,8 +1,213 @@
 package service_test
 
 import (
+	"context"
+	"errors"
+	"github.com/carprks/account/service"
+	login "github.com/carprks/login/service"
+	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
+	"time"
 )
 
+func verifyService(mode string) (service.Service, *captureNotifier, *time.Time) {
+	notifier := &captureNotifier{}
+	now := time.Now()
+
+	s := service.NewService()
+	s.Notifier = notifier
+	s.Verifications = service.NewMemoryVerificationStore()
+	s.Verification = service.VerifyConfig{
+		Key:      []byte("verify-key"),
+		TTL:      service.VerifyTTL,
+		Cooldown: service.VerifyCooldown,
+		Login:    mode,
+	}
+	s.Clock = func() time.Time {
+		return now
+	}
+
+	return s, notifier, &now
+}
+
 func TestVerify(t *testing.T) {
+	s, notifier, _ := verifyService(service.VerifyLoginFlag)
+
+	resp, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	if err != nil {
+		t.Errorf("verify register failed: %v", err)
+	}
+	sent := notifier.last()
+	assert.Equal(t, service.NotificationVerify, sent.Type)
+	assert.Equal(t, "tester@carpark.ninja", sent.Email)
+
+	lo, err := s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.True(t, lo.Unverified)
+
+	body, err := s.VerifyHandler(context.Background(), `{"token":"`+sent.Token+`"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"identifier":"5f46cf19-5399-55e3-aa62-0e7c19382250","status":"verified"}`, body)
+
+	lo, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+	assert.False(t, lo.Unverified)
+
+	deleteAccount(resp.Identifier)
+}
+
+func TestVerifyRefuse(t *testing.T) {
+	s, notifier, _ := verifyService(service.VerifyLoginRefuse)
+
+	resp, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	if err != nil {
+		t.Errorf("verify register failed: %v", err)
+	}
+
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.True(t, errors.Is(err, service.ErrUnverified))
+
+	_, err = s.Verify(context.Background(), notifier.last().Token)
+	assert.Nil(t, err)
+
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	deleteAccount(resp.Identifier)
+}
+
+func TestVerifyToken(t *testing.T) {
+	s, notifier, now := verifyService(service.VerifyLoginFlag)
+
+	resp, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	if err != nil {
+		t.Errorf("verify register failed: %v", err)
+	}
+	token := notifier.last().Token
+
+	_, err = s.Verify(context.Background(), token+"a")
+	assert.Equal(t, service.ErrVerifyToken, err)
+	_, err = s.Verify(context.Background(), "not.a.token")
+	assert.Equal(t, service.ErrVerifyToken, err)
+
+	other := s
+	other.Verification.Key = []byte("other-key")
+	_, err = other.Verify(context.Background(), token)
+	assert.Equal(t, service.ErrVerifyToken, err)
+
+	*now = now.Add(service.VerifyTTL)
+	_, err = s.Verify(context.Background(), token)
+	assert.Equal(t, service.ErrVerifyToken, err)
+
+	deleteAccount(resp.Identifier)
+}
+
+func TestVerifyResend(t *testing.T) {
+	s, notifier, now := verifyService(service.VerifyLoginFlag)
+
+	resp, err := s.Register(context.Background(), login.RegisterRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+		Verify:   "Carpark-Ninja-2019",
+	})
+	if err != nil {
+		t.Errorf("verify register failed: %v", err)
+	}
+	assert.Len(t, notifier.sent, 1)
+
+	body, err := s.VerifyResendHandler(context.Background(), `{"email":"tester@carpark.ninja"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"status":"sent"}`, body)
+	assert.Len(t, notifier.sent, 1)
+
+	*now = now.Add(service.VerifyCooldown)
+	_, err = s.Resend(context.Background(), service.VerifyResend{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, notifier.sent, 2)
+
+	body, err = s.VerifyResendHandler(context.Background(), `{"email":"failure@carpark.ninja"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"status":"sent"}`, body)
+	assert.Len(t, notifier.sent, 2)
+
+	deleteAccount(resp.Identifier)
+}
+
+func TestVerifyFailClosed(t *testing.T) {
+	s, notifier, now := verifyService(service.VerifyLoginRefuse)
+	_, err := s.Register(context.Background(), testsRegister[0].request)
+	assert.Nil(t, err)
+
+	// an account the store has nothing on isn't taken to be verified
+	s.Verifications = service.NewMemoryVerificationStore()
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.True(t, errors.Is(err, service.ErrUnverified))
+
+	*now = now.Add(service.VerifyCooldown)
+	_, err = s.Resend(context.Background(), service.VerifyResend{
+		Email: "tester@carpark.ninja",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, notifier.sent, 2)
+	_, err = s.Verify(context.Background(), notifier.last().Token)
+	assert.Nil(t, err)
+	_, err = s.Login(context.Background(), login.LoginRequest{
+		Email:    "tester@carpark.ninja",
+		Password: "Carpark-Ninja-2019",
+	})
+	assert.Nil(t, err)
+
+	// without a key nothing is signed or accepted
+	token := notifier.last().Token
+	s.Verification.Key = nil
+	_, err = s.Verify(context.Background(), token)
+	assert.Equal(t, service.ErrVerifyToken, err)
+
+	deleteAccount(login.GenerateIdent("tester@carpark.ninja"))
+}
+
+func TestNewVerifyConfig(t *testing.T) {
+	key := os.Getenv("VERIFY_KEY")
+	defer func() {
+		_ = os.Setenv("VERIFY_KEY", key)
+	}()
+
+	_ = os.Unsetenv("VERIFY_KEY")
+	_, err := service.NewVerifyConfig()
+	assert.Equal(t, service.ErrVerifyKey, err)
+
+	_ = os.Setenv("VERIFY_KEY", "verify-key")
+	c, err := service.NewVerifyConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("verify-key"), c.Key)
 }
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WorkerInterval how often the server runs the scheduled jobs, the lambda is
+// run by a schedule instead
+const WorkerInterval = time.Minute * 15
+
+// WorkSummary what a run of the scheduled jobs did
+type WorkSummary struct {
+	Purged   int `json:"purged"`
+	Exported int `json:"exported"`
+}
+
+// Work ...
+func Work() (WorkSummary, error) {
+	return WorkContext(context.Background())
+}
+
+// WorkContext Work bounded by ctx
+func WorkContext(ctx context.Context) (WorkSummary, error) {
+	return NewService().Work(ctx)
+}
+
+// Work run the jobs that no request starts, a job that fails is left for the
+// next run
+func (s Service) Work(ctx context.Context) (WorkSummary, error) {
+	sum := WorkSummary{}
+
+	// one job failing doesn't stop the other
+	var purgeErr, exportErr error
+	sum.Purged, purgeErr = s.PurgeDeletions(ctx)
+	if purgeErr != nil {
+		s.Logger.Error("can't purge deletions", Fields{"err": purgeErr, "purged": sum.Purged})
+	}
+	sum.Exported, exportErr = s.ProcessExports(ctx)
+	if exportErr != nil {
+		s.Logger.Error("can't process exports", Fields{"err": exportErr, "exported": sum.Exported})
+	}
+
+	s.Logger.Info("work done", Fields{"purged": sum.Purged, "exported": sum.Exported})
+	if purgeErr != nil {
+		return sum, fmt.Errorf("can't purge deletions: %w", purgeErr)
+	}
+	if exportErr != nil {
+		return sum, fmt.Errorf("can't process exports: %w", exportErr)
+	}
+
+	return sum, nil
+}